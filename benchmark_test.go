@@ -223,3 +223,24 @@ func BenchmarkConcurrentMap_ReadWrite(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkCompressDictionary(b *testing.B) {
+	var dict = []byte(`{"id":0,"user_name":"","email_address":"","created_at":"","updated_at":"","status":"active","roles":["member"]}`)
+	var payload = []byte(`{"id":42,"user_name":"caster","email_address":"caster@example.com","created_at":"2023-01-01","updated_at":"2023-06-01","status":"active","roles":["member"]}`)
+
+	for _, item := range []struct {
+		name string
+		dict []byte
+	}{{name: "none", dict: nil}, {name: "preset", dict: dict}} {
+		b.Run(item.name, func(b *testing.B) {
+			var pd = PermessageDeflate{Enabled: true, Level: defaultCompressLevel, ClientMaxWindowBits: 15}
+			var d = new(deflater).initialize(false, pd, defaultReadMaxPayloadSize)
+			var buf = bytes.NewBuffer(nil)
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				_ = d.Compress(internal.Bytes(payload), buf, item.dict)
+			}
+			b.ReportMetric(float64(buf.Len())/float64(len(payload)), "ratio")
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -101,8 +102,18 @@ func (c *connector) request() (*http.Response, *bufio.Reader, error) {
 	r.Header.Set(internal.Connection.Key, internal.Connection.Val)
 	r.Header.Set(internal.Upgrade.Key, internal.Upgrade.Val)
 	r.Header.Set(internal.SecWebSocketVersion.Key, internal.SecWebSocketVersion.Val)
+	var offers []string
 	if c.option.PermessageDeflate.Enabled {
-		r.Header.Set(internal.SecWebSocketExtensions.Key, c.option.PermessageDeflate.genRequestHeader())
+		offers = append(offers, c.option.PermessageDeflate.genRequestHeader())
+	}
+	for _, ext := range c.option.Extensions {
+		offers = append(offers, extensionElement{name: ext.Name(), params: ext.Offer()}.String())
+	}
+	if len(offers) > 0 {
+		r.Header.Set(internal.SecWebSocketExtensions.Key, strings.Join(offers, ", "))
+	}
+	if c.option.AdvertiseMaxPayload {
+		r.Header.Set(internal.SecWebSocketMaxPayload.Key, strconv.Itoa(c.option.ReadMaxPayloadSize))
 	}
 	if c.secWebsocketKey == "" {
 		var key [16]byte
@@ -146,6 +157,9 @@ func (c *connector) getPermessageDeflate(extensions string) PermessageDeflate {
 		Threshold:             clientPD.Threshold,
 		Level:                 clientPD.Level,
 		PoolSize:              clientPD.PoolSize,
+		Dictionary:            clientPD.Dictionary,
+		NewCompressor:         clientPD.NewCompressor,
+		Adaptive:              clientPD.Adaptive,
 		ServerContextTakeover: serverPD.ServerContextTakeover,
 		ClientContextTakeover: serverPD.ClientContextTakeover,
 		ServerMaxWindowBits:   serverPD.ServerMaxWindowBits,
@@ -171,22 +185,34 @@ func (c *connector) handshake() (*Conn, *http.Response, error) {
 	}
 
 	var extensions = resp.Header.Get(internal.SecWebSocketExtensions.Key)
-	var pd = c.getPermessageDeflate(extensions)
+	var pd = c.getPermessageDeflate(deflateExtensions(extensions))
+	enabled, err := acceptExtensions(c.option.Extensions, extensions)
+	if err != nil {
+		return nil, resp, err
+	}
+	config := c.option.getConfig()
 	socket := &Conn{
 		ss:                c.option.NewSession(),
 		isServer:          false,
 		subprotocol:       subprotocol,
+		secure:            strings.HasPrefix(c.option.Addr, "wss://"),
 		pd:                pd,
 		conn:              c.conn,
-		config:            c.option.getConfig(),
+		config:            config,
 		br:                br,
 		continuationFrame: continuationFrame{},
 		fh:                frameHeader{},
 		handler:           c.eventHandler,
 		closed:            0,
 		deflater:          new(deflater),
-		writeQueue:        workerQueue{maxConcurrency: 1},
+		writeQueue:        newWriteQueue(config),
+		limiter:           newRateLimiter(config.WriteRateLimit),
 		readQueue:         make(channel, c.option.ParallelGolimit),
+		extensions:        enabled,
+		extensionHeader:   extensions,
+	}
+	if c.option.AdvertiseMaxPayload {
+		socket.peerMaxPayloadSize = parseMaxPayloadSize(resp.Header)
 	}
 
 	// 压缩字典和解压字典内存开销比较大, 故使用懒加载
@@ -199,6 +225,10 @@ func (c *connector) handshake() (*Conn, *http.Response, error) {
 		if pd.ClientContextTakeover {
 			socket.cpsWindow.initialize(nil, pd.ClientMaxWindowBits)
 		}
+		socket.presetDictionary()
+		if pd.NewCompressor != nil {
+			socket.compressor, socket.decompressor = pd.NewCompressor()
+		}
 	}
 	return socket, resp, c.conn.SetDeadline(time.Time{})
 }
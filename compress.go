@@ -18,6 +18,57 @@ import (
 // The tail marker of the deflate compression algorithm
 var flateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
 
+type (
+	// Compressor 压缩器
+	// Compressor
+	Compressor interface {
+		// Compress 压缩 src 并将结果追加到 dst, dict 为压缩字典, 可能为 nil
+		// Compresses src and appends the result to dst, dict is the compression dictionary and may be nil
+		Compress(src io.WriterTo, dst *bytes.Buffer, dict []byte) error
+	}
+
+	// Decompressor 解压器
+	// Decompressor
+	Decompressor interface {
+		// Decompress 解压 src, dict 为解压字典, 可能为 nil. 返回的 buffer 会在消息关闭时回收到内存池.
+		// 解压结果超过 ReadMaxPayloadSize 时连接以 1009 状态码关闭. 该检查在解压之后进行, 实现应当自行限制输出长度, 以防压缩炸弹.
+		// Decompresses src, dict is the decompression dictionary and may be nil.
+		// The returned buffer is recycled to the memory pool when the message is closed.
+		// If the result exceeds ReadMaxPayloadSize, the connection is closed with status code 1009. The check happens
+		// after decompression, so implementations should limit their output themselves to guard against zip bombs.
+		Decompress(src *bytes.Buffer, dict []byte) (*bytes.Buffer, error)
+	}
+)
+
+// 自适应压缩的评估窗口(消息数)和压缩率阈值
+// Evaluation window (in messages) and compression ratio threshold of adaptive compression
+const (
+	adaptiveWindow = 64
+	adaptiveRatio  = 0.95
+)
+
+// 自适应压缩的统计
+// Statistics of adaptive compression
+type adaptiveStats struct {
+	messages   int
+	raw        int
+	compressed int
+}
+
+// 记录一条压缩消息, 评估窗口结束时返回压缩是否划算
+// Records a compressed message, returns whether compression pays off when the evaluation window ends
+func (c *adaptiveStats) observe(raw, compressed int) bool {
+	c.messages++
+	c.raw += raw
+	c.compressed += compressed
+	if c.messages < adaptiveWindow {
+		return true
+	}
+	var ok = float64(c.compressed) <= float64(c.raw)*adaptiveRatio
+	*c = adaptiveStats{}
+	return ok
+}
+
 type deflaterPool struct {
 	serial uint64
 	num    uint64
@@ -59,12 +110,19 @@ func (c *deflater) initialize(isServer bool, options PermessageDeflate, limit in
 	c.buf = make([]byte, 32*1024)
 	c.limit = limit
 	windowBits := internal.SelectValue(isServer, options.ServerMaxWindowBits, options.ClientMaxWindowBits)
+	c.cpsWriter = newFlateWriter(windowBits, options.Level)
+	return c
+}
+
+// 创建 flate 压缩器, 滑动窗口小于 32KB 时不支持设置压缩级别
+// Creates a flate writer, the compression level cannot be set if the sliding window is smaller than 32KB
+func newFlateWriter(windowBits int, level int) *flate.Writer {
 	if windowBits == 15 {
-		c.cpsWriter, _ = flate.NewWriter(nil, options.Level)
-	} else {
-		c.cpsWriter, _ = flate.NewWriterWindow(nil, internal.BinaryPow(windowBits))
+		cpsWriter, _ := flate.NewWriter(nil, level)
+		return cpsWriter
 	}
-	return c
+	cpsWriter, _ := flate.NewWriterWindow(nil, internal.BinaryPow(windowBits))
+	return cpsWriter
 }
 
 // 重置deflate reader
@@ -97,7 +155,7 @@ func (c *deflater) Decompress(src *bytes.Buffer, dict []byte) (*bytes.Buffer, er
 
 // Compress 压缩
 // Compress data
-func (c *deflater) Compress(src internal.Payload, dst *bytes.Buffer, dict []byte) error {
+func (c *deflater) Compress(src io.WriterTo, dst *bytes.Buffer, dict []byte) error {
 	c.cpsLocker.Lock()
 	defer c.cpsLocker.Unlock()
 	if err := compressTo(c.cpsWriter, src, dst, dict); err != nil {
@@ -171,6 +229,102 @@ func (c *slideWindow) Write(p []byte) (int, error) {
 	return total, nil
 }
 
+// 返回连接使用的压缩器, 默认为 permessage-deflate
+// Returns the compressor of the connection, defaults to permessage-deflate
+func (c *Conn) getCompressor() Compressor {
+	if c.compressor != nil {
+		return c.compressor
+	}
+	if d := c.getCpsDeflater(); d != nil {
+		return d
+	}
+	return c.deflater
+}
+
+// 返回连接独占的压缩器, 没有时返回 nil. 广播不持有 c.mu, 所以该字段需要原子读写
+// Returns the compressor owned by the connection, or nil. Broadcasts do not hold c.mu, so the field is accessed atomically.
+func (c *Conn) getCpsDeflater() *deflater {
+	d, _ := c.cpsDeflater.Load().(*deflater)
+	return d
+}
+
+// SetCompressionLevel 设置当前连接的压缩级别
+// 取值范围为 flate.BestSpeed 到 flate.BestCompression, 或者 flate.DefaultCompression.
+// 调用后连接不再共享压缩器池, 会额外占用一个压缩器的内存. 未开启压缩或者使用自定义压缩器时不生效.
+// 滑动窗口指数小于15时 flate 不支持设置压缩级别, 此时返回 ErrCompressionLevel, 压缩器保持不变.
+// 可以在写入进行中调用, 正在进行的写入继续使用原来的压缩器.
+// Sets the compression level of this connection.
+// The level ranges from flate.BestSpeed to flate.BestCompression, or is flate.DefaultCompression.
+// After the call, the connection no longer shares the compressor pool and owns a compressor of its own.
+// It has no effect if compression is off or a custom compressor is used.
+// flate does not support compression levels when the window bits are less than 15,
+// ErrCompressionLevel is returned in that case and the compressor is left untouched.
+// It may be called while writes are in flight, writes already in progress keep using the previous compressor.
+func (c *Conn) SetCompressionLevel(level int) error {
+	if level != flate.DefaultCompression && (level < flate.BestSpeed || level > flate.BestCompression) {
+		return ErrCompressionLevel
+	}
+	if !c.pd.Enabled || c.compressor != nil {
+		return nil
+	}
+	windowBits := internal.SelectValue(c.isServer, c.pd.ServerMaxWindowBits, c.pd.ClientMaxWindowBits)
+	if windowBits != 15 {
+		return ErrCompressionLevel
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cpsDeflater.Store(&deflater{cpsWriter: newFlateWriter(windowBits, level)})
+	return nil
+}
+
+// 返回连接使用的解压器, 默认为 permessage-deflate
+// Returns the decompressor of the connection, defaults to permessage-deflate
+func (c *Conn) getDecompressor() Decompressor {
+	if c.decompressor != nil {
+		return c.decompressor
+	}
+	return c.deflater
+}
+
+// ResetCompressionContext 清空压缩滑动窗口, 下一条消息将从头开始压缩, 不会引用之前发送的内容
+// 适用于发送了一次性的大消息之后, 避免它占据滑动窗口, 降低后续消息的压缩率.
+// 只在开启了本端的上下文接管时有效; 协商了 no_context_takeover 时每条消息本来就独立压缩, 调用不产生任何效果.
+// 对端的解压窗口保持不变, 所以不需要额外的协商. 清空后也不会再使用预置字典.
+// Clears the compression sliding window, the next message is compressed from scratch without referencing earlier data.
+// It is useful after a large one-off message, so that it does not occupy the window and hurt the ratio of later messages.
+// It only has an effect with context takeover on this side;
+// with no_context_takeover negotiated every message is already compressed independently and the call does nothing.
+// The decompression window of the peer is left intact, so no extra negotiation is needed.
+// The preset dictionary is not used again after the reset.
+func (c *Conn) ResetCompressionContext() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waitFragments()
+	if c.cpsWindow.enabled {
+		c.cpsWindow.dict = c.cpsWindow.dict[:0]
+	}
+}
+
+// 使用预置字典填充滑动窗口
+// Fills the sliding windows with the preset dictionary
+func (c *Conn) presetDictionary() {
+	_, _ = c.cpsWindow.Write(c.pd.Dictionary)
+	_, _ = c.dpsWindow.Write(c.pd.Dictionary)
+}
+
+// 返回压缩字典, 开启上下文接管时为滑动窗口, 否则为预置字典
+// Returns the compression dictionary, the sliding window with context takeover, otherwise the preset dictionary
+func (c *Conn) compressDict() []byte {
+	return internal.SelectValue(c.cpsWindow.enabled, c.cpsWindow.dict, c.pd.Dictionary)
+}
+
+// 返回解压字典, 开启上下文接管时为滑动窗口, 否则为预置字典
+// Returns the decompression dictionary, the sliding window with context takeover, otherwise the preset dictionary
+func (c *Conn) decompressDict() []byte {
+	return internal.SelectValue(c.dpsWindow.enabled, c.dpsWindow.dict, c.pd.Dictionary)
+}
+
 // 生成请求头
 // Generate request headers
 func (c *PermessageDeflate) genRequestHeader() string {
@@ -1,11 +1,19 @@
 package gws
 
 import (
+	"bytes"
+	"crypto/rand"
 	"errors"
 	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/flate"
 	"github.com/lxzan/gws/internal"
 
 	"github.com/stretchr/testify/assert"
@@ -96,12 +104,27 @@ func TestPermessageNegotiation(t *testing.T) {
 			},
 		})
 		assert.NoError(t, err)
+		assert.True(t, client.CompressionEnabled())
 		assert.Equal(t, client.cpsWindow.size, 1024)
 		assert.Equal(t, client.dpsWindow.size, 1024)
 		assert.Equal(t, client.pd.ServerContextTakeover, true)
 		assert.Equal(t, client.pd.ClientContextTakeover, true)
 	})
 
+	t.Run("not negotiated", func(t *testing.T) {
+		var addr = ":" + nextPort()
+		var server = NewServer(new(BuiltinEventHandler), &ServerOption{})
+		go server.Run(addr)
+
+		time.Sleep(100 * time.Millisecond)
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:              "ws://localhost" + addr,
+			PermessageDeflate: PermessageDeflate{Enabled: true},
+		})
+		assert.NoError(t, err)
+		assert.False(t, client.CompressionEnabled())
+	})
+
 	t.Run("ok 2", func(t *testing.T) {
 		var addr = ":" + nextPort()
 		var server = NewServer(new(BuiltinEventHandler), &ServerOption{PermessageDeflate: PermessageDeflate{
@@ -263,3 +286,529 @@ func (c *writerTo) WriteTo(w io.Writer) (n int64, err error) {
 func (c *writerTo) Read(p []byte) (n int, err error) {
 	return 0, errors.New("1")
 }
+
+func TestPermessageDeflate_Dictionary(t *testing.T) {
+	var as = assert.New(t)
+	var dict = []byte(`{"id":0,"user_name":"","email_address":"","created_at":"","updated_at":"","status":"active","roles":["member"]}`)
+	var payload = []byte(`{"id":42,"user_name":"caster","email_address":"caster@example.com","created_at":"2023-01-01","updated_at":"2023-06-01","status":"active","roles":["member"]}`)
+
+	var run = func(takeover bool, dictionary []byte) (written int64) {
+		var pd = PermessageDeflate{
+			Enabled:               true,
+			Threshold:             1,
+			ServerContextTakeover: takeover,
+			ClientContextTakeover: takeover,
+			Dictionary:            dictionary,
+		}
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		}
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(string(payload), message.Data.String())
+			wg.Done()
+		}
+		var server = httptest.NewServer(NewUpgrader(serverHandler, &ServerOption{PermessageDeflate: pd}).Handler())
+		defer server.Close()
+
+		client, _, err := NewClient(clientHandler, &ClientOption{
+			Addr:              "ws" + strings.TrimPrefix(server.URL, "http"),
+			PermessageDeflate: pd,
+		})
+		if !as.NoError(err) {
+			return 0
+		}
+		go client.ReadLoop()
+		for i := 0; i < 3; i++ {
+			as.NoError(client.WriteMessage(OpcodeText, payload))
+		}
+		wg.Wait()
+		_ = client.WriteClose(1000, nil)
+		return client.Stats().BytesWritten
+	}
+
+	t.Run("no context takeover", func(t *testing.T) {
+		as.Less(run(false, dict), run(false, nil))
+	})
+
+	t.Run("context takeover", func(t *testing.T) {
+		as.Less(run(true, dict), run(true, nil))
+	})
+}
+
+// 测试用的编解码器, 对每个字节取反
+type xorCodec struct{ calls int64 }
+
+func (c *xorCodec) Compress(src io.WriterTo, dst *bytes.Buffer, dict []byte) error {
+	atomic.AddInt64(&c.calls, 1)
+	var offset = dst.Len()
+	if _, err := src.WriteTo(dst); err != nil {
+		return err
+	}
+	var p = dst.Bytes()[offset:]
+	for i := range p {
+		p[i] ^= 0xFF
+	}
+	return nil
+}
+
+func (c *xorCodec) Decompress(src *bytes.Buffer, dict []byte) (*bytes.Buffer, error) {
+	atomic.AddInt64(&c.calls, 1)
+	var dst = binaryPool.Get(src.Len())
+	for _, b := range src.Bytes() {
+		dst.WriteByte(b ^ 0xFF)
+	}
+	return dst, nil
+}
+
+func TestPermessageDeflate_NewCompressor(t *testing.T) {
+	var as = assert.New(t)
+	var serverCodec, clientCodec = new(xorCodec), new(xorCodec)
+	var newPD = func(codec *xorCodec) PermessageDeflate {
+		return PermessageDeflate{
+			Enabled:       true,
+			Threshold:     1,
+			NewCompressor: func() (Compressor, Decompressor) { return codec, codec },
+		}
+	}
+
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	var messages = make(chan string, 2)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	var server = httptest.NewServer(NewUpgrader(serverHandler, &ServerOption{PermessageDeflate: newPD(serverCodec)}).Handler())
+	defer server.Close()
+
+	client, _, err := NewClient(clientHandler, &ClientOption{
+		Addr:              "ws" + strings.TrimPrefix(server.URL, "http"),
+		PermessageDeflate: newPD(clientCodec),
+	})
+	if !as.NoError(err) {
+		return
+	}
+	go client.ReadLoop()
+
+	as.NoError(client.WriteString("hello"))
+	as.Equal("hello", <-messages)
+
+	var content = internal.AlphabetNumeric.Generate(300 * 1024)
+	as.NoError(client.WriteFile(OpcodeBinary, bytes.NewReader(content)))
+	as.Equal(string(content), <-messages)
+
+	as.Equal(int64(4), atomic.LoadInt64(&clientCodec.calls))
+	as.Equal(int64(4), atomic.LoadInt64(&serverCodec.calls))
+	_ = client.WriteClose(1000, nil)
+}
+
+// 测试用的解压器, 输出为输入的四倍
+type expandDecompressor struct{ xorCodec }
+
+func (c *expandDecompressor) Decompress(src *bytes.Buffer, dict []byte) (*bytes.Buffer, error) {
+	var dst, _ = c.xorCodec.Decompress(src, dict)
+	var p = dst.Bytes()
+	for i := 0; i < 3; i++ {
+		dst.Write(p)
+	}
+	return dst, nil
+}
+
+func TestPermessageDeflate_NewCompressor_PayloadLimit(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var received = make(chan int, 1)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		received <- message.Data.Len()
+	}
+	var closed = make(chan error, 1)
+	clientHandler.onClose = func(socket *Conn, err error) {
+		closed <- err
+	}
+	var server = httptest.NewServer(NewUpgrader(serverHandler, &ServerOption{
+		ReadMaxPayloadSize: 1024,
+		PermessageDeflate: PermessageDeflate{
+			Enabled:       true,
+			Threshold:     1,
+			NewCompressor: func() (Compressor, Decompressor) { return new(xorCodec), new(expandDecompressor) },
+		},
+	}).Handler())
+	defer server.Close()
+
+	var codec = new(xorCodec)
+	client, _, err := NewClient(clientHandler, &ClientOption{
+		Addr: "ws" + strings.TrimPrefix(server.URL, "http"),
+		PermessageDeflate: PermessageDeflate{
+			Enabled:       true,
+			Threshold:     1,
+			NewCompressor: func() (Compressor, Decompressor) { return codec, codec },
+		},
+	})
+	if !as.NoError(err) {
+		return
+	}
+	go client.ReadLoop()
+
+	as.NoError(client.WriteMessage(OpcodeBinary, make([]byte, 256)))
+	as.Equal(1024, <-received)
+
+	// 解压后超过 ReadMaxPayloadSize, 以 1009 状态码关闭
+	// It exceeds ReadMaxPayloadSize after decompression, so the connection is closed with status code 1009
+	as.NoError(client.WriteMessage(OpcodeBinary, make([]byte, 512)))
+	var closeErr *CloseError
+	if err := <-closed; as.True(errors.As(err, &closeErr)) {
+		as.Equal(internal.CloseMessageTooLarge.Uint16(), closeErr.Code)
+	}
+}
+
+func TestConn_SetCompressionLevel(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("invalid level", func(t *testing.T) {
+		server, _ := newPeer(new(webSocketMocker), &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		as.ErrorIs(server.SetCompressionLevel(flate.NoCompression), ErrCompressionLevel)
+		as.ErrorIs(server.SetCompressionLevel(flate.BestCompression+1), ErrCompressionLevel)
+		as.NoError(server.SetCompressionLevel(flate.BestCompression))
+		as.Nil(server.getCpsDeflater())
+	})
+
+	t.Run("write", func(t *testing.T) {
+		var pd = PermessageDeflate{Enabled: true, Threshold: 1}
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var messages = make(chan string, 2)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			messages <- message.Data.String()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{PermessageDeflate: pd}, clientHandler, &ClientOption{PermessageDeflate: pd})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(server.SetCompressionLevel(flate.BestCompression))
+		as.NoError(server.SetCompressionLevel(flate.DefaultCompression))
+		as.NotNil(server.getCpsDeflater())
+
+		var content = strings.Repeat("hello, world! ", 64)
+		as.NoError(server.WriteString(content))
+		as.Equal(content, <-messages)
+
+		var file = internal.AlphabetNumeric.Generate(300 * 1024)
+		as.NoError(server.WriteFile(OpcodeBinary, bytes.NewReader(file)))
+		as.Equal(string(file), <-messages)
+		_ = server.WriteClose(1000, nil)
+	})
+
+	t.Run("small window", func(t *testing.T) {
+		var pd = PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true}
+		server, _ := newPeer(new(webSocketMocker), &ServerOption{PermessageDeflate: pd}, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+		as.Equal(12, server.pd.ServerMaxWindowBits)
+		as.ErrorIs(server.SetCompressionLevel(flate.BestCompression), ErrCompressionLevel)
+		as.Nil(server.getCpsDeflater())
+	})
+
+	t.Run("concurrent writes", func(t *testing.T) {
+		var pd = PermessageDeflate{Enabled: true, Threshold: 1}
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var messages = make(chan string, 64)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			messages <- message.Data.String()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{PermessageDeflate: pd}, clientHandler, &ClientOption{PermessageDeflate: pd})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var content = strings.Repeat("hello, world! ", 64)
+		var file = internal.AlphabetNumeric.Generate(64 * 1024)
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 8; i++ {
+				as.NoError(server.SetCompressionLevel(internal.SelectValue(i%2 == 0, flate.BestSpeed, flate.BestCompression)))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 8; i++ {
+				var broadcaster = NewBroadcaster(OpcodeText, []byte(content))
+				as.NoError(broadcaster.Broadcast(server))
+				_ = broadcaster.Close()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 4; i++ {
+				as.NoError(server.WriteFile(OpcodeBinary, bytes.NewReader(file)))
+			}
+		}()
+		wg.Wait()
+
+		for i := 0; i < 12; i++ {
+			var msg = <-messages
+			as.True(msg == content || msg == string(file))
+		}
+		_ = server.WriteClose(1000, nil)
+	})
+}
+
+func TestUpgrader_WindowBitsNegotiation(t *testing.T) {
+	var as = assert.New(t)
+	var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{PermessageDeflate: PermessageDeflate{
+		Enabled:               true,
+		ServerContextTakeover: true,
+		ClientContextTakeover: true,
+		ServerMaxWindowBits:   12,
+		ClientMaxWindowBits:   12,
+	}})
+
+	var cases = []struct {
+		extensions   string
+		serverBits   int
+		clientBits   int
+		responseHead string
+	}{
+		{
+			extensions:   "permessage-deflate",
+			serverBits:   12,
+			clientBits:   15,
+			responseHead: "permessage-deflate; server_max_window_bits=12",
+		},
+		{
+			extensions:   "permessage-deflate; client_max_window_bits",
+			serverBits:   12,
+			clientBits:   12,
+			responseHead: "permessage-deflate; server_max_window_bits=12; client_max_window_bits=12",
+		},
+		{
+			extensions:   "permessage-deflate; server_max_window_bits=9; client_max_window_bits=10",
+			serverBits:   9,
+			clientBits:   10,
+			responseHead: "permessage-deflate; server_max_window_bits=9; client_max_window_bits=10",
+		},
+	}
+	for _, item := range cases {
+		var pd = upgrader.getPermessageDeflate(item.extensions)
+		as.Equal(item.serverBits, pd.ServerMaxWindowBits)
+		as.Equal(item.clientBits, pd.ClientMaxWindowBits)
+		as.Equal(item.responseHead, pd.genResponseHeader())
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var sockets = make(chan *Conn, 1)
+		serverHandler.onOpen = func(socket *Conn) { sockets <- socket }
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			_ = socket.WriteMessage(message.Opcode, message.Data.Bytes())
+		}
+		var messages = make(chan string, 2)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			messages <- message.Data.String()
+		}
+		var pd = PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+		var server = httptest.NewServer(NewUpgrader(serverHandler, &ServerOption{PermessageDeflate: pd}).Handler())
+		defer server.Close()
+
+		pd.ServerMaxWindowBits, pd.ClientMaxWindowBits = 9, 10
+		client, resp, err := NewClient(clientHandler, &ClientOption{
+			Addr:              "ws" + strings.TrimPrefix(server.URL, "http"),
+			PermessageDeflate: pd,
+		})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		as.Equal(
+			"permessage-deflate; server_max_window_bits=9; client_max_window_bits=10",
+			resp.Header.Get(internal.SecWebSocketExtensions.Key),
+		)
+		var socket = <-sockets
+		as.Equal(512, socket.cpsWindow.size)
+		as.Equal(1024, socket.dpsWindow.size)
+		as.NotNil(socket.getCpsDeflater())
+
+		for i := 0; i < 2; i++ {
+			var content = string(internal.AlphabetNumeric.Generate(2048))
+			as.NoError(client.WriteString(content))
+			as.Equal(content, <-messages)
+		}
+		_ = client.WriteClose(1000, nil)
+	})
+}
+
+func TestConn_ResetCompressionContext(t *testing.T) {
+	var as = assert.New(t)
+	var pd = PermessageDeflate{Enabled: true, Threshold: 1, ServerContextTakeover: true, ClientContextTakeover: true}
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var sockets = make(chan *Conn, 1)
+	serverHandler.onOpen = func(socket *Conn) { sockets <- socket }
+	var messages = make(chan string, 1)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	var server = httptest.NewServer(NewUpgrader(serverHandler, &ServerOption{PermessageDeflate: pd}).Handler())
+	defer server.Close()
+
+	client, _, err := NewClient(clientHandler, &ClientOption{
+		Addr:              "ws" + strings.TrimPrefix(server.URL, "http"),
+		PermessageDeflate: pd,
+	})
+	if !as.NoError(err) {
+		return
+	}
+	go client.ReadLoop()
+	var socket = <-sockets
+
+	var content = string(internal.AlphabetNumeric.Generate(1024))
+	var write = func() int64 {
+		var n = socket.Stats().BytesWritten
+		as.NoError(socket.WriteString(content))
+		as.Equal(content, <-messages)
+		return socket.Stats().BytesWritten - n
+	}
+
+	var first = write()
+	as.Less(write(), first/4)
+	socket.ResetCompressionContext()
+	as.Equal(0, len(socket.cpsWindow.dict))
+	as.Equal(first, write())
+	as.Less(write(), first/4)
+	_ = client.WriteClose(1000, nil)
+
+	t.Run("no context takeover", func(t *testing.T) {
+		server, _ := newPeer(new(webSocketMocker), &ServerOption{PermessageDeflate: PermessageDeflate{Enabled: true}}, new(webSocketMocker), &ClientOption{})
+		server.ResetCompressionContext()
+		as.False(server.cpsWindow.enabled)
+	})
+}
+
+func TestPermessageDeflate_Adaptive(t *testing.T) {
+	var as = assert.New(t)
+
+	var run = func(pd PermessageDeflate, generate func() []byte) (*Conn, []int) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(adaptiveWindow + 1)
+		var messages []int
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			messages = append(messages, message.Data.Len())
+			wg.Done()
+		}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{PermessageDeflate: pd})
+		server, client, err := NewPipeConns(upgrader, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+		as.NoError(err)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		for i := 0; i < adaptiveWindow+1; i++ {
+			as.NoError(client.WriteMessage(OpcodeBinary, generate()))
+		}
+		wg.Wait()
+		return client, messages
+	}
+
+	var random = func() []byte {
+		var p = make([]byte, 1024)
+		_, _ = rand.Read(p)
+		return p
+	}
+	var text = func() []byte {
+		return bytes.Repeat([]byte("hello, world! "), 64)
+	}
+
+	t.Run("incompressible", func(t *testing.T) {
+		client, messages := run(PermessageDeflate{Enabled: true, Threshold: 1, Adaptive: true}, random)
+		as.False(client.CompressionEnabled())
+		as.Equal(1024, messages[adaptiveWindow])
+	})
+
+	t.Run("compressible", func(t *testing.T) {
+		client, _ := run(PermessageDeflate{Enabled: true, Threshold: 1, Adaptive: true}, text)
+		as.True(client.CompressionEnabled())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		client, _ := run(PermessageDeflate{Enabled: true, Threshold: 1}, random)
+		as.True(client.CompressionEnabled())
+	})
+
+	t.Run("context takeover", func(t *testing.T) {
+		var pd = PermessageDeflate{Enabled: true, Adaptive: true, ServerContextTakeover: true, ClientContextTakeover: true}
+		client, _ := run(pd, random)
+		as.True(client.CompressionEnabled())
+	})
+}
+
+func TestPermessageDeflate_AsymmetricContextTakeover(t *testing.T) {
+	var as = assert.New(t)
+
+	var run = func(serverTakeover, clientTakeover bool) {
+		const count = 8
+		var wg = &sync.WaitGroup{}
+		wg.Add(2 * count)
+		var serverReceived, clientReceived []string
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			serverReceived = append(serverReceived, message.Data.String())
+			wg.Done()
+		}
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			clientReceived = append(clientReceived, message.Data.String())
+			wg.Done()
+		}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{PermessageDeflate: PermessageDeflate{
+			Enabled:               true,
+			Threshold:             1,
+			ServerContextTakeover: true,
+			ClientContextTakeover: true,
+		}})
+		server, client, err := NewPipeConns(upgrader, clientHandler, &ClientOption{PermessageDeflate: PermessageDeflate{
+			Enabled:               true,
+			Threshold:             1,
+			ServerContextTakeover: serverTakeover,
+			ClientContextTakeover: clientTakeover,
+		}})
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 双方按照握手的结果分别配置每个方向的滑动窗口
+		// Both sides configure the sliding window of each direction according to the handshake result
+		as.Equal(serverTakeover, client.pd.ServerContextTakeover)
+		as.Equal(clientTakeover, client.pd.ClientContextTakeover)
+		as.Equal(serverTakeover, server.cpsWindow.enabled)
+		as.Equal(serverTakeover, client.dpsWindow.enabled)
+		as.Equal(clientTakeover, client.cpsWindow.enabled)
+		as.Equal(clientTakeover, server.dpsWindow.enabled)
+
+		var sent []string
+		for i := 0; i < count; i++ {
+			var text = strings.Repeat("hello, world! "+strconv.Itoa(i), 32)
+			sent = append(sent, text)
+			as.NoError(server.WriteString(text))
+			as.NoError(client.WriteString(text))
+		}
+		wg.Wait()
+		as.Equal(sent, serverReceived)
+		as.Equal(sent, clientReceived)
+	}
+
+	t.Run("client no context takeover", func(t *testing.T) {
+		run(true, false)
+	})
+
+	t.Run("server no context takeover", func(t *testing.T) {
+		run(false, true)
+	})
+}
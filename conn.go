@@ -3,8 +3,10 @@ package gws
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -16,6 +18,18 @@ import (
 // Conn WebSocket连接
 // WebSocket connection
 type Conn struct {
+	// 统计信息. 必须是第一个字段, 以保证 32 位平台上 64 位原子操作的对齐
+	// Statistics. It must be the first field to keep 64-bit atomic operations aligned on 32-bit platforms
+	stats statsCounter
+
+	// 读取队列已执行的任务数量. 与 writeQueue 一样紧跟在 stats 之后, 保持 64 位对齐
+	// Number of jobs processed by the read queue. Like writeQueue it directly follows stats to stay 64-bit aligned.
+	readCounter queueCounter
+
+	// 写入队列
+	// Write queue
+	writeQueue workerQueue
+
 	// 互斥锁，用于保护共享资源
 	// Mutex to protect shared resources
 	mu sync.Mutex
@@ -28,6 +42,10 @@ type Conn struct {
 	// Atomic value for storing errors
 	ev atomic.Value
 
+	// 最近一次设置的写截止时间
+	// Write deadline set last
+	writeDeadline atomic.Value
+
 	// 标识是否为服务器端
 	// Indicates if this is a server-side connection
 	isServer bool
@@ -36,6 +54,26 @@ type Conn struct {
 	// Subprotocol
 	subprotocol string
 
+	// 连接是否经由 TLS 建立
+	// Whether the connection was established over TLS
+	secure bool
+
+	// 服务端连接在握手时解析的客户端 IP
+	// Client IP resolved at handshake for server-side connections
+	clientIP string
+
+	// 对端通过 Sec-WebSocket-MaxPayload 声明的最大消息长度, 0 表示未声明
+	// Maximum message size advertised by the peer through Sec-WebSocket-MaxPayload, 0 means not advertised
+	peerMaxPayloadSize int
+
+	// 握手时协商启用的自定义扩展
+	// Custom extensions enabled during the handshake
+	extensions []Extension
+
+	// 握手响应中的 Sec-WebSocket-Extensions 头
+	// Sec-WebSocket-Extensions header of the handshake response
+	extensionHeader string
+
 	// 底层网络连接
 	// Underlying network connection
 	conn net.Conn
@@ -64,18 +102,77 @@ type Conn struct {
 	// Closed state
 	closed uint32
 
+	// ReadLoop 是否已经开始运行, 本端发起关闭时由它等待对端回复的关闭帧
+	// Whether ReadLoop has started, it awaits the close frame of the peer when this side starts the close
+	reading uint32
+
+	// 自上次发送 Ping 帧之后是否收到了 Pong 帧
+	// Whether a pong frame has been received since the last ping
+	ponged uint32
+
+	// 写入限速器, 为空表示不限速
+	// Write rate limiter, nil means unlimited
+	limiter *rateLimiter
+
+	// ReadLoop 退出时关闭, 懒加载
+	// Closed when ReadLoop exits, lazily created
+	readDone     chan struct{}
+	readDoneOnce sync.Once
+
+	// 连接开始关闭(closed 被设置)时关闭, 懒加载
+	// Closed once the connection starts closing (closed is set), lazily created
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// 拉取模式的消息通道, 懒加载
+	// Message channel of pull mode, lazily created
+	pullQueue     chan *Message
+	pullQueueOnce sync.Once
+
+	// 升级器的连接注册表, ReadLoop 返回时从中删除
+	// Connection registry of the upgrader, the connection is removed from it when ReadLoop returns
+	conns *ConcurrentMap[*Conn, struct{}]
+
 	// 读取队列
 	// Read queue
 	readQueue channel
 
-	// 写入队列
-	// Write queue
-	writeQueue workerQueue
+	// 开启流式读取时的事件处理器, 在 ReadLoop 开始时设置
+	// Event handler for stream reading, set when ReadLoop starts
+	streamHandler StreamHandler
+
+	// 消息头事件处理器, 在 ReadLoop 开始时设置
+	// Message header event handler, set when ReadLoop starts
+	headerHandler MessageHeaderHandler
+
+	// 批量写入的缓冲区
+	// Buffer for batched writes
+	wbatch writeBatch
+
+	// 分片写入期间为非空, 在写入结束时关闭. 等待令牌时会释放 c.mu, 其他数据帧需要等待它, 以免插入分片消息中间
+	// Non-nil while a fragmented message is being written and closed once it is done. c.mu is released while waiting
+	// for tokens, so other data frames have to wait for it in order not to interleave with the fragments.
+	fragments chan struct{}
 
 	// 压缩器
 	// Deflater
 	deflater *deflater
 
+	// 自定义的压缩器和解压器, 为空时使用 deflater
+	// Custom compressor and decompressor, deflater is used if they are nil
+	compressor   Compressor
+	decompressor Decompressor
+
+	// 通过 SetCompressionLevel 设置的连接独占的压缩器, 类型为 *deflater. 广播不持有 c.mu, 所以需要原子读写
+	// Compressor owned by the connection, set by SetCompressionLevel, the type is *deflater.
+	// Broadcasts do not hold c.mu, so it is accessed atomically.
+	cpsDeflater atomic.Value
+
+	// 自适应压缩的统计, 以及压缩是否已被关闭
+	// Statistics of adaptive compression, and whether compression has been turned off
+	adaptive    adaptiveStats
+	cpsDisabled uint32
+
 	// 解压字典滑动窗口
 	// Decompressing dictionary sliding window
 	dpsWindow slideWindow
@@ -87,26 +184,57 @@ type Conn struct {
 	// 压缩拓展配置
 	// Compression extension configuration
 	pd PermessageDeflate
+
+	// 连接的上下文, 结束时发送 1001 关闭帧
+	// Context of the connection, a 1001 close frame is sent when it is done
+	ctx context.Context
 }
 
 // ReadLoop
 // 循环读取消息. 如果复用了HTTP Server, 建议开启goroutine, 阻塞会导致请求上下文无法被GC.
+// ReadLoop 只负责读取(以及心跳), 写入不依赖它, 在它开始之前就可以调用 WriteMessage 和 WriteAsync 等方法.
 // Read messages in a loop.
 // If HTTP Server is reused, it is recommended to enable goroutine, as blocking will prevent the context from being GC.
+// ReadLoop only governs reading (and keepalive), writing does not depend on it:
+// WriteMessage, WriteAsync and so on can be called before it starts.
 func (c *Conn) ReadLoop() {
-	c.handler.OnOpen(c)
+	if c.config.StreamReadEnabled {
+		c.streamHandler, _ = c.handler.(StreamHandler)
+	}
+	c.headerHandler, _ = c.handler.(MessageHeaderHandler)
+	atomic.StoreUint32(&c.reading, 1)
+	c.dispatchOpen()
+
+	var done = make(chan struct{})
+	if c.config.PingInterval > 0 {
+		go c.keepalive(done)
+	}
+	if c.ctx != nil && c.ctx.Done() != nil {
+		go c.watchContext(done)
+	}
 
 	// 无限循环读取消息, 如果发生错误则触发错误事件并退出循环
 	// Infinite loop to read messages, if an error occurs, trigger the error event and exit the loop
 	for {
 		if err := c.readMessage(); err != nil {
-			c.emitError(true, err)
+			c.emitError(true, c.checkReadTimeout(err))
 			break
 		}
 	}
+	// 本端发起关闭时, 连接在收到对端回复的关闭帧或者超时之后才在这里断开
+	// If this side started the close, the connection is only dropped here, after the close frame of the peer or a timeout
+	_ = c.conn.Close()
+	close(done)
+
+	// 已经读取的消息不会丢失, 等待并行处理中的 OnMessage 全部返回之后再触发 OnClose
+	// Messages already read are not lost, OnClose is only fired after all OnMessage calls running in parallel have returned
+	c.readQueue.wait()
 
 	err, ok := c.ev.Load().(error)
-	c.handler.OnClose(c, internal.SelectValue(ok, err, errEmpty))
+	c.dispatchClose(internal.SelectValue(ok, err, errEmpty))
+	if c.conns != nil {
+		c.conns.Delete(c)
+	}
 
 	// 回收资源
 	// Reclaim resources
@@ -123,11 +251,140 @@ func (c *Conn) ReadLoop() {
 			c.dpsWindow.dict = nil
 		}
 	}
+	close(c.getReadDone())
+}
+
+// 分发 OnOpen 事件和异常恢复
+// Dispatch the OnOpen event & Recovery
+func (c *Conn) dispatchOpen() {
+	var done = false
+	defer c.config.Recovery(c.config.Logger)
+	defer c.closeOnPanic(&done)
+	c.handler.OnOpen(c)
+	done = true
+}
+
+// 分发 OnClose 事件和异常恢复, 此时连接已经关闭
+// Dispatch the OnClose event & Recovery, the connection is already closed at this point
+func (c *Conn) dispatchClose(err error) {
+	defer c.config.Recovery(c.config.Logger)
+	c.handler.OnClose(c, err)
+}
+
+// 返回 ReadLoop 退出信号
+// Returns the channel that is closed when ReadLoop exits
+func (c *Conn) getReadDone() chan struct{} {
+	c.readDoneOnce.Do(func() { c.readDone = make(chan struct{}) })
+	return c.readDone
+}
+
+// 返回连接开始关闭的信号
+// Returns the channel that is closed once the connection starts closing
+func (c *Conn) getClosing() chan struct{} {
+	c.closingOnce.Do(func() { c.closing = make(chan struct{}) })
+	return c.closing
+}
+
+// 将连接标记为已关闭并发出关闭信号, 只有第一次调用返回 true
+// Marks the connection as closed and signals it, only the first call returns true
+func (c *Conn) markClosed() bool {
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		return false
+	}
+	close(c.getClosing())
+	return true
+}
+
+// 返回拉取模式的消息通道
+// Returns the message channel of pull mode
+func (c *Conn) getPullQueue() chan *Message {
+	c.pullQueueOnce.Do(func() { c.pullQueue = make(chan *Message) })
+	return c.pullQueue
+}
+
+// NextMessage 在拉取模式(PullMode)下阻塞直到收到下一条完整的消息, 连接关闭后返回 OnClose 收到的错误
+// ReadLoop 需要在另一个协程中运行. 只能由一个协程调用, 使用完毕后可以调用 Message.Close 回收内存.
+// 连接开始关闭(例如调用了 WriteClose)之后收到的消息可能会被丢弃.
+// In pull mode (PullMode), blocks until the next complete message is received.
+// After the connection is closed, the error passed to OnClose is returned.
+// ReadLoop must run in another goroutine. It must be called by exactly one goroutine,
+// and Message.Close can be called to recycle the memory when the message is no longer used.
+// Messages received after the connection starts closing (e.g. after WriteClose) may be dropped.
+func (c *Conn) NextMessage() (*Message, error) {
+	select {
+	case msg := <-c.getPullQueue():
+		return msg, nil
+	case <-c.getReadDone():
+		if err, ok := c.ev.Load().(error); ok {
+			return nil, err
+		}
+		return nil, ErrConnClosed
+	}
 }
 
-// 检查连接是否已关闭
-// Checks if the connection is closed
-func (c *Conn) isClosed() bool {
+// CloseAndWait 发送关闭帧, 然后等待 ReadLoop 返回并且发送队列中的任务执行完毕
+// 只能在 ReadLoop 已经运行时调用, 并且不要在事件回调中调用, 否则会永久阻塞
+// Sends a close frame, then waits until ReadLoop has returned and the jobs in the write queue have run.
+// Only call it while ReadLoop is running, and never from an event callback, otherwise it blocks forever.
+func (c *Conn) CloseAndWait(code uint16, reason []byte) error {
+	var err = c.WriteClose(code, reason)
+	<-c.getReadDone()
+
+	// 发送队列是先进先出的, 哨兵任务执行时之前的任务都已完成
+	// The write queue is FIFO, so all earlier jobs have finished when the sentinel runs
+	var drained = make(chan struct{})
+	var drain = func() { close(drained) }
+	if c.writeQueue.PushDroppable(drain, drain) {
+		<-drained
+	}
+	return err
+}
+
+// 心跳保活, 定时发送 Ping 帧, 超时未收到 Pong 帧则断开连接
+// Keepalive, sends ping frames periodically and closes the connection if no pong frame arrives in time
+func (c *Conn) keepalive(done <-chan struct{}) {
+	var ticker = time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		atomic.StoreUint32(&c.ponged, 0)
+		if err := c.WritePing(nil); err != nil {
+			return
+		}
+
+		var timer = time.NewTimer(c.config.PingTimeout)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if atomic.LoadUint32(&c.ponged) == 0 {
+			c.emitError(false, ErrPingTimeout)
+			return
+		}
+	}
+}
+
+// 监听上下文, 结束时发送 1001 (going away) 关闭帧
+// Watches the context and sends a 1001 (going away) close frame when it is done
+func (c *Conn) watchContext(done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-c.ctx.Done():
+		_ = c.WriteClose(internal.CloseGoingAway.Uint16(), nil)
+	}
+}
+
+// IsClosed 检查连接是否已关闭, 关闭后所有写操作都会返回 ErrConnClosed
+// Checks if the connection is closed, all writes return ErrConnClosed once it is closed
+func (c *Conn) IsClosed() bool {
 	return atomic.LoadUint32(&c.closed) == 1
 }
 
@@ -137,8 +394,11 @@ func (c *Conn) emitError(reading bool, err error) {
 	if err == nil {
 		return
 	}
+	if !reading && c.config.KeepOpenOnRejectedWrite && isRejectedWrite(err) {
+		return
+	}
 
-	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+	if c.markClosed() {
 		// 待发送的错误码和错误原因
 		// Error code to be sent and cause of error
 		var sendCode, sendErr = internal.CloseGoingAway, error(internal.CloseGoingAway)
@@ -149,15 +409,28 @@ func (c *Conn) emitError(reading bool, err error) {
 			case *internal.Error:
 				sendCode, sendErr, err = v.Code, v.Err, v.Err
 			default:
+				// 读取出错而没有收到关闭帧, 对应用报告为 1006
+				// A read error without a close frame is reported to the application as 1006
 				sendCode, sendErr = internal.CloseNormalClosure, err
+				err = &CloseError{Code: CloseAbnormalClosure, err: err}
 			}
 		}
 
+		// 读取出错时帧流已经不可用, 不再等待对端回复关闭帧
+		// The frame stream is unusable after a read error, so the close frame of the peer is not awaited
 		var reason = append(sendCode.Bytes(), sendErr.Error()...)
-		_ = c.writeClose(err, reason)
+		_ = c.writeClose(err, reason, !reading)
 	}
 }
 
+// 判断写入是否在到达网络之前被拒绝, 此时帧流没有损坏
+// Reports whether the write was rejected before reaching the network, so the frame stream is intact
+func isRejectedWrite(err error) bool {
+	var ie *interceptError
+	return errors.Is(err, ErrTextEncoding) || errors.Is(err, ErrMessageTooLarge) ||
+		errors.Is(err, errRateLimitDeadline) || errors.As(err, &ie)
+}
+
 // 处理关闭事件
 // Handles the close event
 func (c *Conn) emitClose(buf *bytes.Buffer) error {
@@ -165,8 +438,10 @@ func (c *Conn) emitClose(buf *bytes.Buffer) error {
 	var realCode = internal.CloseNormalClosure.Uint16()
 	switch buf.Len() {
 	case 0:
+		// 没有状态码的关闭帧, 对应用报告为 1005, 回复的关闭帧同样不带状态码
+		// A close frame without status code is reported to the application as 1005, the reply carries no status code either
 		responseCode = 0
-		realCode = 0
+		realCode = CloseNoStatusReceived
 	case 1:
 		responseCode = internal.CloseProtocolError
 		realCode = uint16(buf.Bytes()[0])
@@ -191,8 +466,8 @@ func (c *Conn) emitClose(buf *bytes.Buffer) error {
 			responseCode = internal.CloseUnsupportedData
 		}
 	}
-	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
-		_ = c.writeClose(&CloseError{Code: realCode, Reason: buf.Bytes()}, responseCode.Bytes())
+	if c.markClosed() {
+		_ = c.writeClose(&CloseError{Code: realCode, Reason: buf.Bytes()}, responseCode.Bytes(), false)
 	}
 	return internal.CloseNormalClosure
 }
@@ -200,6 +475,8 @@ func (c *Conn) emitClose(buf *bytes.Buffer) error {
 // SetDeadline 设置连接的截止时间
 // Sets the deadline for the connection
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.limiter.setDeadline(t)
+	c.writeDeadline.Store(t)
 	err := c.conn.SetDeadline(t)
 	c.emitError(false, err)
 	return err
@@ -216,11 +493,26 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 // SetWriteDeadline 设置写入操作的截止时间
 // Sets the deadline for write operations
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	err := c.conn.SetWriteDeadline(t)
+	c.limiter.setDeadline(t)
+	err := c.setWriteDeadline(t)
 	c.emitError(false, err)
 	return err
 }
 
+// 设置写截止时间并记录下来, 以便 WriteContext 中止写入之后恢复
+// Sets the write deadline and records it, so that WriteContext can restore it after aborting a write
+func (c *Conn) setWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(t)
+	return c.conn.SetWriteDeadline(t)
+}
+
+// 返回最近一次设置的写截止时间, 没有设置时为零值
+// Returns the write deadline set last, the zero value if none was set
+func (c *Conn) getWriteDeadline() time.Time {
+	t, _ := c.writeDeadline.Load().(time.Time)
+	return t
+}
+
 // LocalAddr 返回本地网络地址
 // Returns the local network address
 func (c *Conn) LocalAddr() net.Addr {
@@ -243,25 +535,143 @@ func (c *Conn) NetConn() net.Conn {
 // SetNoDelay 设置无延迟
 // 控制操作系统是否应该延迟数据包传输以期望发送更少的数据包(Nagle算法).
 // 默认值是 true（无延迟），这意味着数据在 Write 之后尽快发送.
+// 升级和拨号都不会修改它, 连接保持 Go 对 TCP 连接的默认值, 即关闭 Nagle 算法, 适合聊天, 游戏等对延迟敏感的小消息.
+// 大量小消息且更看重吞吐量时, 可以在 OnOpen 中调用 SetNoDelay(false) 合并数据包, 代价是增加延迟; 也可以考虑 WriteBatchSize.
 // Controls whether the operating system should delay packet transmission in hopes of sending fewer packets (Nagle's algorithm).
 // The default is true (no delay), meaning that data is sent as soon as possible after a Write.
+// Neither upgrading nor dialing changes it, connections keep Go's default for TCP connections, i.e. Nagle's algorithm is off,
+// which suits latency-sensitive small messages such as chat or games. For many small messages where throughput matters more,
+// call SetNoDelay(false) in OnOpen to coalesce packets at the cost of latency; WriteBatchSize is another option.
 func (c *Conn) SetNoDelay(noDelay bool) error {
-	switch v := c.conn.(type) {
-	case *net.TCPConn:
-		return v.SetNoDelay(noDelay)
+	if netConn, ok := tcpConn(c.conn); ok {
+		return netConn.SetNoDelay(noDelay)
+	}
+	return nil
+}
+
+// 设置 TCP 保活探测的间隔, 0 表示不修改, 负数表示关闭保活; 不是 TCP 连接时不做任何事
+// Sets the interval of TCP keep-alive probes, 0 leaves it unchanged and a negative value disables keep-alive.
+// It does nothing if the connection is not a TCP connection.
+func (c *Conn) setKeepAlive(period time.Duration) error {
+	netConn, ok := tcpConn(c.conn)
+	if !ok || period == 0 {
+		return nil
+	}
+	if period < 0 {
+		return netConn.SetKeepAlive(false)
+	}
+	if err := netConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return netConn.SetKeepAlivePeriod(period)
+}
 
+// 返回底层的 TCP 连接, TLS 连接会被解开
+// Returns the underlying TCP connection, TLS connections are unwrapped
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	switch v := conn.(type) {
+	case *net.TCPConn:
+		return v, true
 	case *tls.Conn:
-		if netConn, ok := v.NetConn().(*net.TCPConn); ok {
-			return netConn.SetNoDelay(noDelay)
-		}
+		netConn, ok := v.NetConn().(*net.TCPConn)
+		return netConn, ok
 	}
-	return nil
+	return nil, false
 }
 
 // SubProtocol 获取协商的子协议
 // Gets the negotiated sub-protocol
 func (c *Conn) SubProtocol() string { return c.subprotocol }
 
-// Session 获取会话存储
-// Gets the session storage
+// IsSecure 报告连接是否经由 TLS 建立, 即是否为 wss:// 连接
+// 服务端连接在握手时根据 r.TLS 和可信代理的 X-Forwarded-Proto 请求头判断, 参见 Upgrader.IsSecure.
+// Reports whether the connection was established over TLS, i.e. whether it is a wss:// connection.
+// Server-side connections decide it at handshake from r.TLS and the X-Forwarded-Proto header of trusted proxies,
+// see Upgrader.IsSecure.
+func (c *Conn) IsSecure() bool { return c.secure }
+
+// ClientIP 返回客户端的真实 IP, 在握手时通过 Upgrader.ClientIP 解析; 跳过握手的连接返回对端地址, 客户端连接返回空字符串
+// Returns the real IP of the client, resolved at handshake through Upgrader.ClientIP.
+// Connections that skipped the handshake return the peer address, client-side connections return an empty string.
+func (c *Conn) ClientIP() string { return c.clientIP }
+
+// PeerMaxPayloadSize 返回对端在握手时通过 Sec-WebSocket-MaxPayload 声明的最大消息长度
+// 只有开启了 AdvertiseMaxPayload 才会读取, 对端未声明或者声明的值无效时返回 0. gws 不会据此限制写入, 由应用自行遵守.
+// Returns the maximum message size advertised by the peer through Sec-WebSocket-MaxPayload during the handshake.
+// It is only read with AdvertiseMaxPayload enabled, and is 0 if the peer did not advertise a valid value.
+// gws does not limit writes accordingly, the application is expected to honor it.
+func (c *Conn) PeerMaxPayloadSize() int { return c.peerMaxPayloadSize }
+
+// Session 获取会话存储, 即握手时传给 Authorize 的同一个存储, 可以在连接的整个生命周期内读写
+// 默认实现是并发安全的, 可以在任意协程中使用, 例如保存用户当前所在的房间或订阅列表.
+// Gets the session storage, the same storage passed to Authorize during the handshake,
+// which can be read and written for the whole life of the connection.
+// The default implementation is safe for concurrent use from any goroutine,
+// e.g. to keep the user's current room or subscription set.
 func (c *Conn) Session() SessionStorage { return c.ss }
+
+// HandshakeResult 握手协商的结果
+// Outcome of the handshake negotiation
+type HandshakeResult struct {
+	// 协商的子协议, 未协商时为空
+	// Negotiated sub-protocol, empty if none was agreed
+	SubProtocol string
+
+	// 是否协商了 permessage-deflate 压缩
+	// Whether permessage-deflate compression was negotiated
+	Compression bool
+
+	// 协商后的压缩配置, 包括上下文接管和滑动窗口大小, 未协商压缩时为零值
+	// Negotiated compression configuration, including context takeover and window sizes, the zero value if compression was not negotiated
+	PermessageDeflate PermessageDeflate
+
+	// 握手响应中的 Sec-WebSocket-Extensions 头, 即双方约定的扩展及其参数
+	// Sec-WebSocket-Extensions header of the handshake response, i.e. the extensions and parameters agreed on
+	Extensions string
+
+	// 对端声明的最大消息长度, 参见 Conn.PeerMaxPayloadSize
+	// Maximum message size advertised by the peer, see Conn.PeerMaxPayloadSize
+	PeerMaxPayloadSize int
+}
+
+// Handshake 返回握手协商的结果, 跳过握手的连接(ServeConn)返回零值
+// 与 CompressionEnabled 不同, Compression 不受自适应压缩的影响.
+// Returns the outcome of the handshake negotiation, the zero value for connections that skipped the handshake (ServeConn).
+// Unlike CompressionEnabled, Compression is not affected by adaptive compression.
+func (c *Conn) Handshake() HandshakeResult {
+	var result = HandshakeResult{
+		SubProtocol:        c.subprotocol,
+		Compression:        c.pd.Enabled,
+		Extensions:         c.extensionHeader,
+		PeerMaxPayloadSize: c.peerMaxPayloadSize,
+	}
+	if c.pd.Enabled {
+		result.PermessageDeflate = c.pd
+	}
+	return result
+}
+
+// CompressionEnabled 返回是否压缩发送的消息, 即握手时协商了 permessage-deflate 压缩, 并且没有被自适应压缩关闭
+// Reports whether outgoing messages are compressed, that is permessage-deflate compression was negotiated
+// during the handshake and has not been turned off by adaptive compression
+func (c *Conn) CompressionEnabled() bool {
+	return c.pd.Enabled && atomic.LoadUint32(&c.cpsDisabled) == 0
+}
+
+// Context 返回连接的上下文, 未设置时为 context.Background()
+// Returns the context of the connection, context.Background() if it is not set
+func (c *Conn) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// SetContext 设置连接的上下文, 需要在 ReadLoop 之前调用
+// 上下文结束时连接会发送 1001 (going away) 关闭帧并断开, 可以用来把连接的生命周期绑定到服务或者业务的上下文.
+// 注意 http.Request 的上下文在 handler 返回时就会被取消, 不适合直接使用.
+// Sets the context of the connection, it must be called before ReadLoop.
+// When the context is done, the connection sends a 1001 (going away) close frame and is closed,
+// which ties the lifetime of the connection to a server-scoped or business context.
+// Note that the context of an http.Request is canceled as soon as the handler returns, so it is not suitable as is.
+func (c *Conn) SetContext(ctx context.Context) { c.ctx = ctx }
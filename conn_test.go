@@ -2,8 +2,11 @@ package gws
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"io"
 	"net"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -154,3 +157,425 @@ func TestConn_EmitError(t *testing.T) {
 	server.emitError(false, err)
 	wg.Wait()
 }
+
+func TestConn_Keepalive(t *testing.T) {
+	t.Run("pong received", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(BuiltinEventHandler)
+		var serverOption = &ServerOption{PingInterval: 20 * time.Millisecond}
+		var clientOption = &ClientOption{}
+		var pongs = int64(0)
+		serverHandler.onPong = func(socket *Conn, payload []byte) {
+			atomic.AddInt64(&pongs, 1)
+		}
+		var closed = int64(0)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			atomic.StoreInt64(&closed, 1)
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		time.Sleep(150 * time.Millisecond)
+		assert.Greater(t, atomic.LoadInt64(&pongs), int64(1))
+		assert.Equal(t, int64(0), atomic.LoadInt64(&closed))
+		_ = server.WriteClose(1000, nil)
+	})
+
+	t.Run("ping timeout", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{
+			PingInterval: 20 * time.Millisecond,
+			PingTimeout:  20 * time.Millisecond,
+		}
+		var clientOption = &ClientOption{}
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			assert.True(t, errors.Is(err, ErrPingTimeout))
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		wg.Wait()
+	})
+
+	t.Run("default timeout", func(t *testing.T) {
+		var option = initServerOption(&ServerOption{PingInterval: time.Second})
+		assert.Equal(t, time.Second, option.getConfig().PingTimeout)
+	})
+}
+
+func TestConn_ReadTimeout(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{ReadTimeout: 50 * time.Millisecond}
+		var clientOption = &ClientOption{}
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			assert.ErrorIs(t, err, ErrReadTimeout)
+			wg.Done()
+		}
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if assert.True(t, errors.As(err, &closeErr)) {
+				assert.Equal(t, internal.CloseGoingAway.Uint16(), closeErr.Code)
+			}
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		wg.Wait()
+	})
+
+	t.Run("active peer", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{ReadTimeout: 50 * time.Millisecond}
+		var clientOption = &ClientOption{}
+		var messages = int64(0)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			atomic.AddInt64(&messages, 1)
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			assert.NoError(t, client.WriteString("hello"))
+		}
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, int64(5), atomic.LoadInt64(&messages))
+		_ = client.WriteClose(1000, nil)
+	})
+
+	t.Run("stalled frame", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{ReadTimeout: 50 * time.Millisecond}
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			assert.Fail(t, "unexpected message")
+		}
+		serverHandler.onClose = func(socket *Conn, err error) {
+			assert.ErrorIs(t, err, ErrReadTimeout)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 发送帧头和部分负载之后停止发送
+		// Send the header and part of the payload, then stall
+		var frame = FrameEncoder{}.EncodeClientFrame(true, false, OpcodeText, []byte("hello, world"))
+		_, err := client.conn.Write(frame[:len(frame)-5])
+		assert.NoError(t, err)
+		wg.Wait()
+	})
+
+	t.Run("slow large frame", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{ReadTimeout: 50 * time.Millisecond}
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var payload = internal.AlphabetNumeric.Generate(1000)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			assert.Equal(t, string(payload), message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 负载持续到达, 总耗时超过 ReadTimeout 也不会超时
+		// The payload keeps arriving, so it does not time out even though the whole frame takes longer than ReadTimeout
+		var frame = FrameEncoder{}.EncodeClientFrame(true, false, OpcodeText, payload)
+		for i := 0; i < len(frame); i += 100 {
+			_, err := client.conn.Write(frame[i:internal.Min(i+100, len(frame))])
+			assert.NoError(t, err)
+			time.Sleep(20 * time.Millisecond)
+		}
+		wg.Wait()
+		_ = client.WriteClose(1000, nil)
+	})
+}
+
+func TestConn_CloseAndWait(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var closed = int64(0)
+	serverHandler.onClose = func(socket *Conn, err error) {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt64(&closed, 1)
+	}
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var written = int64(0)
+	for i := 0; i < 10; i++ {
+		server.WriteAsync(OpcodeText, []byte("hello"), func(err error) {
+			atomic.AddInt64(&written, 1)
+		})
+	}
+	as.NoError(server.CloseAndWait(1000, nil))
+	as.Equal(int64(1), atomic.LoadInt64(&closed))
+	as.Equal(int64(10), atomic.LoadInt64(&written))
+	as.Error(server.CloseAndWait(1000, nil))
+}
+
+func TestConn_CloseDrain(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("inbound", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var handled = int64(0)
+		var closed = make(chan int64, 1)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt64(&handled, 1)
+		}
+		serverHandler.onClose = func(socket *Conn, err error) {
+			closed <- atomic.LoadInt64(&handled)
+		}
+		var serverOption = &ServerOption{ParallelEnabled: true, ParallelGolimit: 4}
+		server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		for i := 0; i < 10; i++ {
+			as.NoError(client.WriteString("hello"))
+		}
+		as.NoError(client.WriteClose(1000, nil))
+		as.Equal(int64(10), <-closed)
+	})
+
+	t.Run("outbound", func(t *testing.T) {
+		var clientHandler = new(webSocketMocker)
+		var received = int64(0)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			atomic.AddInt64(&received, 1)
+		}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var block = make(chan struct{})
+		server.Async(func() { <-block })
+		var wg = &sync.WaitGroup{}
+		wg.Add(5)
+		for i := 0; i < 5; i++ {
+			server.WriteAsync(OpcodeText, []byte("hello"), func(err error) {
+				as.ErrorIs(err, ErrConnClosed)
+				wg.Done()
+			})
+		}
+		as.NoError(server.WriteClose(1000, nil))
+		close(block)
+		wg.Wait()
+		as.Equal(int64(0), atomic.LoadInt64(&received))
+	})
+}
+
+func TestConn_Handshake(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("negotiated", func(t *testing.T) {
+		var pd = PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true}
+		var extensions = []Extension{&xorExtension{name: "x-xor2", rsv: RSV2, key: 1}}
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			PermessageDeflate:   pd,
+			Extensions:          extensions,
+			SubProtocols:        []string{"chat"},
+			AdvertiseMaxPayload: true,
+		})
+		server, client, err := NewPipeConns(upgrader, new(BuiltinEventHandler), &ClientOption{
+			PermessageDeflate:   pd,
+			Extensions:          extensions,
+			RequestHeader:       http.Header{"Sec-Websocket-Protocol": []string{"chat"}},
+			AdvertiseMaxPayload: true,
+		})
+		if !as.NoError(err) {
+			return
+		}
+
+		for _, socket := range []*Conn{server, client} {
+			var result = socket.Handshake()
+			as.Equal("chat", result.SubProtocol)
+			as.True(result.Compression)
+			as.True(result.PermessageDeflate.ServerContextTakeover)
+			as.True(result.PermessageDeflate.ClientContextTakeover)
+			as.Equal(defaultReadMaxPayloadSize, result.PeerMaxPayloadSize)
+			as.Equal("permessage-deflate; server_max_window_bits=12; client_max_window_bits=12, x-xor2; key=1", result.Extensions)
+		}
+	})
+
+	t.Run("plain", func(t *testing.T) {
+		server, client, err := NewPipeConns(NewUpgrader(new(BuiltinEventHandler), nil), new(BuiltinEventHandler), nil)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(HandshakeResult{}, server.Handshake())
+		as.Equal(HandshakeResult{}, client.Handshake())
+	})
+}
+
+func TestConn_ReservedCloseCodes(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("no status received", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		var onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(CloseNoStatusReceived, closeErr.Code)
+				as.Empty(closeErr.Reason)
+			}
+			wg.Done()
+		}
+		var serverHandler = &webSocketMocker{onClose: onClose}
+		var clientHandler = &webSocketMocker{onClose: onClose}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 服务端回复的关闭帧同样没有状态码, 1005 不会被发送
+		// The close frame replied by the server carries no status code either, 1005 is never sent
+		var frame = FrameEncoder{}.EncodeClientFrame(true, false, OpcodeCloseConnection, nil)
+		_, err := client.conn.Write(frame)
+		as.NoError(err)
+		wg.Wait()
+	})
+
+	t.Run("abnormal closure", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(CloseAbnormalClosure, closeErr.Code)
+			}
+			as.ErrorIs(err, io.EOF)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		go server.ReadLoop()
+
+		as.NoError(client.NetConn().Close())
+		wg.Wait()
+	})
+}
+
+func TestConn_Context(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+	clientHandler.onClose = func(socket *Conn, err error) {
+		var closeErr *CloseError
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(internal.CloseGoingAway.Uint16(), closeErr.Code)
+		}
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	as.Equal(context.Background(), server.Context())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server.SetContext(ctx)
+	as.Equal(ctx, server.Context())
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	cancel()
+	wg.Wait()
+	select {
+	case <-server.getReadDone():
+	case <-time.After(time.Second):
+		t.Fatal("ReadLoop did not return")
+	}
+}
+
+func TestConn_OnOpen(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var opened = int64(0)
+	var wg = &sync.WaitGroup{}
+	wg.Add(3)
+	serverHandler.onOpen = func(socket *Conn) {
+		atomic.AddInt64(&opened, 1)
+	}
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(int64(1), atomic.LoadInt64(&opened))
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+
+	// 消息在 ReadLoop 启动之前就已经发出
+	// The messages are sent before ReadLoop starts
+	go func() {
+		for i := 0; i < 3; i++ {
+			_ = client.WriteString("hello")
+		}
+	}()
+	go server.ReadLoop()
+	go client.ReadLoop()
+	wg.Wait()
+	as.Equal(int64(1), atomic.LoadInt64(&opened))
+}
+
+func TestConn_IsClosed(t *testing.T) {
+	var as = assert.New(t)
+	server, client := newPeer(new(webSocketMocker), nil, new(webSocketMocker), nil)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.False(server.IsClosed())
+	as.NoError(server.WriteClose(1000, nil))
+	as.True(server.IsClosed())
+	as.ErrorIs(server.WriteString("hello"), ErrConnClosed)
+}
+
+func TestConn_ClosingHandshake(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	server, client := newPeer(serverHandler, nil, clientHandler, nil)
+	serverHandler.onClose = func(socket *Conn, err error) {
+		var closeErr *CloseError
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(CloseNormalClosure, closeErr.Code)
+			as.Equal("bye", string(closeErr.Reason))
+		}
+		var errs = make(chan error, 1)
+		socket.WriteAsync(OpcodeText, []byte("hello"), func(err error) { errs <- err })
+		as.ErrorIs(<-errs, ErrConnClosed)
+		wg.Done()
+	}
+	clientHandler.onClose = func(socket *Conn, err error) {
+		// 服务端回应的关闭帧 / the close frame echoed by the server
+		var closeErr *CloseError
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(CloseNormalClosure, closeErr.Code)
+		}
+		wg.Done()
+	}
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	// 只发送关闭帧, 不标记本端已关闭, 以便接收服务端的回应
+	// Sends the close frame only, without marking this side closed, so that the echo from the server is received
+	as.NoError(client.doWrite(OpcodeCloseConnection, internal.Bytes(append(internal.CloseNormalClosure.Bytes(), "bye"...))))
+	wg.Wait()
+}
@@ -0,0 +1,37 @@
+package gws
+
+import "github.com/lxzan/gws/internal"
+
+// FrameEncoder 帧编码器, 用于构造原始的 WebSocket 帧, 例如测试工具, 模糊测试和流量回放. 零值可以直接使用.
+// 不会检查帧的合法性(例如控制帧的长度), 以便构造违规的帧. compress 只设置 RSV1 标志位, payload 需要已经压缩过.
+// Frame encoder, used to construct raw WebSocket frames for test harnesses, fuzzers or replay tools.
+// The zero value is ready to use.
+// The frames are not validated (e.g. the length of control frames), so that invalid frames can be built.
+// compress only sets the RSV1 bit, the payload must already be compressed.
+type FrameEncoder struct{}
+
+// EncodeServerFrame 编码服务端发送的帧, 不带掩码
+// Encodes a frame sent by a server, without mask
+func (c FrameEncoder) EncodeServerFrame(fin bool, compress bool, opcode Opcode, payload []byte) []byte {
+	return c.encode(true, fin, compress, opcode, payload)
+}
+
+// EncodeClientFrame 编码客户端发送的帧, 使用随机掩码, 不会修改 payload
+// Encodes a frame sent by a client with a random mask, payload is not modified
+func (c FrameEncoder) EncodeClientFrame(fin bool, compress bool, opcode Opcode, payload []byte) []byte {
+	return c.encode(false, fin, compress, opcode, payload)
+}
+
+// 生成帧头并拷贝负载, 客户端帧的负载会被掩码
+// Generates the header and copies the payload, which is masked for client frames
+func (c FrameEncoder) encode(isServer bool, fin bool, compress bool, opcode Opcode, payload []byte) []byte {
+	var header = frameHeader{}
+	var n, maskBytes = header.GenerateHeader(isServer, fin, compress, opcode, len(payload))
+	var frame = make([]byte, n+len(payload))
+	copy(frame, header[:n])
+	copy(frame[n:], payload)
+	if !isServer {
+		internal.MaskXOR(frame[n:], maskBytes)
+	}
+	return frame
+}
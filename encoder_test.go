@@ -0,0 +1,70 @@
+package gws
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameEncoder(t *testing.T) {
+	var as = assert.New(t)
+	var encoder FrameEncoder
+
+	t.Run("server frame", func(t *testing.T) {
+		var frame = encoder.EncodeServerFrame(true, false, OpcodeText, []byte("hello"))
+		as.Equal([]byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'}, frame)
+
+		var fh = frameHeader{}
+		var n, err = fh.Parse(bytes.NewReader(encoder.EncodeServerFrame(false, true, OpcodeBinary, make([]byte, 300))))
+		as.NoError(err)
+		as.Equal(300, n)
+		as.False(fh.GetFIN())
+		as.True(fh.GetRSV1())
+		as.False(fh.GetMask())
+		as.Equal(OpcodeBinary, fh.GetOpcode())
+	})
+
+	t.Run("client frame", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(OpcodeText, message.Opcode)
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var payload = []byte("hello")
+		var frames = [][]byte{
+			encoder.EncodeClientFrame(false, false, OpcodeText, payload[:2]),
+			encoder.EncodeClientFrame(true, false, OpcodeContinuation, payload[2:]),
+		}
+		as.Equal("hello", string(payload))
+		go func() {
+			for _, frame := range frames {
+				_, _ = client.conn.Write(frame)
+			}
+		}()
+		wg.Wait()
+	})
+}
+
+func TestSetMaskKeyFunc(t *testing.T) {
+	var as = assert.New(t)
+	SetMaskKeyFunc(func() [4]byte { return [4]byte{1, 2, 3, 4} })
+	defer SetMaskKeyFunc(nil)
+
+	var frame = FrameEncoder{}.EncodeClientFrame(true, false, OpcodeText, []byte("hello"))
+	as.Equal([]byte{0x81, 0x85, 1, 2, 3, 4, 'h' ^ 1, 'e' ^ 2, 'l' ^ 3, 'l' ^ 4, 'o' ^ 1}, frame)
+
+	SetMaskKeyFunc(nil)
+	var a = FrameEncoder{}.EncodeClientFrame(true, false, OpcodeText, []byte("hello"))
+	var b = FrameEncoder{}.EncodeClientFrame(true, false, OpcodeText, []byte("hello"))
+	as.NotEqual(a, b)
+}
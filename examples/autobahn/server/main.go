@@ -78,6 +78,6 @@ func (c *Handler) OnMessage(socket *gws.Conn, message *gws.Message) {
 		_ = socket.WriteMessage(message.Opcode, message.Bytes())
 		_ = message.Close()
 	} else {
-		socket.WriteAsync(message.Opcode, message.Bytes(), func(err error) { _ = message.Close() })
+		socket.WriteAsync(message.Opcode, message.Data.Bytes(), func(err error) { _ = message.Close() })
 	}
 }
@@ -0,0 +1,243 @@
+package gws
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// RSVBit 自定义扩展可以占用的保留位
+// Reserved bit that a custom extension can claim
+type RSVBit uint8
+
+const (
+	// RSV2 第二个保留位
+	// The second reserved bit
+	RSV2 RSVBit = 0x20
+
+	// RSV3 第三个保留位
+	// The third reserved bit
+	RSV3 RSVBit = 0x10
+)
+
+// Extension 自定义 WebSocket 扩展, 通过 Sec-WebSocket-Extensions 协商, 占用 RSV2 或 RSV3 并转换数据消息的负载
+// 同一个实例被所有连接共享, 必须是并发安全的. RSV1 由内置的 permessage-deflate 占用.
+// 发送时先按照注册顺序调用 Encode 再压缩, 并在消息的第一帧设置保留位; 接收时先解压, 再按照相反的顺序对设置了保留位的消息调用 Decode.
+// Broadcaster, WriteFile 和 WriteRaw 发送的消息以及流式读取和手动解压的消息不经过扩展, 前两者发送的消息不设置保留位.
+// Custom WebSocket extension, negotiated through Sec-WebSocket-Extensions, which claims RSV2 or RSV3 and transforms
+// the payload of data messages. A single instance is shared by all connections and must be safe for concurrent use.
+// RSV1 is taken by the built-in permessage-deflate.
+// Outgoing messages go through Encode in registration order before compression, and the reserved bit is set
+// on their first frame; incoming messages are decompressed first, then Decode is called in reverse order
+// on messages with the reserved bit set. Messages sent through Broadcaster, WriteFile and WriteRaw,
+// as well as streamed and manually decompressed messages, bypass extensions;
+// the former two are sent without the reserved bit.
+type Extension interface {
+	// Name 扩展名称, 例如 x-foo
+	// Extension name, e.g. x-foo
+	Name() string
+
+	// RSV 扩展占用的保留位, 必须是 RSV2 或 RSV3
+	// Reserved bit claimed by the extension, must be RSV2 or RSV3
+	RSV() RSVBit
+
+	// Offer 客户端在请求头中提供的参数, 例如 "a=1; b", 可以为空
+	// Parameters offered by the client in the request header, e.g. "a=1; b", may be empty
+	Offer() string
+
+	// Negotiate 服务端根据客户端提供的参数返回响应参数, ok 为 false 时不启用该扩展
+	// The server returns the response parameters for the parameters offered by the client,
+	// the extension is not enabled if ok is false
+	Negotiate(params string) (response string, ok bool)
+
+	// Accept 客户端检查服务端的响应参数, 返回 false 时握手失败
+	// The client checks the response parameters of the server, the handshake fails if it returns false
+	Accept(params string) bool
+
+	// Encode 转换发出的数据消息的负载
+	// Transforms the payload of an outgoing data message
+	Encode(opcode Opcode, payload []byte) ([]byte, error)
+
+	// Decode 还原收到的数据消息的负载
+	// Restores the payload of an incoming data message
+	Decode(opcode Opcode, payload []byte) ([]byte, error)
+}
+
+// 扩展请求头中的一项, 由名称和参数组成
+// An element of the extension header, made of a name and parameters
+type extensionElement struct {
+	name   string
+	params string
+}
+
+// 解析 Sec-WebSocket-Extensions 请求头, 元素以逗号分隔, 参数以分号分隔
+// Parses the Sec-WebSocket-Extensions header, elements are separated by commas and parameters by semicolons
+func parseExtensions(header string) []extensionElement {
+	var list []extensionElement
+	for _, item := range internal.Split(header, ",") {
+		var fields = internal.Split(item, ";")
+		if len(fields) == 0 {
+			continue
+		}
+		list = append(list, extensionElement{name: fields[0], params: strings.Join(fields[1:], "; ")})
+	}
+	return list
+}
+
+// 格式化扩展元素
+// Formats an extension element
+func (c extensionElement) String() string {
+	if c.params == "" {
+		return c.name
+	}
+	return c.name + "; " + c.params
+}
+
+// 从扩展请求头中取出 permessage-deflate 的部分, 其他扩展的参数不能参与压缩协商
+// Extracts the permessage-deflate part of the extension header, the parameters of other extensions must not affect compression negotiation
+func deflateExtensions(header string) string {
+	if !strings.Contains(header, ",") {
+		return header
+	}
+	var list []string
+	for _, item := range parseExtensions(header) {
+		if item.name == internal.PermessageDeflate {
+			list = append(list, item.String())
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+// 检查保留位是否有效且未被占用
+// Checks that the reserved bit is valid and not claimed yet
+func claimRSV(used RSVBit, ext Extension) bool {
+	var rsv = ext.RSV()
+	return (rsv == RSV2 || rsv == RSV3) && used&rsv == 0
+}
+
+// 服务端按照注册顺序协商扩展, 返回启用的扩展和响应元素
+// The server negotiates extensions in registration order, returns the enabled extensions and the response elements
+func negotiateExtensions(registered []Extension, header string) ([]Extension, []string) {
+	if len(registered) == 0 || header == "" {
+		return nil, nil
+	}
+	var offers = parseExtensions(header)
+	var enabled []Extension
+	var responses []string
+	var used RSVBit
+	for _, ext := range registered {
+		if !claimRSV(used, ext) {
+			continue
+		}
+		for _, offer := range offers {
+			if offer.name != ext.Name() {
+				continue
+			}
+			if params, ok := ext.Negotiate(offer.params); ok {
+				enabled = append(enabled, ext)
+				responses = append(responses, extensionElement{name: ext.Name(), params: params}.String())
+				used |= ext.RSV()
+				break
+			}
+		}
+	}
+	return enabled, responses
+}
+
+// 客户端根据服务端的响应启用扩展, 响应了没有注册的扩展或者拒绝响应参数时返回 ErrHandshake
+// permessage-deflate 由压缩协商单独处理, 这里跳过.
+// The client enables extensions according to the server response. ErrHandshake is returned if the response
+// contains an extension that is not registered or the response parameters are rejected.
+// permessage-deflate is handled by the compression negotiation and skipped here.
+func acceptExtensions(registered []Extension, header string) ([]Extension, error) {
+	if header == "" {
+		return nil, nil
+	}
+	var enabled []Extension
+	var used RSVBit
+	for _, item := range parseExtensions(header) {
+		if item.name == internal.PermessageDeflate {
+			continue
+		}
+		var ext = findExtension(registered, item.name)
+		if ext == nil || !claimRSV(used, ext) || !ext.Accept(item.params) {
+			return nil, ErrHandshake
+		}
+		enabled = append(enabled, ext)
+		used |= ext.RSV()
+	}
+	return enabled, nil
+}
+
+// 按名称查找注册的扩展, 不存在时返回 nil
+// Finds a registered extension by name, nil is returned if there is none
+func findExtension(registered []Extension, name string) Extension {
+	for _, ext := range registered {
+		if ext.Name() == name {
+			return ext
+		}
+	}
+	return nil
+}
+
+// 按照注册顺序转换发出的数据消息, 返回转换后的负载和需要设置的保留位. 调用者必须持有 c.mu
+// Transforms an outgoing data message in registration order, returns the payload and the reserved bits to set.
+// The caller must hold c.mu.
+func (c *Conn) encodeExtensions(opcode Opcode, payload internal.Payload) (internal.Payload, RSVBit, error) {
+	if len(c.extensions) == 0 || !opcode.isDataFrame() {
+		return payload, 0, nil
+	}
+	var p = payloadBytes(payload)
+	var rsv RSVBit
+	for _, ext := range c.extensions {
+		var err error
+		if p, err = ext.Encode(opcode, p); err != nil {
+			return nil, 0, err
+		}
+		rsv |= ext.RSV()
+	}
+	return internal.Bytes(p), rsv, nil
+}
+
+// 按照相反的顺序还原设置了保留位的消息
+// Restores a message with reserved bits set in reverse order
+func (c *Conn) decodeExtensions(msg *Message) error {
+	var p = msg.Data.Bytes()
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		var ext = c.extensions[i]
+		if msg.rsv&ext.RSV() == 0 {
+			continue
+		}
+		var err error
+		if p, err = ext.Decode(msg.Opcode, p); err != nil {
+			return internal.NewError(internal.CloseProtocolError, err)
+		}
+	}
+	// Write 使用 copy, p 引用原缓冲区时也是安全的
+	// Write uses copy, which is safe even if p refers to the original buffer
+	msg.Data.Reset()
+	msg.Data.Write(p)
+	return nil
+}
+
+// 已启用的扩展占用的保留位
+// Reserved bits claimed by the enabled extensions
+func (c *Conn) extensionRSV() RSVBit {
+	var rsv RSVBit
+	for _, ext := range c.extensions {
+		rsv |= ext.RSV()
+	}
+	return rsv
+}
+
+// 返回负载的字节切片, 必要时拷贝
+// Returns the bytes of the payload, copying them if necessary
+func payloadBytes(payload internal.Payload) []byte {
+	if p, ok := payload.(internal.Bytes); ok {
+		return p
+	}
+	var buf = bytes.NewBuffer(make([]byte, 0, payload.Len()))
+	_, _ = payload.WriteTo(buf)
+	return buf.Bytes()
+}
@@ -0,0 +1,240 @@
+package gws
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试用的扩展, 对负载逐字节异或
+// Extension for tests, xors the payload byte by byte
+type xorExtension struct {
+	name   string
+	rsv    RSVBit
+	key    byte
+	reject bool
+}
+
+func (c *xorExtension) Name() string { return c.name }
+
+func (c *xorExtension) RSV() RSVBit { return c.rsv }
+
+func (c *xorExtension) Offer() string { return "key=" + strconv.Itoa(int(c.key)) }
+
+func (c *xorExtension) Negotiate(params string) (string, bool) { return params, !c.reject }
+
+func (c *xorExtension) Accept(params string) bool { return params == c.Offer() }
+
+func (c *xorExtension) Encode(opcode Opcode, payload []byte) ([]byte, error) {
+	var p = make([]byte, len(payload))
+	for i := range payload {
+		p[i] = payload[i] ^ c.key
+	}
+	return p, nil
+}
+
+func (c *xorExtension) Decode(opcode Opcode, payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("empty payload")
+	}
+	return c.Encode(opcode, payload)
+}
+
+func TestExtension(t *testing.T) {
+	var as = assert.New(t)
+
+	var roundTrip = func(pd PermessageDeflate, extensions []Extension) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		var received, echoed []string
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			received = append(received, message.Data.String())
+			as.NoError(socket.WriteMessage(message.Opcode, message.Bytes()))
+		}
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			echoed = append(echoed, message.Data.String())
+			wg.Done()
+		}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{
+			PermessageDeflate: pd,
+			Extensions:        extensions,
+			CheckUtf8Enabled:  true,
+		})
+		server, client, err := NewPipeConns(upgrader, clientHandler, &ClientOption{
+			PermessageDeflate: pd,
+			Extensions:        extensions,
+			CheckUtf8Enabled:  true,
+		})
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(extensions, server.extensions)
+		as.Equal(extensions, client.extensions)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(client.WriteString("hello"))
+		as.NoError(client.WriteBatch([]Frame{{Opcode: OpcodeText, Payload: []byte("world")}}))
+		client.WriteAsync(OpcodeBinary, []byte("async"), nil)
+		wg.Wait()
+		as.Equal([]string{"hello", "world", "async"}, received)
+		as.Equal(received, echoed)
+	}
+
+	var extensions = []Extension{
+		&xorExtension{name: "x-xor2", rsv: RSV2, key: 0x5a},
+		&xorExtension{name: "x-xor3", rsv: RSV3, key: 0xa5},
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		roundTrip(PermessageDeflate{}, extensions)
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		roundTrip(PermessageDeflate{Enabled: true, Threshold: 1}, extensions)
+	})
+
+	t.Run("context takeover", func(t *testing.T) {
+		roundTrip(PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true}, extensions[:1])
+	})
+
+	t.Run("response header", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			PermessageDeflate: PermessageDeflate{Enabled: true},
+			Extensions: []Extension{
+				&xorExtension{name: "x-xor2", rsv: RSV2},
+				&xorExtension{name: "x-rejected", rsv: RSV3, reject: true},
+				&xorExtension{name: "x-conflict", rsv: RSV2},
+			},
+		})
+		var request = &http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{},
+		}
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Sec-WebSocket-Version", "13")
+		request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		request.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits, x-unknown, x-conflict, x-rejected, x-xor2; key=7")
+		server, client := net.Pipe()
+		go func() {
+			_, _ = upgrader.UpgradeFromConn(server, bufio.NewReader(server), request)
+		}()
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+		as.Equal(
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover, x-xor2; key=7",
+			resp.Header.Get("Sec-WebSocket-Extensions"),
+		)
+	})
+
+	t.Run("not offered", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(internal.CloseProtocolError.Uint16(), closeErr.Code)
+			}
+			wg.Done()
+		}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{Extensions: extensions})
+		server, client, err := NewPipeConns(upgrader, new(webSocketMocker), nil)
+		if !as.NoError(err) {
+			return
+		}
+		as.Empty(server.extensions)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var fh = frameHeader{}
+		var n, _ = fh.GenerateHeader(true, true, false, OpcodeText, 0)
+		fh[0] |= byte(RSV2)
+		_, _ = server.conn.Write(fh[:n])
+		wg.Wait()
+	})
+
+	t.Run("decode error", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			wg.Done()
+		}
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(internal.CloseProtocolError.Uint16(), closeErr.Code)
+			}
+		}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{Extensions: extensions})
+		server, client, err := NewPipeConns(upgrader, clientHandler, &ClientOption{Extensions: extensions})
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(client.WriteString(""))
+		wg.Wait()
+	})
+
+	t.Run("rejected by client", func(t *testing.T) {
+		var serverExt = &xorExtension{name: "x-xor2", rsv: RSV2, key: 1}
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{Extensions: []Extension{serverExt}})
+		var clientExt = &fixedResponseExtension{xorExtension: xorExtension{name: "x-xor2", rsv: RSV2, key: 1}}
+		_, _, err := NewPipeConns(upgrader, new(BuiltinEventHandler), &ClientOption{Extensions: []Extension{clientExt}})
+		as.ErrorIs(err, ErrHandshake)
+	})
+
+	t.Run("unknown response", func(t *testing.T) {
+		var ext = &xorExtension{name: "x-xor2", rsv: RSV2, key: 1}
+		enabled, err := acceptExtensions([]Extension{ext}, "permessage-deflate; server_no_context_takeover, x-xor2; key=1")
+		as.NoError(err)
+		as.Equal([]Extension{ext}, enabled)
+
+		_, err = acceptExtensions([]Extension{ext}, "x-xor2; key=1, x-foo")
+		as.ErrorIs(err, ErrHandshake)
+		_, err = acceptExtensions(nil, "x-foo")
+		as.ErrorIs(err, ErrHandshake)
+		_, err = acceptExtensions([]Extension{ext}, "x-xor2; key=1, x-xor2; key=1")
+		as.ErrorIs(err, ErrHandshake)
+		enabled, err = acceptExtensions(nil, "permessage-deflate")
+		as.NoError(err)
+		as.Empty(enabled)
+	})
+
+	t.Run("parse", func(t *testing.T) {
+		as.Equal([]extensionElement{
+			{name: "permessage-deflate", params: "client_max_window_bits"},
+			{name: "x-foo"},
+			{name: "x-bar", params: "a=1; b"},
+		}, parseExtensions("permessage-deflate;client_max_window_bits, x-foo,, x-bar; a=1 ;b"))
+		as.Equal("permessage-deflate; server_no_context_takeover", deflateExtensions("permessage-deflate; server_no_context_takeover"))
+		as.Equal("permessage-deflate; client_max_window_bits", deflateExtensions("x-foo; a=1, permessage-deflate; client_max_window_bits"))
+	})
+}
+
+// 客户端提供的参数和能接受的参数不同, 用于测试握手失败
+// The offered parameters differ from the accepted ones, used to test a failed handshake
+type fixedResponseExtension struct {
+	xorExtension
+}
+
+func (c *fixedResponseExtension) Offer() string { return "key=2" }
+
+func (c *fixedResponseExtension) Accept(params string) bool { return params == "key=1" }
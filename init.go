@@ -1,12 +1,17 @@
 package gws
 
-import "github.com/lxzan/gws/internal"
+import (
+	"sync/atomic"
+
+	"github.com/lxzan/gws/internal"
+)
 
 var (
 	framePadding    = frameHeader{}            // 帧头填充物
 	defaultLogger   = new(stdLogger)           // 默认日志工具
 	bufferThreshold = uint32(256 * 1024)       // buffer阈值
 	binaryPool      = new(internal.BufferPool) // 内存池
+	maskKeyFunc     atomic.Value               // 掩码生成函数
 )
 
 func init() {
@@ -19,3 +24,24 @@ func SetBufferThreshold(x uint32) {
 	bufferThreshold = internal.ToBinaryNumber(x)
 	binaryPool = internal.NewBufferPool(128, bufferThreshold)
 }
+
+// SetMaskKeyFunc 设置客户端帧的掩码生成函数, 可以生成固定的掩码, 便于测试时比对帧的原始字节
+// 可以与连接的读写并发调用. f 为 nil 时恢复默认的随机掩码. 生产环境中不要使用可预测的掩码.
+// Sets the mask key generator of client frames. It can produce fixed mask keys,
+// so that tests can compare the exact bytes of frames. It is safe to call while connections are reading and writing.
+// A nil f restores the default random mask keys. Do not use predictable mask keys in production.
+func SetMaskKeyFunc(f func() [4]byte) {
+	if f == nil {
+		f = internal.NewMaskKey
+	}
+	maskKeyFunc.Store(f)
+}
+
+// 生成掩码
+// Generates a mask key
+func newMaskKey() [4]byte {
+	if f, ok := maskKeyFunc.Load().(func() [4]byte); ok {
+		return f()
+	}
+	return internal.NewMaskKey()
+}
@@ -27,6 +27,7 @@ var (
 	Upgrade                = Pair{"Upgrade", "websocket"}
 	SecWebSocketAccept     = Pair{"Sec-WebSocket-Accept", ""}
 	SecWebSocketProtocol   = Pair{"Sec-WebSocket-Protocol", ""}
+	SecWebSocketMaxPayload = Pair{"Sec-WebSocket-MaxPayload", ""}
 )
 
 // MagicNumber WebSocket 握手过程中使用的魔术字符串
@@ -51,6 +51,10 @@ const (
 	// 默认的拨号超时时间
 	// Default dial timeout
 	defaultDialTimeout = 5 * time.Second
+
+	// 默认的关闭超时时间
+	// Default close timeout
+	defaultCloseTimeout = 5 * time.Second
 )
 
 type (
@@ -68,8 +72,11 @@ type (
 		// Compress level
 		Level int
 
-		// 压缩阈值, 长度小于阈值的消息不会被压缩, 仅适用于无上下文接管模式.
+		// 压缩阈值, 长度小于阈值的消息不会被压缩, 仅适用于无上下文接管模式. 默认512字节.
+		// 阈值越低越节省带宽, 但小消息的压缩收益有限, 会消耗更多CPU.
 		// Compression threshold, messages below the threshold will not be compressed, only for context-free takeover mode.
+		// Defaults to 512 bytes. A lower threshold saves bandwidth,
+		// but compressing small messages gains little and costs more CPU.
 		Threshold int
 
 		// 压缩器内存池大小
@@ -97,6 +104,31 @@ type (
 		// The client-side sliding window index
 		// Range 8<=n<=15, means pow(2,n) bytes.
 		ClientMaxWindowBits int
+
+		// 预置压缩字典, 需要通信双方通过带外方式约定相同的内容
+		// 可以提升小消息(如键名重复的JSON)的压缩率. 开启上下文接管时作为滑动窗口的初始内容, 否则每条消息都会使用它.
+		// Preset compression dictionary, both peers must agree on the same content out of band.
+		// It improves the compression ratio of small messages (e.g. JSON with repeated keys).
+		// With context takeover it is the initial content of the sliding window, otherwise every message uses it.
+		// 注意: 压缩级别1-6不会在短于128字节的消息中查找重复内容
+		// Note: levels 1-6 do not search for matches in messages shorter than 128 bytes.
+		Dictionary []byte
+
+		// 创建自定义的压缩器和解压器, 为空时使用 deflate 算法
+		// 握手协商和 RSV1 标志位的语义保持不变, 所以通信双方必须使用相同的算法, 仅适用于两端都受控的私有部署.
+		// Creates a custom compressor and decompressor, deflate is used if it is nil.
+		// The handshake negotiation and the RSV1 bit keep their semantics, so both peers must use the same codec.
+		// Only suitable for private deployments where both ends are under control.
+		NewCompressor func() (Compressor, Decompressor)
+
+		// 是否开启自适应压缩
+		// 开启后每写入 64 条压缩消息评估一次压缩率, 压缩后的长度超过原长度的 95% 时, 该连接之后不再压缩消息.
+		// 本端开启上下文接管时, 每条消息都必须压缩, 该选项不生效.
+		// Whether adaptive compression is enabled.
+		// When enabled, the compression ratio is evaluated every 64 compressed messages written,
+		// and if the compressed size exceeds 95% of the raw size, the connection stops compressing messages.
+		// It has no effect with context takeover on this side, since every message must be compressed then.
+		Adaptive bool
 	}
 
 	Config struct {
@@ -116,10 +148,18 @@ type (
 		// Memory pool for decompressor sliding window
 		dswPool *internal.Pool[[]byte]
 
+		// 所有连接的统计信息汇总
+		// Aggregated statistics of all connections
+		stats *statsCounter
+
 		// 是否开启并行消息处理
 		// Whether to enable parallel message processing
 		ParallelEnabled bool
 
+		// 是否开启拉取模式
+		// Whether pull mode is enabled
+		PullMode bool
+
 		// (单个连接)用于并行消息处理的协程数量限制
 		// Limit on the number of concurrent goroutines used for parallel message processing (single connection)
 		ParallelGolimit int
@@ -128,6 +168,14 @@ type (
 		// Maximum read message content length
 		ReadMaxPayloadSize int
 
+		// 最大读取的单帧内容长度
+		// Maximum read frame content length
+		ReadMaxFrameSize int
+
+		// 最大读取的单条消息的帧数, 0表示不限制
+		// Maximum number of frames of a single read message, 0 means unlimited
+		ReadMaxFragments int
+
 		// 读缓冲区的大小
 		// Size of the read buffer
 		ReadBufferSize int
@@ -144,8 +192,76 @@ type (
 		// Whether to check the text utf8 encoding, turn off the performance will be better
 		CheckUtf8Enabled bool
 
-		// 消息回调(OnMessage)的恢复程序
-		// Message callback (OnMessage) recovery program
+		// 心跳间隔, 大于0时 ReadLoop 会定时发送 Ping 帧
+		// Ping interval, if greater than 0, ReadLoop sends ping frames periodically
+		PingInterval time.Duration
+
+		// 心跳超时, 发送 Ping 帧之后超过该时间没有收到 Pong 帧会断开连接
+		// Ping timeout, the connection is closed if no pong frame is received within this time after a ping
+		PingTimeout time.Duration
+
+		// 读超时, 大于0时在读取每一帧之前以及读取负载时设置读截止时间
+		// Read timeout, if greater than 0, the read deadline is set before reading each frame and while reading its payload
+		ReadTimeout time.Duration
+
+		// 发送队列容量, 0表示不限制
+		// Write queue capacity, 0 means unlimited
+		WriteQueueCapacity int
+
+		// 发送队列已满时的处理策略
+		// Policy applied when the write queue is full
+		QueueFullPolicy QueueFullPolicy
+
+		// 关闭超时, 写入关闭帧以及等待对端回复关闭帧的时间
+		// Close timeout, the time for writing the close frame and for awaiting the close frame of the peer
+		CloseTimeout time.Duration
+
+		// 每秒最多写入的字节数, 0表示不限制
+		// Maximum number of bytes written per second, 0 means unlimited
+		WriteRateLimit int
+
+		// 批量写入的最大帧数, 小于等于1表示不合并
+		// Maximum number of frames in a batched write, less than or equal to 1 means no coalescing
+		WriteBatchSize int
+
+		// 写入在到达网络之前被拒绝时是否保持连接
+		// Whether the connection stays open when a write is rejected before reaching the network
+		KeepOpenOnRejectedWrite bool
+
+		// 写入拦截器, 在压缩之前处理每个发出的帧的负载
+		// Write interceptor, processes the payload of every outgoing frame before compression
+		WriteInterceptor func(opcode Opcode, payload []byte) ([]byte, error)
+
+		// 是否开启流式读取
+		// Whether stream reading is enabled
+		StreamReadEnabled bool
+
+		// 是否关闭自动解压
+		// Whether automatic decompression is disabled
+		ManualDecompression bool
+
+		// 解压失败的回调, 返回 false 时丢弃该消息并继续读取
+		// Decompression failure callback, returning false discards the message and keeps reading
+		OnDecompressError func(socket *Conn, err error) (close bool)
+
+		// 读取拦截器, 在解压之后, OnMessage 之前处理每条收到的消息
+		// Read interceptor, processes every received message after decompression and before OnMessage
+		ReadInterceptor func(opcode Opcode, payload []byte) ([]byte, error)
+
+		// 是否延迟拼接分片消息
+		// Whether fragmented messages are reassembled lazily
+		LazyReassembly bool
+
+		// 帧观察回调
+		// Frame observer
+		OnFrame func(socket *Conn, fin bool, rsv1 bool, opcode Opcode, payloadLen int)
+
+		// 是否恢复事件回调中的 panic
+		// Whether panics in event callbacks are recovered
+		RecoverHandlerPanics bool
+
+		// 事件回调的恢复程序
+		// Event callback recovery program
 		Recovery func(logger Logger)
 
 		// 日志工具
@@ -168,20 +284,56 @@ type (
 		// PermessageDeflate configuration
 		PermessageDeflate PermessageDeflate
 
-		// 是否启用并行处理
-		// Whether parallel processing is enabled
+		// 自定义扩展, 按照注册顺序协商并转换消息, 参见 Extension
+		// 每个扩展必须占用不同的保留位(RSV2 或 RSV3), 保留位已被占用的扩展不会启用.
+		// Custom extensions, negotiated and applied to messages in registration order, see Extension.
+		// Each extension must claim a different reserved bit (RSV2 or RSV3), an extension whose bit is already taken is not enabled.
+		Extensions []Extension
+
+		// 是否启用并行处理, 默认关闭, 即按顺序逐条调用 OnMessage
+		// 开启后同一连接的 OnMessage 会被并发调用, 消息的处理顺序不再有保证
+		// Whether parallel processing is enabled. It is off by default, so OnMessage is called one message at a time in order.
+		// When enabled, OnMessage is called concurrently for the same connection and messages may be processed out of order.
+		// 连接关闭时, 已经读取的消息都会被处理, OnClose 在所有 OnMessage 返回之后才会被调用.
+		// When the connection closes, every message already read is still processed, and OnClose is only called after all OnMessage calls have returned.
 		ParallelEnabled bool
 
-		// 并行协程限制
-		// Parallel goroutine limit
+		// 是否开启拉取模式, 默认关闭
+		// 开启后不再调用 OnMessage, 而是由使用者循环调用 Conn.NextMessage 获取消息, 其他事件照常触发.
+		// 读协程会阻塞到消息被取走为止, 所以需要持续调用 NextMessage 直到它返回错误; 连接开始关闭之后不再阻塞, 未取走的消息被丢弃.
+		// Whether pull mode is enabled, it is off by default.
+		// When enabled, OnMessage is no longer called, messages are pulled by calling Conn.NextMessage in a loop instead,
+		// other events are emitted as usual. The read goroutine blocks until each message is taken,
+		// so NextMessage must keep being called until it returns an error; once the connection starts closing
+		// it no longer blocks and messages not taken are dropped.
+		PullMode bool
+
+		// 并行协程限制, 即单个连接同时运行的 OnMessage 数量上限, 默认为8
+		// Parallel goroutine limit, i.e. the maximum number of OnMessage calls running at the same time per connection, defaults to 8
 		ParallelGolimit int
 
 		// 读取最大负载大小
 		// Maximum payload size for reading
 		ReadMaxPayloadSize int
 
-		// 读取缓冲区大小
-		// Read buffer size
+		// 读取单帧的最大负载大小, 默认等于 ReadMaxPayloadSize
+		// 在解析帧头之后、分配内存之前检查, 超出时以 1009 状态码关闭连接
+		// Maximum payload size of a single frame for reading, defaults to ReadMaxPayloadSize.
+		// It is checked right after the frame header is parsed and before any allocation,
+		// the connection is closed with status code 1009 if it is exceeded.
+		ReadMaxFrameSize int
+
+		// 读取单条消息的最大帧数(包括第一帧和所有延续帧), 默认为 0, 即不限制
+		// 超出时以 1009 状态码关闭连接, 用于防御把消息拆成大量小帧的对端, 这类消息即使没有超过 ReadMaxPayloadSize 也会消耗大量 CPU. 流式读取同样生效.
+		// Maximum number of frames of a single read message (the first frame and all continuation frames), defaults to 0, i.e. unlimited.
+		// The connection is closed with status code 1009 if it is exceeded. It defends against peers that split a message into
+		// a huge number of tiny frames, which costs a lot of CPU even below ReadMaxPayloadSize. It also applies to stream reading.
+		ReadMaxFragments int
+
+		// 读取缓冲区大小, 默认4KB
+		// 更大的缓冲区可以减少大帧的系统调用次数, 代价是每个连接占用更多内存
+		// Read buffer size, defaults to 4KB.
+		// A larger buffer reduces syscalls for large frames at the cost of more memory per connection.
 		ReadBufferSize int
 
 		// 写入最大负载大小
@@ -192,12 +344,172 @@ type (
 		// Whether UTF-8 check is enabled
 		CheckUtf8Enabled bool
 
+		// 心跳间隔, 大于0时 ReadLoop 会定时发送 Ping 帧
+		// Ping interval, if greater than 0, ReadLoop sends ping frames periodically
+		PingInterval time.Duration
+
+		// 心跳超时, 默认等于心跳间隔
+		// 发送 Ping 帧之后超过该时间没有收到 Pong 帧会断开连接
+		// Ping timeout, defaults to the ping interval.
+		// The connection is closed if no pong frame is received within this time after a ping.
+		PingTimeout time.Duration
+
+		// 读超时(空闲超时), 大于0时在读取每一帧之前设置读截止时间, 任何帧都会重置它; 读取负载时每收到数据也会重置, 所以大帧不会仅仅因为体积大而超时.
+		// 超时后以 1001 状态码关闭连接, OnClose 收到 ErrReadTimeout. 适合自带心跳且不响应 Ping 的对端.
+		// Read (idle) timeout, if greater than 0, the read deadline is set before reading each frame, so any frame resets it.
+		// It is also reset whenever payload data arrives, so a large frame does not time out just because it is big.
+		// When it expires, the connection is closed with status code 1001 and OnClose receives ErrReadTimeout.
+		// Suitable for peers that send their own heartbeats and do not answer pings.
+		ReadTimeout time.Duration
+
+		// 发送队列容量, 即等待执行的异步任务数量上限, 0表示不限制
+		// 它只限制 WriteAsync 等异步写入, 与读取消息的并发度 ParallelGolimit 相互独立, 队列满时按照 QueueFullPolicy 处理.
+		// Write queue capacity, i.e. the maximum number of pending asynchronous jobs, 0 means unlimited.
+		// It only bounds asynchronous writes such as WriteAsync and is independent of ParallelGolimit,
+		// the concurrency of reading messages. QueueFullPolicy is applied when the queue is full.
+		WriteQueueCapacity int
+
+		// 发送队列已满时的处理策略, 默认为 QueueFullDropNewest
+		// Policy applied when the write queue is full, defaults to QueueFullDropNewest
+		QueueFullPolicy QueueFullPolicy
+
+		// 关闭超时, 默认5秒
+		// 写入关闭帧的截止时间, 超时后强制关闭底层连接, 避免阻塞在半关闭的连接上.
+		// 本端发起关闭且 ReadLoop 正在运行时, 发送关闭帧之后最多再等待这么久, 直到收到对端回复的关闭帧才断开连接.
+		// Close timeout, defaults to 5 seconds.
+		// Deadline for writing the close frame, after which the underlying connection is closed forcibly,
+		// so that half-closed connections do not block forever.
+		// When this side starts the close and ReadLoop is running, after sending the close frame it waits at most
+		// this long for the close frame of the peer before the connection is dropped.
+		CloseTimeout time.Duration
+
+		// 每个连接每秒最多写入的字节数(令牌桶限速), 0表示不限制
+		// 令牌不足时写入会阻塞, 但不会超过 SetWriteDeadline 设置的截止时间. 控制帧不受限制.
+		// Maximum number of bytes written per second per connection (token bucket), 0 means unlimited.
+		// Writes block when there are not enough tokens, but never beyond the deadline set by SetWriteDeadline.
+		// Control frames are not limited.
+		WriteRateLimit int
+
+		// 批量写入的最大帧数, 默认为0, 小于等于1表示不合并
+		// 大于1时, 发送队列中的异步写入(WriteAsync, WritevAsync, TryWriteAsync, Broadcast)会先进入缓冲区,
+		// 直到缓冲了这么多帧或者队列为空时才一次性写入连接, 以减少小消息的系统调用次数.
+		// 此时回调收到的错误只代表帧是否进入了缓冲区, 写入错误会触发 OnClose.
+		// Maximum number of frames in a batched write, defaults to 0, less than or equal to 1 means no coalescing.
+		// If greater than 1, asynchronous writes of the write queue (WriteAsync, WritevAsync, TryWriteAsync, Broadcast)
+		// go to a buffer first, which is written to the connection at once when it holds this many frames
+		// or when the queue is empty, reducing syscalls for small messages.
+		// The error passed to callbacks then only tells whether the frame was buffered, write errors trigger OnClose.
+		WriteBatchSize int
+
+		// 写入在到达网络之前被拒绝时是否保持连接, 默认为 false, 即关闭连接
+		// 被拒绝的写入包括文本编码无效, 消息过大, 等待限速令牌超时以及写入拦截器返回错误, 此时写方法只返回错误, 需要时可以调用 WriteClose 主动关闭.
+		// 读取错误和网络写入错误总是会关闭连接, 因为帧流可能已经损坏.
+		// Whether the connection stays open when a write is rejected before reaching the network, defaults to false, i.e. the connection is closed.
+		// Rejected writes are invalid text encoding, message too large, timing out while waiting for rate limit tokens
+		// and errors returned by the write interceptor,
+		// in which case the write method only returns the error and WriteClose can be called if it is fatal.
+		// Read errors and network write errors always close the connection, since the frame stream may be broken.
+		KeepOpenOnRejectedWrite bool
+
+		// 写入拦截器, 默认为 nil
+		// 在写锁内, 压缩之前对每个发出的帧调用(同步和异步写入, Writev 和 WriteBatch), 可以返回修改后的负载, 例如添加序号或者签名;
+		// 返回错误时中止该次写入, 写方法返回该错误, 它和其他被拒绝的写入一样受 KeepOpenOnRejectedWrite 控制.
+		// 关闭帧, Broadcaster 预先编码的帧和 WriteFile 不经过拦截器.
+		// 拦截器在写锁内串行执行, 不要在其中写入同一个连接, 否则会死锁. payload 是调用者负载的副本, 可以原地修改或者追加.
+		// Write interceptor, defaults to nil.
+		// It is called for every outgoing frame under the write lock and before compression
+		// (synchronous and asynchronous writes, Writev and WriteBatch), and may return a modified payload,
+		// e.g. to add a sequence number or a signature. Returning an error aborts the write and the write method returns it,
+		// like other rejected writes it is subject to KeepOpenOnRejectedWrite.
+		// Close frames, frames pre-encoded by a Broadcaster and WriteFile do not go through the interceptor.
+		// The interceptor runs serially under the write lock, writing to the same connection from it deadlocks.
+		// payload is a copy of the payload of the caller, so it may be modified in place or appended to.
+		WriteInterceptor func(opcode Opcode, payload []byte) ([]byte, error)
+
+		// 是否开启流式读取, 默认为 false
+		// 开启后, 如果事件处理器实现了 StreamHandler, 数据消息不再整体缓存, 而是收到第一帧时通过 OnStream 按帧读取.
+		// 流式读取的消息总长度(压缩消息为解压后的长度)同样受 ReadMaxPayloadSize 限制, 超出时以 1009 状态码关闭连接;
+		// 单个帧受 ReadMaxFrameSize 限制. 流式读取不会检查文本编码.
+		// Whether stream reading is enabled, defaults to false.
+		// When enabled and the event handler implements StreamHandler, data messages are no longer buffered as a whole,
+		// they are read frame by frame through OnStream as soon as the first frame arrives.
+		// The total size of a streamed message (decompressed, if it is compressed) is still bounded by ReadMaxPayloadSize,
+		// the connection is closed with status code 1009 beyond it; each frame is limited by ReadMaxFrameSize.
+		// The text encoding is not checked.
+		StreamReadEnabled bool
+
+		// 是否关闭自动解压, 开启后压缩消息(RSV1)的原始负载会直接交给 OnMessage, Message.Compressed() 返回 true
+		// 解压由使用者负责(deflate 数据需要追加 0x00 0x00 0xff 0xff). 不会检查压缩消息的文本编码.
+		// 开启上下文接管时解压依赖之前所有的消息, 建议同时关闭对端的上下文接管.
+		// Whether automatic decompression is disabled. When enabled, the raw payload of compressed (RSV1) messages
+		// is handed to OnMessage as is, and Message.Compressed() reports true.
+		// The user is responsible for decompression (deflate data needs 0x00 0x00 0xff 0xff appended),
+		// and the text encoding of compressed messages is not checked.
+		// With context takeover, decompression depends on all previous messages,
+		// so it is recommended to disable context takeover for the peer as well.
+		ManualDecompression bool
+
+		// 解压失败的回调, 默认为 nil, 即关闭连接
+		// 返回 false 时丢弃该消息并继续读取, 返回 true 时以 1011 状态码关闭连接. 只对自动解压生效.
+		// 开启对端的上下文接管时, 后续消息的解压依赖丢弃的消息, 很可能继续失败, 建议同时关闭对端的上下文接管.
+		// Decompression failure callback, defaults to nil, i.e. the connection is closed.
+		// Returning false discards the message and keeps reading, returning true closes the connection with status code 1011.
+		// It only applies to automatic decompression. With context takeover on the peer, later messages depend on
+		// the discarded one and will most likely fail as well, so it is recommended to disable context takeover for the peer.
+		OnDecompressError func(socket *Conn, err error) (close bool)
+
+		// 读取拦截器, 默认为 nil
+		// 在读协程中, 解压之后, 检查文本编码和 OnMessage 之前对每条收到的数据消息调用, 返回的负载替换消息内容, 例如解密或者校验签名.
+		// 返回错误时以 1008 状态码关闭连接. 流式读取和手动解压的压缩消息不经过拦截器. payload 只在调用期间有效.
+		// Read interceptor, defaults to nil.
+		// It is called on the read goroutine for every received data message, after decompression and before
+		// the text encoding check and OnMessage. The returned payload replaces the message content,
+		// e.g. to decrypt it or verify a signature. Returning an error closes the connection with status code 1008.
+		// Streamed messages and compressed messages with manual decompression bypass the interceptor.
+		// The payload is only valid during the call.
+		ReadInterceptor func(opcode Opcode, payload []byte) ([]byte, error)
+
+		// 是否延迟拼接分片消息, 默认为 false
+		// 开启后分片消息的各个帧保留在各自的缓冲区中, Message.Data 为 nil, 通过 Message.Read 依次读取各个分片, 省去拼接大消息时的复制.
+		// Message.Bytes 和 Message.Bind 会先把分片合并到 Message.Data. 单帧消息, 压缩消息, 使用自定义扩展的消息,
+		// 设置了 ReadInterceptor 以及需要检查文本编码的消息依赖完整的负载, 仍然按照原来的方式拼接.
+		// Whether fragmented messages are reassembled lazily, defaults to false.
+		// When enabled, the frames of a fragmented message stay in their own buffers and Message.Data is nil;
+		// Message.Read walks the fragments in order, which saves the copy when reassembling large messages.
+		// Message.Bytes and Message.Bind merge the fragments into Message.Data first.
+		// Single-frame messages, compressed messages, messages using custom extensions, and messages that need
+		// the full payload for ReadInterceptor or the text encoding check are still reassembled as before.
+		LazyReassembly bool
+
+		// 帧观察回调, 默认为 nil
+		// 在读协程中, 对收到的每一个物理帧(包括控制帧和延续帧)在解析帧头之后, 校验, 拼接和解压之前调用, 只用于观察, 例如调试互通问题.
+		// payloadLen 是帧头中声明的负载长度. 回调不能修改连接的读状态, 应当尽快返回.
+		// Frame observer, defaults to nil.
+		// It is called on the read goroutine for every physical frame received, including control and continuation frames,
+		// right after the frame header is parsed and before validation, reassembly and decompression.
+		// It is for observation only, e.g. to diagnose interop issues. payloadLen is the payload length declared in the header.
+		// The callback must not change the read state of the connection and should return quickly.
+		OnFrame func(socket *Conn, fin bool, rsv1 bool, opcode Opcode, payloadLen int)
+
 		// 日志记录器
 		// Logger
 		Logger Logger
 
-		// 恢复函数
-		// Recovery function
+		// 是否恢复事件回调(OnOpen, OnClose, OnPing, OnPong, OnMessage, OnStream)中的 panic, 为空时默认为 true
+		// 回调发生 panic 时(OnClose 除外)先以 1011 状态码关闭连接, OnClose 收到 ErrHandlerPanic, 然后交给 Recovery 记录日志.
+		// 设置为 false 时不做恢复, panic 会继续传播, 除非 Recovery 自己调用了 recover.
+		// Whether panics in event callbacks (OnOpen, OnClose, OnPing, OnPong, OnMessage, OnStream) are recovered,
+		// nil means true.
+		// When a callback other than OnClose panics, the connection is first closed with status code 1011 and OnClose
+		// receives ErrHandlerPanic, then the panic is handed to Recovery for logging.
+		// If it is set to false, panics keep propagating unless Recovery calls recover itself.
+		RecoverHandlerPanics *bool
+
+		// 恢复函数, 用于记录事件回调中的 panic, 默认为 gws.Recovery, 即通过 Logger 打印 panic 和调用栈
+		// 开启 RecoverHandlerPanics 时, 即使恢复函数没有调用 recover, panic 也会被恢复.
+		// Recovery function that logs panics in event callbacks,
+		// defaults to gws.Recovery, which prints the panic and the stack trace through Logger.
+		// With RecoverHandlerPanics enabled, the panic is recovered even if the function does not call recover.
 		Recovery func(logger Logger)
 
 		// TLS 设置
@@ -208,8 +520,18 @@ type (
 		// Handshake timeout duration
 		HandshakeTimeout time.Duration
 
-		// WebSocket 子协议, 握手失败会断开连接
-		// WebSocket sub-protocol, handshake failure disconnects the connection
+		// TCP 保活探测的间隔, 默认为 0, 即保持操作系统或者 http.Server 的设置, 负数表示关闭保活
+		// 只对 TCP 连接(包括 TCP 上的 TLS)生效, 其他连接忽略. 它在操作系统层面检测失效的连接, 与应用层的 PingInterval 相互独立.
+		// Interval of TCP keep-alive probes, defaults to 0, i.e. the setting of the operating system or http.Server is kept,
+		// a negative value disables keep-alive. It only applies to TCP connections (including TLS over TCP)
+		// and is ignored for other connections. It detects dead connections at the operating system level,
+		// independently of the application-level PingInterval.
+		TCPKeepAlive time.Duration
+
+		// WebSocket 子协议, 按优先级排列
+		// 协商失败时握手仍然成功, 但协商结果为空字符串
+		// WebSocket sub-protocols, in priority order.
+		// If negotiation fails, the handshake still succeeds with an empty sub-protocol.
 		SubProtocols []string
 
 		// 额外的响应头(可能不受客户端支持)
@@ -217,10 +539,71 @@ type (
 		// https://www.rfc-editor.org/rfc/rfc6455.html#section-1.3
 		ResponseHeader http.Header
 
+		// 修改握手响应头, 在写入响应之前调用, 可以根据请求设置每个连接不同的响应头(例如 Cookie)
+		// header 是 ResponseHeader 的副本, 修改它不会影响其他连接. WebSocket 协议相关的响应头不能被修改.
+		// Modifies the handshake response headers. It is called right before the response is written
+		// and can set per-connection headers derived from the request (e.g. cookies).
+		// header is a copy of ResponseHeader, so modifying it does not affect other connections.
+		// The WebSocket protocol headers cannot be modified.
+		ModifyResponseHeader func(r *http.Request, header http.Header)
+
+		// 可信的反向代理, 元素为 CIDR 或者 IP 地址
+		// 只有直接对端是可信代理时才会解析 X-Forwarded-For 和 X-Forwarded-Proto 请求头,
+		// 以获取客户端的真实 IP 和原始协议, 参见 Upgrader.ClientIP 和 Upgrader.IsSecure.
+		// Trusted reverse proxies, each element is a CIDR or an IP address.
+		// The X-Forwarded-For and X-Forwarded-Proto headers are only parsed for the real client IP and the original scheme
+		// when the direct peer is a trusted proxy, see Upgrader.ClientIP and Upgrader.IsSecure.
+		TrustedProxies []string
+
+		// 是否通过 Sec-WebSocket-MaxPayload 响应头告知客户端 ReadMaxPayloadSize, 默认为 false
+		// 开启后同时读取客户端在同名请求头中声明的上限, 参见 Conn.PeerMaxPayloadSize. 这不是标准的协议扩展, 只适用于双方都遵守该约定的私有协议.
+		// Whether ReadMaxPayloadSize is advertised to the client in the Sec-WebSocket-MaxPayload response header, defaults to false.
+		// When enabled, the limit advertised by the client in the request header of the same name is read as well,
+		// see Conn.PeerMaxPayloadSize. This is not a standard extension, it is only meant for private protocols
+		// where both sides honor the advertised value.
+		AdvertiseMaxPayload bool
+
+		// 最大并发连接数, 默认不限制
+		// 达到上限时新的握手请求响应 503. 连接在 ReadLoop 返回后才会释放名额; 并发握手时可能略微超出上限.
+		// Maximum number of concurrent connections, unlimited by default.
+		// Handshakes beyond the limit are answered with 503. A connection frees its slot when its ReadLoop returns;
+		// the limit may be slightly exceeded by concurrent handshakes.
+		MaxConcurrentConnections int
+
+		// 是否收集握手请求所有未通过的校验项(方法, Connection, Upgrade, 版本, Sec-WebSocket-Key), 默认在第一个失败项返回
+		// 开启后返回 HandshakeErrors, 便于排查某个客户端无法连接的原因.
+		// Whether to collect every failed check of a handshake request (method, Connection, Upgrade, version, Sec-WebSocket-Key),
+		// by default the first failure is returned. When enabled a HandshakeErrors is returned,
+		// which helps diagnose why a particular client cannot connect.
+		VerboseHandshakeErrors bool
+
+		// 是否汇总所有连接的统计信息, 默认为 false
+		// 开启后每次读写都会额外更新一组被所有连接共享的原子计数器, 通过 Upgrader.Stats 读取; 关闭时 Upgrader.Stats 总是返回0.
+		// 每个连接自身的统计信息(Conn.Stats)不受影响.
+		// Whether the statistics of all connections are aggregated, defaults to false.
+		// When enabled, every read and write additionally updates a set of atomic counters shared by all connections,
+		// which Upgrader.Stats reads; when disabled Upgrader.Stats always returns zeros.
+		// The statistics of each connection (Conn.Stats) are not affected.
+		AggregateStats bool
+
 		// 鉴权函数，用于连接建立的请求
-		// Authentication function for connection establishment requests
+		// 在劫持连接之前调用, 可以向 session 写入用户信息; 返回 false 时响应 403 并终止升级
+		// Authentication function for connection establishment requests.
+		// It is called before the connection is hijacked and may populate the session;
+		// returning false responds with 403 and aborts the upgrade.
 		Authorize func(r *http.Request, session SessionStorage) bool
 
+		// 升级请求在劫持连接之前被拒绝时调用, 用于写入自定义的错误响应, 例如 JSON 格式的错误信息
+		// 默认写入状态码和纯文本的错误原因. 调用前已经设置好协议要求的响应头(如版本不匹配时的 Sec-WebSocket-Version).
+		// 只在 Upgrade 中使用; UpgradeFromConn 没有 http.ResponseWriter, 以及劫持之后的错误仍然写入纯文本响应.
+		// Called when an upgrade request is rejected before the connection is hijacked,
+		// to write a custom error response, e.g. a JSON error body.
+		// By default the status code and the reason are written as plain text. Response headers required by
+		// the protocol (such as Sec-WebSocket-Version on a version mismatch) are set before it is called.
+		// It is only used by Upgrade; UpgradeFromConn has no http.ResponseWriter,
+		// and errors after hijacking are still answered with plain text.
+		OnUpgradeReject func(w http.ResponseWriter, r *http.Request, reason error)
+
 		// 创建 session 存储空间，用于自定义 SessionStorage 实现
 		// Create session storage space for custom SessionStorage implementations
 		NewSession func() SessionStorage
@@ -240,11 +623,17 @@ func (c *PermessageDeflate) setThreshold(isServer bool) {
 // 删除受保护的 WebSocket 头部字段
 // Removes protected WebSocket header fields
 func (c *ServerOption) deleteProtectedHeaders() {
-	c.ResponseHeader.Del(internal.Upgrade.Key)
-	c.ResponseHeader.Del(internal.Connection.Key)
-	c.ResponseHeader.Del(internal.SecWebSocketAccept.Key)
-	c.ResponseHeader.Del(internal.SecWebSocketExtensions.Key)
-	c.ResponseHeader.Del(internal.SecWebSocketProtocol.Key)
+	deleteProtectedHeaders(c.ResponseHeader)
+}
+
+// 从响应头中删除受保护的 WebSocket 头部字段
+// Removes protected WebSocket header fields from the response headers
+func deleteProtectedHeaders(h http.Header) {
+	h.Del(internal.Upgrade.Key)
+	h.Del(internal.Connection.Key)
+	h.Del(internal.SecWebSocketAccept.Key)
+	h.Del(internal.SecWebSocketExtensions.Key)
+	h.Del(internal.SecWebSocketProtocol.Key)
 }
 
 // 初始化服务器配置
@@ -256,6 +645,9 @@ func initServerOption(c *ServerOption) *ServerOption {
 	if c.ReadMaxPayloadSize <= 0 {
 		c.ReadMaxPayloadSize = defaultReadMaxPayloadSize
 	}
+	if c.ReadMaxFrameSize <= 0 {
+		c.ReadMaxFrameSize = c.ReadMaxPayloadSize
+	}
 	if c.ParallelGolimit <= 0 {
 		c.ParallelGolimit = defaultParallelGolimit
 	}
@@ -271,6 +663,11 @@ func initServerOption(c *ServerOption) *ServerOption {
 	if c.Authorize == nil {
 		c.Authorize = func(r *http.Request, session SessionStorage) bool { return true }
 	}
+	if c.OnUpgradeReject == nil {
+		c.OnUpgradeReject = func(w http.ResponseWriter, r *http.Request, reason error) {
+			http.Error(w, reason.Error(), UpgradeErrorStatus(reason))
+		}
+	}
 	if c.NewSession == nil {
 		c.NewSession = func() SessionStorage { return newSmap() }
 	}
@@ -280,12 +677,15 @@ func initServerOption(c *ServerOption) *ServerOption {
 	if c.HandshakeTimeout <= 0 {
 		c.HandshakeTimeout = defaultHandshakeTimeout
 	}
+	if c.PingTimeout <= 0 {
+		c.PingTimeout = c.PingInterval
+	}
+	if c.CloseTimeout <= 0 {
+		c.CloseTimeout = defaultCloseTimeout
+	}
 	if c.Logger == nil {
 		c.Logger = defaultLogger
 	}
-	if c.Recovery == nil {
-		c.Recovery = func(logger Logger) {}
-	}
 
 	if c.PermessageDeflate.Enabled {
 		if c.PermessageDeflate.ServerMaxWindowBits < 8 || c.PermessageDeflate.ServerMaxWindowBits > 15 {
@@ -309,19 +709,42 @@ func initServerOption(c *ServerOption) *ServerOption {
 	c.deleteProtectedHeaders()
 
 	c.config = &Config{
-		ParallelEnabled:     c.ParallelEnabled,
-		ParallelGolimit:     c.ParallelGolimit,
-		ReadMaxPayloadSize:  c.ReadMaxPayloadSize,
-		ReadBufferSize:      c.ReadBufferSize,
-		WriteMaxPayloadSize: c.WriteMaxPayloadSize,
-		WriteBufferSize:     c.WriteBufferSize,
-		CheckUtf8Enabled:    c.CheckUtf8Enabled,
-		Recovery:            c.Recovery,
-		Logger:              c.Logger,
+		ParallelEnabled:         c.ParallelEnabled,
+		PullMode:                c.PullMode,
+		ParallelGolimit:         c.ParallelGolimit,
+		ReadMaxPayloadSize:      c.ReadMaxPayloadSize,
+		ReadMaxFrameSize:        c.ReadMaxFrameSize,
+		ReadMaxFragments:        c.ReadMaxFragments,
+		ReadBufferSize:          c.ReadBufferSize,
+		WriteMaxPayloadSize:     c.WriteMaxPayloadSize,
+		WriteBufferSize:         c.WriteBufferSize,
+		CheckUtf8Enabled:        c.CheckUtf8Enabled,
+		PingInterval:            c.PingInterval,
+		PingTimeout:             c.PingTimeout,
+		ReadTimeout:             c.ReadTimeout,
+		WriteQueueCapacity:      c.WriteQueueCapacity,
+		QueueFullPolicy:         c.QueueFullPolicy,
+		CloseTimeout:            c.CloseTimeout,
+		WriteRateLimit:          c.WriteRateLimit,
+		WriteBatchSize:          c.WriteBatchSize,
+		KeepOpenOnRejectedWrite: c.KeepOpenOnRejectedWrite,
+		WriteInterceptor:        c.WriteInterceptor,
+		StreamReadEnabled:       c.StreamReadEnabled,
+		ManualDecompression:     c.ManualDecompression,
+		OnDecompressError:       c.OnDecompressError,
+		ReadInterceptor:         c.ReadInterceptor,
+		LazyReassembly:          c.LazyReassembly,
+		OnFrame:                 c.OnFrame,
+		RecoverHandlerPanics:    c.RecoverHandlerPanics == nil || *c.RecoverHandlerPanics,
+		Recovery:                newRecovery(c.RecoverHandlerPanics == nil || *c.RecoverHandlerPanics, c.Recovery),
+		Logger:                  c.Logger,
 		brPool: internal.NewPool(func() *bufio.Reader {
 			return bufio.NewReaderSize(nil, c.ReadBufferSize)
 		}),
 	}
+	if c.AggregateStats {
+		c.config.stats = new(statsCounter)
+	}
 
 	if c.PermessageDeflate.Enabled {
 		c.config.bdPool = internal.NewPool[*bigDeflater](func() *bigDeflater {
@@ -344,6 +767,29 @@ func initServerOption(c *ServerOption) *ServerOption {
 	return c
 }
 
+// 生成事件回调使用的恢复函数
+// recoverPanics 为 true 时总是恢复 panic, 然后在 panic 的上下文中调用 hook 记录日志, 这样 hook 里的 recover 仍然可以取到 panic 的值.
+// Builds the recovery function used by event callbacks.
+// If recoverPanics is true, the panic is always recovered and hook is then called in a panicking context for logging,
+// so that recover in hook still gets the panic value.
+func newRecovery(recoverPanics bool, hook func(logger Logger)) func(logger Logger) {
+	if !recoverPanics {
+		return internal.SelectValue(hook == nil, func(logger Logger) {}, hook)
+	}
+	if hook == nil {
+		return Recovery
+	}
+	return func(logger Logger) {
+		if e := recover(); e != nil {
+			defer func() { _ = recover() }()
+			func() {
+				defer hook(logger)
+				panic(e)
+			}()
+		}
+	}
+}
+
 // 获取服务器配置
 // Get server configuration
 func (c *ServerOption) getConfig() *Config { return c.config }
@@ -359,20 +805,56 @@ type ClientOption struct {
 	// PermessageDeflate configuration
 	PermessageDeflate PermessageDeflate
 
-	// 是否启用并行处理
-	// Whether parallel processing is enabled
+	// 自定义扩展, 按照注册顺序协商并转换消息, 参见 Extension
+	// 每个扩展必须占用不同的保留位(RSV2 或 RSV3), 保留位已被占用的扩展不会启用.
+	// Custom extensions, negotiated and applied to messages in registration order, see Extension.
+	// Each extension must claim a different reserved bit (RSV2 or RSV3), an extension whose bit is already taken is not enabled.
+	Extensions []Extension
+
+	// 是否启用并行处理, 默认关闭, 即按顺序逐条调用 OnMessage
+	// 开启后同一连接的 OnMessage 会被并发调用, 消息的处理顺序不再有保证
+	// Whether parallel processing is enabled. It is off by default, so OnMessage is called one message at a time in order.
+	// When enabled, OnMessage is called concurrently for the same connection and messages may be processed out of order.
+	// 连接关闭时, 已经读取的消息都会被处理, OnClose 在所有 OnMessage 返回之后才会被调用.
+	// When the connection closes, every message already read is still processed, and OnClose is only called after all OnMessage calls have returned.
 	ParallelEnabled bool
 
-	// 并行协程限制
-	// Parallel goroutine limit
+	// 是否开启拉取模式, 默认关闭
+	// 开启后不再调用 OnMessage, 而是由使用者循环调用 Conn.NextMessage 获取消息, 其他事件照常触发.
+	// 读协程会阻塞到消息被取走为止, 所以需要持续调用 NextMessage 直到它返回错误; 连接开始关闭之后不再阻塞, 未取走的消息被丢弃.
+	// Whether pull mode is enabled, it is off by default.
+	// When enabled, OnMessage is no longer called, messages are pulled by calling Conn.NextMessage in a loop instead,
+	// other events are emitted as usual. The read goroutine blocks until each message is taken,
+	// so NextMessage must keep being called until it returns an error; once the connection starts closing
+	// it no longer blocks and messages not taken are dropped.
+	PullMode bool
+
+	// 并行协程限制, 即单个连接同时运行的 OnMessage 数量上限, 默认为8
+	// Parallel goroutine limit, i.e. the maximum number of OnMessage calls running at the same time per connection, defaults to 8
 	ParallelGolimit int
 
 	// 读取最大负载大小
 	// Maximum payload size for reading
 	ReadMaxPayloadSize int
 
-	// 读取缓冲区大小
-	// Read buffer size
+	// 读取单帧的最大负载大小, 默认等于 ReadMaxPayloadSize
+	// 在解析帧头之后、分配内存之前检查, 超出时以 1009 状态码关闭连接
+	// Maximum payload size of a single frame for reading, defaults to ReadMaxPayloadSize.
+	// It is checked right after the frame header is parsed and before any allocation,
+	// the connection is closed with status code 1009 if it is exceeded.
+	ReadMaxFrameSize int
+
+	// 读取单条消息的最大帧数(包括第一帧和所有延续帧), 默认为 0, 即不限制
+	// 超出时以 1009 状态码关闭连接, 用于防御把消息拆成大量小帧的对端, 这类消息即使没有超过 ReadMaxPayloadSize 也会消耗大量 CPU. 流式读取同样生效.
+	// Maximum number of frames of a single read message (the first frame and all continuation frames), defaults to 0, i.e. unlimited.
+	// The connection is closed with status code 1009 if it is exceeded. It defends against peers that split a message into
+	// a huge number of tiny frames, which costs a lot of CPU even below ReadMaxPayloadSize. It also applies to stream reading.
+	ReadMaxFragments int
+
+	// 读取缓冲区大小, 默认4KB
+	// 更大的缓冲区可以减少大帧的系统调用次数, 代价是每个连接占用更多内存
+	// Read buffer size, defaults to 4KB.
+	// A larger buffer reduces syscalls for large frames at the cost of more memory per connection.
 	ReadBufferSize int
 
 	// 写入最大负载大小
@@ -383,12 +865,172 @@ type ClientOption struct {
 	// Whether UTF-8 check is enabled
 	CheckUtf8Enabled bool
 
+	// 心跳间隔, 大于0时 ReadLoop 会定时发送 Ping 帧
+	// Ping interval, if greater than 0, ReadLoop sends ping frames periodically
+	PingInterval time.Duration
+
+	// 心跳超时, 默认等于心跳间隔
+	// 发送 Ping 帧之后超过该时间没有收到 Pong 帧会断开连接
+	// Ping timeout, defaults to the ping interval.
+	// The connection is closed if no pong frame is received within this time after a ping.
+	PingTimeout time.Duration
+
+	// 读超时(空闲超时), 大于0时在读取每一帧之前设置读截止时间, 任何帧都会重置它; 读取负载时每收到数据也会重置, 所以大帧不会仅仅因为体积大而超时.
+	// 超时后以 1001 状态码关闭连接, OnClose 收到 ErrReadTimeout. 适合自带心跳且不响应 Ping 的对端.
+	// Read (idle) timeout, if greater than 0, the read deadline is set before reading each frame, so any frame resets it.
+	// It is also reset whenever payload data arrives, so a large frame does not time out just because it is big.
+	// When it expires, the connection is closed with status code 1001 and OnClose receives ErrReadTimeout.
+	// Suitable for peers that send their own heartbeats and do not answer pings.
+	ReadTimeout time.Duration
+
+	// 发送队列容量, 即等待执行的异步任务数量上限, 0表示不限制
+	// 它只限制 WriteAsync 等异步写入, 与读取消息的并发度 ParallelGolimit 相互独立, 队列满时按照 QueueFullPolicy 处理.
+	// Write queue capacity, i.e. the maximum number of pending asynchronous jobs, 0 means unlimited.
+	// It only bounds asynchronous writes such as WriteAsync and is independent of ParallelGolimit,
+	// the concurrency of reading messages. QueueFullPolicy is applied when the queue is full.
+	WriteQueueCapacity int
+
+	// 发送队列已满时的处理策略, 默认为 QueueFullDropNewest
+	// Policy applied when the write queue is full, defaults to QueueFullDropNewest
+	QueueFullPolicy QueueFullPolicy
+
+	// 关闭超时, 默认5秒
+	// 写入关闭帧的截止时间, 超时后强制关闭底层连接, 避免阻塞在半关闭的连接上.
+	// 本端发起关闭且 ReadLoop 正在运行时, 发送关闭帧之后最多再等待这么久, 直到收到对端回复的关闭帧才断开连接.
+	// Close timeout, defaults to 5 seconds.
+	// Deadline for writing the close frame, after which the underlying connection is closed forcibly,
+	// so that half-closed connections do not block forever.
+	// When this side starts the close and ReadLoop is running, after sending the close frame it waits at most
+	// this long for the close frame of the peer before the connection is dropped.
+	CloseTimeout time.Duration
+
+	// 每个连接每秒最多写入的字节数(令牌桶限速), 0表示不限制
+	// 令牌不足时写入会阻塞, 但不会超过 SetWriteDeadline 设置的截止时间. 控制帧不受限制.
+	// Maximum number of bytes written per second per connection (token bucket), 0 means unlimited.
+	// Writes block when there are not enough tokens, but never beyond the deadline set by SetWriteDeadline.
+	// Control frames are not limited.
+	WriteRateLimit int
+
+	// 批量写入的最大帧数, 默认为0, 小于等于1表示不合并
+	// 大于1时, 发送队列中的异步写入(WriteAsync, WritevAsync, TryWriteAsync, Broadcast)会先进入缓冲区,
+	// 直到缓冲了这么多帧或者队列为空时才一次性写入连接, 以减少小消息的系统调用次数.
+	// 此时回调收到的错误只代表帧是否进入了缓冲区, 写入错误会触发 OnClose.
+	// Maximum number of frames in a batched write, defaults to 0, less than or equal to 1 means no coalescing.
+	// If greater than 1, asynchronous writes of the write queue (WriteAsync, WritevAsync, TryWriteAsync, Broadcast)
+	// go to a buffer first, which is written to the connection at once when it holds this many frames
+	// or when the queue is empty, reducing syscalls for small messages.
+	// The error passed to callbacks then only tells whether the frame was buffered, write errors trigger OnClose.
+	WriteBatchSize int
+
+	// 写入在到达网络之前被拒绝时是否保持连接, 默认为 false, 即关闭连接
+	// 被拒绝的写入包括文本编码无效, 消息过大, 等待限速令牌超时以及写入拦截器返回错误, 此时写方法只返回错误, 需要时可以调用 WriteClose 主动关闭.
+	// 读取错误和网络写入错误总是会关闭连接, 因为帧流可能已经损坏.
+	// Whether the connection stays open when a write is rejected before reaching the network, defaults to false, i.e. the connection is closed.
+	// Rejected writes are invalid text encoding, message too large, timing out while waiting for rate limit tokens
+	// and errors returned by the write interceptor,
+	// in which case the write method only returns the error and WriteClose can be called if it is fatal.
+	// Read errors and network write errors always close the connection, since the frame stream may be broken.
+	KeepOpenOnRejectedWrite bool
+
+	// 写入拦截器, 默认为 nil
+	// 在写锁内, 压缩之前对每个发出的帧调用(同步和异步写入, Writev 和 WriteBatch), 可以返回修改后的负载, 例如添加序号或者签名;
+	// 返回错误时中止该次写入, 写方法返回该错误, 它和其他被拒绝的写入一样受 KeepOpenOnRejectedWrite 控制.
+	// 关闭帧, Broadcaster 预先编码的帧和 WriteFile 不经过拦截器.
+	// 拦截器在写锁内串行执行, 不要在其中写入同一个连接, 否则会死锁. payload 是调用者负载的副本, 可以原地修改或者追加.
+	// Write interceptor, defaults to nil.
+	// It is called for every outgoing frame under the write lock and before compression
+	// (synchronous and asynchronous writes, Writev and WriteBatch), and may return a modified payload,
+	// e.g. to add a sequence number or a signature. Returning an error aborts the write and the write method returns it,
+	// like other rejected writes it is subject to KeepOpenOnRejectedWrite.
+	// Close frames, frames pre-encoded by a Broadcaster and WriteFile do not go through the interceptor.
+	// The interceptor runs serially under the write lock, writing to the same connection from it deadlocks.
+	// payload is a copy of the payload of the caller, so it may be modified in place or appended to.
+	WriteInterceptor func(opcode Opcode, payload []byte) ([]byte, error)
+
+	// 是否开启流式读取, 默认为 false
+	// 开启后, 如果事件处理器实现了 StreamHandler, 数据消息不再整体缓存, 而是收到第一帧时通过 OnStream 按帧读取.
+	// 流式读取的消息总长度(压缩消息为解压后的长度)同样受 ReadMaxPayloadSize 限制, 超出时以 1009 状态码关闭连接;
+	// 单个帧受 ReadMaxFrameSize 限制. 流式读取不会检查文本编码.
+	// Whether stream reading is enabled, defaults to false.
+	// When enabled and the event handler implements StreamHandler, data messages are no longer buffered as a whole,
+	// they are read frame by frame through OnStream as soon as the first frame arrives.
+	// The total size of a streamed message (decompressed, if it is compressed) is still bounded by ReadMaxPayloadSize,
+	// the connection is closed with status code 1009 beyond it; each frame is limited by ReadMaxFrameSize.
+	// The text encoding is not checked.
+	StreamReadEnabled bool
+
+	// 是否关闭自动解压, 开启后压缩消息(RSV1)的原始负载会直接交给 OnMessage, Message.Compressed() 返回 true
+	// 解压由使用者负责(deflate 数据需要追加 0x00 0x00 0xff 0xff). 不会检查压缩消息的文本编码.
+	// 开启上下文接管时解压依赖之前所有的消息, 建议同时关闭对端的上下文接管.
+	// Whether automatic decompression is disabled. When enabled, the raw payload of compressed (RSV1) messages
+	// is handed to OnMessage as is, and Message.Compressed() reports true.
+	// The user is responsible for decompression (deflate data needs 0x00 0x00 0xff 0xff appended),
+	// and the text encoding of compressed messages is not checked.
+	// With context takeover, decompression depends on all previous messages,
+	// so it is recommended to disable context takeover for the peer as well.
+	ManualDecompression bool
+
+	// 解压失败的回调, 默认为 nil, 即关闭连接
+	// 返回 false 时丢弃该消息并继续读取, 返回 true 时以 1011 状态码关闭连接. 只对自动解压生效.
+	// 开启对端的上下文接管时, 后续消息的解压依赖丢弃的消息, 很可能继续失败, 建议同时关闭对端的上下文接管.
+	// Decompression failure callback, defaults to nil, i.e. the connection is closed.
+	// Returning false discards the message and keeps reading, returning true closes the connection with status code 1011.
+	// It only applies to automatic decompression. With context takeover on the peer, later messages depend on
+	// the discarded one and will most likely fail as well, so it is recommended to disable context takeover for the peer.
+	OnDecompressError func(socket *Conn, err error) (close bool)
+
+	// 读取拦截器, 默认为 nil
+	// 在读协程中, 解压之后, 检查文本编码和 OnMessage 之前对每条收到的数据消息调用, 返回的负载替换消息内容, 例如解密或者校验签名.
+	// 返回错误时以 1008 状态码关闭连接. 流式读取和手动解压的压缩消息不经过拦截器. payload 只在调用期间有效.
+	// Read interceptor, defaults to nil.
+	// It is called on the read goroutine for every received data message, after decompression and before
+	// the text encoding check and OnMessage. The returned payload replaces the message content,
+	// e.g. to decrypt it or verify a signature. Returning an error closes the connection with status code 1008.
+	// Streamed messages and compressed messages with manual decompression bypass the interceptor.
+	// The payload is only valid during the call.
+	ReadInterceptor func(opcode Opcode, payload []byte) ([]byte, error)
+
+	// 是否延迟拼接分片消息, 默认为 false
+	// 开启后分片消息的各个帧保留在各自的缓冲区中, Message.Data 为 nil, 通过 Message.Read 依次读取各个分片, 省去拼接大消息时的复制.
+	// Message.Bytes 和 Message.Bind 会先把分片合并到 Message.Data. 单帧消息, 压缩消息, 使用自定义扩展的消息,
+	// 设置了 ReadInterceptor 以及需要检查文本编码的消息依赖完整的负载, 仍然按照原来的方式拼接.
+	// Whether fragmented messages are reassembled lazily, defaults to false.
+	// When enabled, the frames of a fragmented message stay in their own buffers and Message.Data is nil;
+	// Message.Read walks the fragments in order, which saves the copy when reassembling large messages.
+	// Message.Bytes and Message.Bind merge the fragments into Message.Data first.
+	// Single-frame messages, compressed messages, messages using custom extensions, and messages that need
+	// the full payload for ReadInterceptor or the text encoding check are still reassembled as before.
+	LazyReassembly bool
+
+	// 帧观察回调, 默认为 nil
+	// 在读协程中, 对收到的每一个物理帧(包括控制帧和延续帧)在解析帧头之后, 校验, 拼接和解压之前调用, 只用于观察, 例如调试互通问题.
+	// payloadLen 是帧头中声明的负载长度. 回调不能修改连接的读状态, 应当尽快返回.
+	// Frame observer, defaults to nil.
+	// It is called on the read goroutine for every physical frame received, including control and continuation frames,
+	// right after the frame header is parsed and before validation, reassembly and decompression.
+	// It is for observation only, e.g. to diagnose interop issues. payloadLen is the payload length declared in the header.
+	// The callback must not change the read state of the connection and should return quickly.
+	OnFrame func(socket *Conn, fin bool, rsv1 bool, opcode Opcode, payloadLen int)
+
 	// 日志记录器
 	// Logger
 	Logger Logger
 
-	// 恢复函数
-	// Recovery function
+	// 是否恢复事件回调(OnOpen, OnClose, OnPing, OnPong, OnMessage, OnStream)中的 panic, 为空时默认为 true
+	// 回调发生 panic 时(OnClose 除外)先以 1011 状态码关闭连接, OnClose 收到 ErrHandlerPanic, 然后交给 Recovery 记录日志.
+	// 设置为 false 时不做恢复, panic 会继续传播, 除非 Recovery 自己调用了 recover.
+	// Whether panics in event callbacks (OnOpen, OnClose, OnPing, OnPong, OnMessage, OnStream) are recovered,
+	// nil means true.
+	// When a callback other than OnClose panics, the connection is first closed with status code 1011 and OnClose
+	// receives ErrHandlerPanic, then the panic is handed to Recovery for logging.
+	// If it is set to false, panics keep propagating unless Recovery calls recover itself.
+	RecoverHandlerPanics *bool
+
+	// 恢复函数, 用于记录事件回调中的 panic, 默认为 gws.Recovery, 即通过 Logger 打印 panic 和调用栈
+	// 开启 RecoverHandlerPanics 时, 即使恢复函数没有调用 recover, panic 也会被恢复.
+	// Recovery function that logs panics in event callbacks,
+	// defaults to gws.Recovery, which prints the panic and the stack trace through Logger.
+	// With RecoverHandlerPanics enabled, the panic is recovered even if the function does not call recover.
 	Recovery func(logger Logger)
 
 	// 连接地址, 例如 wss://example.com/connect
@@ -399,6 +1041,14 @@ type ClientOption struct {
 	// Extra request headers
 	RequestHeader http.Header
 
+	// 是否通过 Sec-WebSocket-MaxPayload 请求头告知服务端 ReadMaxPayloadSize, 默认为 false
+	// 开启后同时读取服务端在同名响应头中声明的上限, 参见 Conn.PeerMaxPayloadSize. 这不是标准的协议扩展, 只适用于双方都遵守该约定的私有协议.
+	// Whether ReadMaxPayloadSize is advertised to the server in the Sec-WebSocket-MaxPayload request header, defaults to false.
+	// When enabled, the limit advertised by the server in the response header of the same name is read as well,
+	// see Conn.PeerMaxPayloadSize. This is not a standard extension, it is only meant for private protocols
+	// where both sides honor the advertised value.
+	AdvertiseMaxPayload bool
+
 	// 握手超时时间
 	// Handshake timeout duration
 	HandshakeTimeout time.Duration
@@ -431,6 +1081,9 @@ func initClientOption(c *ClientOption) *ClientOption {
 	if c.ReadMaxPayloadSize <= 0 {
 		c.ReadMaxPayloadSize = defaultReadMaxPayloadSize
 	}
+	if c.ReadMaxFrameSize <= 0 {
+		c.ReadMaxFrameSize = c.ReadMaxPayloadSize
+	}
 	if c.ParallelGolimit <= 0 {
 		c.ParallelGolimit = defaultParallelGolimit
 	}
@@ -446,6 +1099,12 @@ func initClientOption(c *ClientOption) *ClientOption {
 	if c.HandshakeTimeout <= 0 {
 		c.HandshakeTimeout = defaultHandshakeTimeout
 	}
+	if c.PingTimeout <= 0 {
+		c.PingTimeout = c.PingInterval
+	}
+	if c.CloseTimeout <= 0 {
+		c.CloseTimeout = defaultCloseTimeout
+	}
 	if c.RequestHeader == nil {
 		c.RequestHeader = http.Header{}
 	}
@@ -458,9 +1117,6 @@ func initClientOption(c *ClientOption) *ClientOption {
 	if c.Logger == nil {
 		c.Logger = defaultLogger
 	}
-	if c.Recovery == nil {
-		c.Recovery = func(logger Logger) {}
-	}
 	if c.PermessageDeflate.Enabled {
 		if c.PermessageDeflate.ServerMaxWindowBits < 8 || c.PermessageDeflate.ServerMaxWindowBits > 15 {
 			c.PermessageDeflate.ServerMaxWindowBits = 15
@@ -483,15 +1139,35 @@ func initClientOption(c *ClientOption) *ClientOption {
 // Converts the ClientOption configuration to Config and returns it
 func (c *ClientOption) getConfig() *Config {
 	config := &Config{
-		ParallelEnabled:     c.ParallelEnabled,
-		ParallelGolimit:     c.ParallelGolimit,
-		ReadMaxPayloadSize:  c.ReadMaxPayloadSize,
-		ReadBufferSize:      c.ReadBufferSize,
-		WriteMaxPayloadSize: c.WriteMaxPayloadSize,
-		WriteBufferSize:     c.WriteBufferSize,
-		CheckUtf8Enabled:    c.CheckUtf8Enabled,
-		Recovery:            c.Recovery,
-		Logger:              c.Logger,
+		ParallelEnabled:         c.ParallelEnabled,
+		PullMode:                c.PullMode,
+		ParallelGolimit:         c.ParallelGolimit,
+		ReadMaxPayloadSize:      c.ReadMaxPayloadSize,
+		ReadMaxFrameSize:        c.ReadMaxFrameSize,
+		ReadMaxFragments:        c.ReadMaxFragments,
+		ReadBufferSize:          c.ReadBufferSize,
+		WriteMaxPayloadSize:     c.WriteMaxPayloadSize,
+		WriteBufferSize:         c.WriteBufferSize,
+		CheckUtf8Enabled:        c.CheckUtf8Enabled,
+		PingInterval:            c.PingInterval,
+		PingTimeout:             c.PingTimeout,
+		ReadTimeout:             c.ReadTimeout,
+		WriteQueueCapacity:      c.WriteQueueCapacity,
+		QueueFullPolicy:         c.QueueFullPolicy,
+		CloseTimeout:            c.CloseTimeout,
+		WriteRateLimit:          c.WriteRateLimit,
+		WriteBatchSize:          c.WriteBatchSize,
+		KeepOpenOnRejectedWrite: c.KeepOpenOnRejectedWrite,
+		WriteInterceptor:        c.WriteInterceptor,
+		StreamReadEnabled:       c.StreamReadEnabled,
+		ManualDecompression:     c.ManualDecompression,
+		OnDecompressError:       c.OnDecompressError,
+		ReadInterceptor:         c.ReadInterceptor,
+		LazyReassembly:          c.LazyReassembly,
+		OnFrame:                 c.OnFrame,
+		RecoverHandlerPanics:    c.RecoverHandlerPanics == nil || *c.RecoverHandlerPanics,
+		Recovery:                newRecovery(c.RecoverHandlerPanics == nil || *c.RecoverHandlerPanics, c.Recovery),
+		Logger:                  c.Logger,
 	}
 	return config
 }
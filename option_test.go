@@ -15,6 +15,8 @@ func validateServerOption(as *assert.Assertions, u *Upgrader) {
 	as.Equal(config.ParallelEnabled, option.ParallelEnabled)
 	as.Equal(config.ParallelGolimit, option.ParallelGolimit)
 	as.Equal(config.ReadMaxPayloadSize, option.ReadMaxPayloadSize)
+	as.Equal(config.ReadMaxFrameSize, option.ReadMaxFrameSize)
+	as.Equal(config.ReadMaxFragments, option.ReadMaxFragments)
 	as.Equal(config.WriteMaxPayloadSize, option.WriteMaxPayloadSize)
 	as.Equal(config.CheckUtf8Enabled, option.CheckUtf8Enabled)
 	as.Equal(config.ReadBufferSize, option.ReadBufferSize)
@@ -32,6 +34,8 @@ func validateClientOption(as *assert.Assertions, option *ClientOption) {
 	as.Equal(config.ParallelEnabled, option.ParallelEnabled)
 	as.Equal(config.ParallelGolimit, option.ParallelGolimit)
 	as.Equal(config.ReadMaxPayloadSize, option.ReadMaxPayloadSize)
+	as.Equal(config.ReadMaxFrameSize, option.ReadMaxFrameSize)
+	as.Equal(config.ReadMaxFragments, option.ReadMaxFragments)
 	as.Equal(config.WriteMaxPayloadSize, option.WriteMaxPayloadSize)
 	as.Equal(config.CheckUtf8Enabled, option.CheckUtf8Enabled)
 	as.Equal(config.ReadBufferSize, option.ReadBufferSize)
@@ -60,6 +64,7 @@ func TestDefaultUpgrader(t *testing.T) {
 	as.Equal(false, config.CheckUtf8Enabled)
 	as.Equal(defaultParallelGolimit, config.ParallelGolimit)
 	as.Equal(defaultReadMaxPayloadSize, config.ReadMaxPayloadSize)
+	as.Equal(defaultReadMaxPayloadSize, config.ReadMaxFrameSize)
 	as.Equal(defaultWriteMaxPayloadSize, config.WriteMaxPayloadSize)
 	as.Equal(defaultHandshakeTimeout, updrader.option.HandshakeTimeout)
 	as.NotNil(updrader.eventHandler)
@@ -153,6 +158,7 @@ func TestDefaultClientOption(t *testing.T) {
 	as.Equal(false, config.CheckUtf8Enabled)
 	as.Equal(defaultParallelGolimit, config.ParallelGolimit)
 	as.Equal(defaultReadMaxPayloadSize, config.ReadMaxPayloadSize)
+	as.Equal(defaultReadMaxPayloadSize, config.ReadMaxFrameSize)
 	as.Equal(defaultWriteMaxPayloadSize, config.WriteMaxPayloadSize)
 	as.NotNil(config)
 	as.Equal(0, len(option.RequestHeader))
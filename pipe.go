@@ -0,0 +1,54 @@
+package gws
+
+import (
+	"net"
+	"net/http"
+)
+
+// NewPipeConns 通过内存管道 net.Pipe 创建一对已完成握手的服务端和客户端连接, 不需要监听真实的网络端口
+// 握手与真实连接相同, 压缩和子协议等按照升级器与客户端配置协商. 常用于测试, 调用方需要分别调用两端的 ReadLoop.
+// 客户端配置未设置 Addr 时使用 ws://127.0.0.1/.
+// Creates a pair of handshaked server-side and client-side connections over an in-memory net.Pipe,
+// without listening on a real network port. The handshake is the same as on a real connection,
+// compression, sub-protocols and so on are negotiated from the upgrader and client options.
+// It is mostly useful for testing, the caller must call ReadLoop on both ends.
+// If Addr is not set in the client option, ws://127.0.0.1/ is used.
+func NewPipeConns(upgrader *Upgrader, clientHandler Event, clientOption *ClientOption) (server, client *Conn, err error) {
+	if clientOption == nil {
+		clientOption = new(ClientOption)
+	}
+	if clientOption.Addr == "" {
+		clientOption.Addr = "ws://127.0.0.1/"
+	}
+
+	type result struct {
+		socket *Conn
+		err    error
+	}
+	var s, c = net.Pipe()
+	var ch = make(chan result, 1)
+	go func() {
+		br := upgrader.option.config.brPool.Get()
+		br.Reset(s)
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			_ = s.Close()
+			ch <- result{err: err}
+			return
+		}
+		socket, err := upgrader.UpgradeFromConn(s, br, r)
+		ch <- result{socket: socket, err: err}
+	}()
+
+	client, _, err = NewClientFromConn(clientHandler, clientOption, c)
+	var res = <-ch
+	if err == nil {
+		err = res.err
+	}
+	if err != nil {
+		_ = s.Close()
+		_ = c.Close()
+		return nil, nil, err
+	}
+	return res.socket, client, nil
+}
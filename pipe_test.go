@@ -0,0 +1,54 @@
+package gws
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPipeConns(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = &webSocketMocker{}
+		var clientHandler = &webSocketMocker{}
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		}
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			assert.Equal(t, "hello", message.Data.String())
+			wg.Done()
+		}
+
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{
+			PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+			SubProtocols:      []string{"chat"},
+		})
+		server, client, err := NewPipeConns(upgrader, clientHandler, &ClientOption{
+			PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+			RequestHeader:     http.Header{"Sec-Websocket-Protocol": []string{"chat"}},
+		})
+		assert.NoError(t, err)
+		assert.True(t, server.CompressionEnabled())
+		assert.True(t, client.CompressionEnabled())
+		assert.Equal(t, "chat", server.SubProtocol())
+		assert.Equal(t, "chat", client.SubProtocol())
+
+		go server.ReadLoop()
+		go client.ReadLoop()
+		assert.NoError(t, client.WriteString("hello"))
+		wg.Wait()
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			Authorize: func(r *http.Request, session SessionStorage) bool { return false },
+		})
+		server, client, err := NewPipeConns(upgrader, new(BuiltinEventHandler), nil)
+		assert.Error(t, err)
+		assert.Nil(t, server)
+		assert.Nil(t, client)
+	})
+}
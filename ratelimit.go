@@ -0,0 +1,91 @@
+package gws
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// 等待令牌会超过写截止时间, 可以通过 errors.Is(err, os.ErrDeadlineExceeded) 判断
+// Waiting for tokens would exceed the write deadline, it matches errors.Is(err, os.ErrDeadlineExceeded)
+var errRateLimitDeadline = fmt.Errorf("gws: rate limit: %w", os.ErrDeadlineExceeded)
+
+// 令牌桶限速器, 每个令牌代表一个字节, 桶容量为一秒的令牌数
+// Token bucket rate limiter, each token stands for one byte and the bucket holds one second worth of tokens
+type rateLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	tokens   float64
+	last     time.Time
+	deadline time.Time
+}
+
+// 创建限速器, rate <= 0 时返回 nil, 表示不限速
+// Creates a rate limiter, returns nil if rate <= 0, which means unlimited
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// 设置写截止时间, 等待令牌的时间不会超过它
+// Sets the write deadline, waiting for tokens never goes beyond it
+func (c *rateLimiter) setDeadline(t time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+}
+
+// 取出 n 个令牌, 令牌不足时阻塞直到补充完毕
+// 超过一秒令牌数的消息允许透支, 由之后的写入偿还. 等待会超过写截止时间时返回错误, 且不消耗令牌.
+// Takes n tokens and blocks until they are refilled if there are not enough.
+// Messages larger than one second worth of tokens may overdraw the bucket, later writes pay it back.
+// If waiting would exceed the write deadline, an error is returned and no tokens are taken.
+func (c *rateLimiter) wait(n int) error {
+	return c.waitContext(context.Background(), n)
+}
+
+// 类似 wait, ctx 结束时停止等待, 归还令牌并返回 ctx.Err()
+// Like wait, but stops waiting once ctx is done, returns the tokens and ctx.Err()
+func (c *rateLimiter) waitContext(ctx context.Context, n int) error {
+	if c == nil || n <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	var now = time.Now()
+	c.tokens = math.Min(c.rate, c.tokens+now.Sub(c.last).Seconds()*c.rate)
+	c.last = now
+	c.tokens -= float64(n)
+	var delay time.Duration
+	if c.tokens < 0 {
+		delay = time.Duration(-c.tokens / c.rate * float64(time.Second))
+	}
+	if delay > 0 && !c.deadline.IsZero() && now.Add(delay).After(c.deadline) {
+		c.tokens += float64(n)
+		c.mu.Unlock()
+		return errRateLimitDeadline
+	}
+	c.mu.Unlock()
+
+	if delay > 0 {
+		var timer = time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.tokens += float64(n)
+			c.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package gws
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("unlimited", func(t *testing.T) {
+		var limiter = newRateLimiter(0)
+		as.Nil(limiter)
+		limiter.setDeadline(time.Now())
+		as.NoError(limiter.wait(1024))
+	})
+
+	t.Run("burst", func(t *testing.T) {
+		var limiter = newRateLimiter(1000)
+		var t0 = time.Now()
+		as.NoError(limiter.wait(600))
+		as.NoError(limiter.wait(400))
+		as.Less(time.Since(t0), 50*time.Millisecond)
+
+		as.NoError(limiter.wait(100))
+		as.GreaterOrEqual(time.Since(t0), 80*time.Millisecond)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		var limiter = newRateLimiter(1000)
+		as.NoError(limiter.wait(1000))
+		limiter.setDeadline(time.Now().Add(100 * time.Millisecond))
+		as.True(errors.Is(limiter.wait(500), os.ErrDeadlineExceeded))
+		as.NoError(limiter.wait(50))
+	})
+}
+
+func TestConn_WriteRateLimit(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var received = make(chan int, 16)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		received <- message.Data.Len()
+	}
+	var pinged = make(chan struct{}, 1)
+	clientHandler.onPing = func(socket *Conn, payload []byte) {
+		pinged <- struct{}{}
+	}
+	server, client := newPeer(serverHandler, &ServerOption{WriteRateLimit: 5000}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var t0 = time.Now()
+	var payload = make([]byte, 500)
+	for i := 0; i < 15; i++ {
+		as.NoError(server.WriteMessage(OpcodeBinary, payload))
+	}
+	for i := 0; i < 15; i++ {
+		as.Equal(500, <-received)
+	}
+	as.GreaterOrEqual(time.Since(t0), 400*time.Millisecond)
+
+	// 令牌已经耗尽, 控制帧不受影响
+	// The bucket is drained, control frames are not affected
+	var t1 = time.Now()
+	as.NoError(server.WritePing(nil))
+	<-pinged
+	as.Less(time.Since(t1), 50*time.Millisecond)
+	_ = server.WriteClose(1000, nil)
+}
+
+func TestConn_WriteFragmentsRateLimit(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var received = make(chan int, 16)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		received <- message.Data.Len()
+	}
+	var pinged = make(chan struct{}, 1)
+	clientHandler.onPing = func(socket *Conn, payload []byte) {
+		pinged <- struct{}{}
+	}
+	server, client := newPeer(serverHandler, &ServerOption{WriteRateLimit: 5000}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var done = make(chan error, 1)
+	go func() { done <- server.WriteFragments(OpcodeBinary, 500, bytes.NewReader(make([]byte, 7500))) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// 分片写入等待令牌期间, 控制帧不被阻塞, 数据帧排在分片消息之后
+	// While the fragmented write waits for tokens, control frames are not blocked
+	// and data frames are queued after the fragmented message
+	var t0 = time.Now()
+	go func() { _ = server.WriteMessage(OpcodeBinary, make([]byte, 10)) }()
+	as.NoError(server.WritePing(nil))
+	<-pinged
+	as.Less(time.Since(t0), 50*time.Millisecond)
+
+	as.NoError(<-done)
+	as.Equal(7500, <-received)
+	as.Equal(10, <-received)
+	_ = server.WriteClose(1000, nil)
+}
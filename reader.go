@@ -2,7 +2,12 @@ package gws
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/lxzan/gws/internal"
@@ -47,14 +52,16 @@ func (c *Conn) readControl() error {
 			internal.MaskXOR(payload, c.fh.GetMaskKey())
 		}
 	}
+	c.statsRead(0, c.fh.length()+int(n))
 
 	var opcode = c.fh.GetOpcode()
 	switch opcode {
 	case OpcodePing:
-		c.handler.OnPing(c, payload)
+		c.dispatchControl(opcode, payload)
 		return nil
 	case OpcodePong:
-		c.handler.OnPong(c, payload)
+		atomic.StoreUint32(&c.ponged, 1)
+		c.dispatchControl(opcode, payload)
 		return nil
 	case OpcodeCloseConnection:
 		return c.emitClose(bytes.NewBuffer(payload))
@@ -64,17 +71,44 @@ func (c *Conn) readControl() error {
 	}
 }
 
-// 读取消息
-// Reads a message
-func (c *Conn) readMessage() error {
+// 由 ReadTimeout 引起的超时视为连接空闲, 以 1001 状态码关闭
+// A timeout caused by ReadTimeout means the connection is idle, it is closed with status code 1001
+func (c *Conn) checkReadTimeout(err error) error {
+	var netErr net.Error
+	if c.config.ReadTimeout > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		return internal.NewError(internal.CloseGoingAway, ErrReadTimeout)
+	}
+	return err
+}
+
+// 设置了 ReadTimeout 时重置读截止时间. 连接开始关闭之后不再重置, 以保留等待对端回复关闭帧的截止时间
+// Resets the read deadline if ReadTimeout is set. It is no longer reset once the connection starts closing,
+// so that the deadline for the close frame of the peer is kept.
+func (c *Conn) resetReadDeadline() error {
+	if c.config.ReadTimeout <= 0 || c.IsClosed() {
+		return nil
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+}
+
+// 读取并校验帧头, 返回内容长度
+// Reads and validates the frame header, returns the content length
+func (c *Conn) readFrameHeader() (int, error) {
+	if err := c.resetReadDeadline(); err != nil {
+		return 0, err
+	}
+
 	// 解析帧头并获取内容长度
 	// Parse the frame header and get the content length
 	contentLength, err := c.fh.Parse(c.br)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if contentLength > c.config.ReadMaxPayloadSize {
-		return internal.CloseMessageTooLarge
+	if c.config.OnFrame != nil {
+		c.dispatchFrame(contentLength)
+	}
+	if contentLength > c.config.ReadMaxPayloadSize || contentLength > c.config.ReadMaxFrameSize {
+		return 0, internal.CloseMessageTooLarge
 	}
 
 	// RSV1, RSV2, RSV3: 每个占 1 位
@@ -84,20 +118,68 @@ func (c *Conn) readMessage() error {
 	// MUST be 0 unless an extension is negotiated that defines meanings for non-zero values.
 	// If a nonzero value is received and none of the negotiated extensions defines the meaning of such a nonzero value,
 	// the receiving endpoint MUST _Fail the WebSocket Connection_.
-	if !c.pd.Enabled && (c.fh.GetRSV1() || c.fh.GetRSV2() || c.fh.GetRSV3()) {
-		return internal.CloseProtocolError
+	// permessage-deflate 只定义了 RSV1, 且只能出现在数据消息的第一帧.
+	// permessage-deflate only defines RSV1, and only on the first frame of a data message.
+	// RSV2 和 RSV3 只能由协商启用的自定义扩展使用, 同样只能出现在数据消息的第一帧.
+	// RSV2 and RSV3 may only be used by negotiated custom extensions, also only on the first frame of a data message.
+	if rsv := c.fh.getExtensionRSV(); rsv != 0 {
+		if rsv&c.extensionRSV() != rsv || !c.fh.GetOpcode().isDataFrame() || c.fh.GetOpcode() == OpcodeContinuation {
+			return 0, internal.CloseProtocolError
+		}
+	}
+	if c.fh.GetRSV1() && (!c.pd.Enabled || !c.fh.GetOpcode().isDataFrame() || c.fh.GetOpcode() == OpcodeContinuation) {
+		return 0, internal.CloseProtocolError
+	}
+	if err := c.checkMask(c.fh.GetMask()); err != nil {
+		return 0, err
+	}
+	return contentLength, nil
+}
+
+// 读取负载, 设置了 ReadTimeout 时每次读取之前重置读截止时间, 只要数据持续到达就不会超时
+// Reads the payload. With ReadTimeout set, the read deadline is reset before every read,
+// so it does not expire as long as data keeps arriving.
+func (c *Conn) readPayload(p []byte) error {
+	if c.config.ReadTimeout <= 0 {
+		return internal.ReadN(c.br, p)
 	}
+	for len(p) > 0 {
+		if err := c.resetReadDeadline(); err != nil {
+			return err
+		}
+		n, err := c.br.Read(p)
+		p = p[n:]
+		if err == io.EOF && len(p) > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	maskEnabled := c.fh.GetMask()
-	if err := c.checkMask(maskEnabled); err != nil {
+// 读取消息
+// Reads a message
+func (c *Conn) readMessage() error {
+	contentLength, err := c.readFrameHeader()
+	if err != nil {
 		return err
 	}
 
+	var maskEnabled = c.fh.GetMask()
 	var opcode = c.fh.GetOpcode()
 	var compressed = c.pd.Enabled && c.fh.GetRSV1()
+	var rsv = c.fh.getExtensionRSV()
 	if !opcode.isDataFrame() {
 		return c.readControl()
 	}
+	if opcode != OpcodeContinuation && c.headerHandler != nil && !c.headerHandler.OnMessageHeader(c, opcode, contentLength) {
+		return internal.CloseMessageTooLarge
+	}
+	if rsv == 0 && c.streamEnabled(opcode, compressed) {
+		return c.readStream(opcode, contentLength, compressed)
+	}
 
 	var fin = c.fh.GetFIN()
 	var buf = binaryPool.Get(contentLength + len(flateTail))
@@ -105,9 +187,10 @@ func (c *Conn) readMessage() error {
 	var closer = Message{Data: buf}
 	defer closer.Close()
 
-	if err := internal.ReadN(c.br, p); err != nil {
+	if err := c.readPayload(p); err != nil {
 		return err
 	}
+	c.statsRead(0, c.fh.length()+contentLength)
 	if maskEnabled {
 		internal.MaskXOR(p, c.fh.GetMaskKey())
 	}
@@ -118,10 +201,10 @@ func (c *Conn) readMessage() error {
 
 	if fin && opcode != OpcodeContinuation {
 		*(*[]byte)(unsafe.Pointer(buf)) = p
-		if !compressed {
+		if !compressed || c.config.ManualDecompression {
 			closer.Data = nil
 		}
-		return c.emitMessage(&Message{Opcode: opcode, Data: buf, compressed: compressed})
+		return c.emitMessage(&Message{Opcode: opcode, Data: buf, compressed: compressed, rsv: rsv})
 	}
 
 	// 处理分片消息
@@ -129,49 +212,204 @@ func (c *Conn) readMessage() error {
 	if !fin && opcode != OpcodeContinuation {
 		c.continuationFrame.initialized = true
 		c.continuationFrame.compressed = compressed
+		c.continuationFrame.rsv = rsv
 		c.continuationFrame.opcode = opcode
-		c.continuationFrame.buffer = bytes.NewBuffer(make([]byte, 0, contentLength))
+		if c.lazyReassemblyEnabled(opcode, compressed, rsv) {
+			c.continuationFrame.fragments = make([]*bytes.Buffer, 0, 8)
+		} else {
+			c.continuationFrame.buffer = bytes.NewBuffer(make([]byte, 0, contentLength))
+		}
 	}
 	if !c.continuationFrame.initialized {
 		return internal.CloseProtocolError
 	}
 
-	c.continuationFrame.buffer.Write(p)
-	if c.continuationFrame.buffer.Len() > c.config.ReadMaxPayloadSize {
+	if c.continuationFrame.fragments != nil {
+		// 缓冲区的所有权转移给分片列表, 不再由 closer 回收
+		// The buffer is handed over to the fragment list and no longer recycled by closer
+		*(*[]byte)(unsafe.Pointer(buf)) = p
+		closer.Data = nil
+		c.continuationFrame.fragments = append(c.continuationFrame.fragments, buf)
+	} else {
+		c.continuationFrame.buffer.Write(p)
+	}
+	c.continuationFrame.size += contentLength
+	c.continuationFrame.frames++
+	if c.continuationFrame.size > c.config.ReadMaxPayloadSize {
 		return internal.CloseMessageTooLarge
 	}
+	if err := c.checkFragments(c.continuationFrame.frames); err != nil {
+		return err
+	}
 	if !fin {
 		return nil
 	}
 
-	msg := &Message{Opcode: c.continuationFrame.opcode, Data: c.continuationFrame.buffer, compressed: c.continuationFrame.compressed}
+	msg := &Message{
+		Opcode:     c.continuationFrame.opcode,
+		Data:       c.continuationFrame.buffer,
+		fragments:  c.continuationFrame.fragments,
+		compressed: c.continuationFrame.compressed,
+		rsv:        c.continuationFrame.rsv,
+	}
 	c.continuationFrame.reset()
+	if msg.fragments != nil {
+		c.statsRead(1, 0)
+		return c.dispatchMessage(msg)
+	}
 	return c.emitMessage(msg)
 }
 
+// 检查消息的帧数是否超过 ReadMaxFragments
+// Checks whether the number of frames of a message exceeds ReadMaxFragments
+func (c *Conn) checkFragments(frames int) error {
+	if c.config.ReadMaxFragments > 0 && frames > c.config.ReadMaxFragments {
+		return internal.CloseMessageTooLarge
+	}
+	return nil
+}
+
+// 分片消息是否可以延迟拼接, 需要完整负载的处理(解压, 扩展, 读取拦截器, 文本编码检查)都会关闭延迟拼接
+// Reports whether a fragmented message can be reassembled lazily. Any processing that needs the full payload
+// (decompression, extensions, the read interceptor, the text encoding check) disables it.
+func (c *Conn) lazyReassemblyEnabled(opcode Opcode, compressed bool, rsv RSVBit) bool {
+	return c.config.LazyReassembly &&
+		!compressed &&
+		rsv == 0 &&
+		c.config.ReadInterceptor == nil &&
+		!(opcode == OpcodeText && c.config.CheckUtf8Enabled)
+}
+
 // 分发消息和异常恢复
 // Dispatch message & Recovery
 func (c *Conn) dispatch(msg *Message) error {
+	var done = false
 	defer c.config.Recovery(c.config.Logger)
+	defer c.closeOnPanic(&done)
 	c.handler.OnMessage(c, msg)
+	done = true
 	return nil
 }
 
+// 分发 Ping 和 Pong 事件和异常恢复
+// Dispatch ping & pong events & Recovery
+func (c *Conn) dispatchControl(opcode Opcode, payload []byte) {
+	var done = false
+	defer c.config.Recovery(c.config.Logger)
+	defer c.closeOnPanic(&done)
+	if opcode == OpcodePing {
+		c.handler.OnPing(c, payload)
+	} else {
+		c.handler.OnPong(c, payload)
+	}
+	done = true
+}
+
+// 调用帧观察回调
+// Calls the frame observer
+func (c *Conn) dispatchFrame(payloadLen int) {
+	var done = false
+	defer c.config.Recovery(c.config.Logger)
+	defer c.closeOnPanic(&done)
+	c.config.OnFrame(c, c.fh.GetFIN(), c.fh.GetRSV1(), c.fh.GetOpcode(), payloadLen)
+	done = true
+}
+
+// 事件回调没有正常返回(发生了 panic)时以 1011 状态码关闭连接, OnClose 收到 ErrHandlerPanic.
+// 必须在 Recovery 之后 defer, 这样它会在 panic 被恢复之前执行.
+// Closes the connection with status code 1011 if the event callback did not return normally (it panicked),
+// OnClose receives ErrHandlerPanic. It must be deferred after Recovery so that it runs before the panic is recovered.
+func (c *Conn) closeOnPanic(done *bool) {
+	if !*done {
+		c.emitError(true, internal.NewError(internal.CloseInternalErr, ErrHandlerPanic))
+	}
+}
+
 // 发射消息事件
 // Emit onmessage event
 func (c *Conn) emitMessage(msg *Message) (err error) {
-	if msg.compressed {
-		msg.Data, err = c.deflater.Decompress(msg.Data, c.dpsWindow.dict)
+	if msg.compressed && c.config.ManualDecompression {
+		c.statsRead(1, 0)
+		return c.dispatchMessage(msg)
+	}
+	if msg.compressed && msg.Data.Len() == 0 {
+		// 空的压缩负载不是有效的 deflate 数据, 视为空消息. 原缓冲区由读取方回收, 这里换成新的缓冲区
+		// An empty compressed payload is not valid deflate data, it is treated as an empty message.
+		// The original buffer is recycled by the reader, so it is replaced with a new one here.
+		msg.Data = binaryPool.Get(0)
+	} else if msg.compressed {
+		msg.Data, err = c.getDecompressor().Decompress(msg.Data, c.decompressDict())
 		if err != nil {
-			return internal.NewError(internal.CloseInternalErr, err)
+			return c.checkDecompressError(err)
+		}
+		// 自定义解压器不限制输出长度, 在这里兜底检查
+		// Custom decompressors do not limit their output, so it is checked here
+		if msg.Data.Len() > c.config.ReadMaxPayloadSize {
+			return internal.CloseMessageTooLarge
+		}
+		_, _ = c.dpsWindow.Write(msg.Data.Bytes())
+	}
+	if msg.rsv != 0 {
+		if err := c.decodeExtensions(msg); err != nil {
+			return err
 		}
-		_, _ = c.dpsWindow.Write(msg.Bytes())
 	}
-	if !internal.CheckEncoding(c.config.CheckUtf8Enabled, uint8(msg.Opcode), msg.Bytes()) {
+	if c.config.ReadInterceptor != nil {
+		p, err := c.config.ReadInterceptor(msg.Opcode, msg.Data.Bytes())
+		if err != nil {
+			return internal.NewError(internal.ClosePolicyViolation, err)
+		}
+		// Write 使用 copy, p 引用原缓冲区时也是安全的
+		// Write uses copy, which is safe even if p refers to the original buffer
+		msg.Data.Reset()
+		msg.Data.Write(p)
+	}
+	if !internal.CheckEncoding(c.config.CheckUtf8Enabled, uint8(msg.Opcode), msg.Data.Bytes()) {
 		return internal.NewError(internal.CloseUnsupportedData, ErrTextEncoding)
 	}
+	msg.compressed = false
+	c.statsRead(1, 0)
+	return c.dispatchMessage(msg)
+}
+
+// 解压失败时, 由 OnDecompressError 决定是关闭连接还是丢弃该消息
+// On decompression failure, OnDecompressError decides whether to close the connection or discard the message
+func (c *Conn) checkDecompressError(err error) error {
+	if c.config.OnDecompressError != nil && !c.config.OnDecompressError(c, err) {
+		return nil
+	}
+	return internal.NewError(internal.CloseInternalErr, err)
+}
+
+// 按照并行配置分发消息
+// Dispatches the message according to the parallel configuration
+func (c *Conn) dispatchMessage(msg *Message) error {
+	if c.IsClosed() {
+		// 本端已经发送关闭帧, 等待对端回复期间收到的消息被丢弃
+		// This side has sent the close frame, messages received while awaiting the reply of the peer are discarded
+		_ = msg.Close()
+		return nil
+	}
+	if c.config.PullMode {
+		// 连接开始关闭之后应用可能不再拉取消息, 此时丢弃消息, 以便读协程继续读取对端的关闭帧
+		// Once the connection starts closing the application may stop pulling, the message is dropped then
+		// so that the read goroutine goes on to read the close frame of the peer
+		select {
+		case c.getPullQueue() <- msg:
+		case <-c.getClosing():
+			_ = msg.Close()
+		}
+		return nil
+	}
 	if c.config.ParallelEnabled {
-		return c.readQueue.Go(msg, c.dispatch)
+		return c.readQueue.Go(msg, c.dispatchParallel)
 	}
 	return c.dispatch(msg)
 }
+
+// 在读取队列中分发消息并计数
+// Dispatches the message in the read queue and counts it
+func (c *Conn) dispatchParallel(msg *Message) error {
+	defer atomic.AddInt64(&c.readCounter.processed, 1)
+	return c.dispatch(msg)
+}
@@ -2,14 +2,23 @@ package gws
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
+	"math"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/flate"
 	"github.com/lxzan/gws/internal"
 	"github.com/stretchr/testify/assert"
 )
@@ -308,6 +317,29 @@ func TestMessage(t *testing.T) {
 	}
 	_, _ = msg.Read(make([]byte, 2))
 	msg.Close()
+
+	t.Run("bytes", func(t *testing.T) {
+		var as = assert.New(t)
+		var buf = binaryPool.Get(16)
+		buf.WriteString("hello")
+		var msg = &Message{Opcode: OpcodeText, Data: buf}
+		var p = msg.Bytes()
+		as.Equal("hello", string(p))
+		buf.Bytes()[0] = 'j'
+		as.Equal("hello", string(p))
+		as.NoError(msg.Close())
+		as.Equal("hello", string(p))
+	})
+
+	t.Run("len", func(t *testing.T) {
+		var as = assert.New(t)
+		var buf = binaryPool.Get(16)
+		buf.WriteString("hello")
+		var msg = &Message{Opcode: OpcodeText, Data: buf}
+		as.Equal(5, msg.Len())
+		as.NoError(msg.Close())
+		as.Equal(0, msg.Len())
+	})
 }
 
 func TestFrameHeader_Parse(t *testing.T) {
@@ -365,6 +397,61 @@ func TestFrameHeader_Parse(t *testing.T) {
 	})
 }
 
+func FuzzFrameHeaderParse(f *testing.F) {
+	var seed = func(isServer bool, length int) []byte {
+		var fh = frameHeader{}
+		var n, _ = fh.GenerateHeader(isServer, true, false, OpcodeBinary, length)
+		return fh[:n]
+	}
+	for _, length := range []int{
+		0, 125, 126, 127, math.MaxUint16, math.MaxUint16 + 1, 1<<31 - 1,
+	} {
+		var header = seed(true, length)
+		f.Add(header)
+		f.Add(seed(false, length))
+		for i := 1; i < len(header); i++ {
+			f.Add(header[:i])
+		}
+	}
+	f.Add([]byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0x82, 127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x82, 126 | 0x80, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var fh = frameHeader{}
+		var reader = bytes.NewReader(data)
+		var n, err = fh.Parse(reader)
+		var consumed = len(data) - reader.Len()
+		if err != nil {
+			switch {
+			case len(data) == 0:
+				assert.ErrorIs(t, err, io.EOF)
+			case errors.Is(err, io.ErrUnexpectedEOF):
+				assert.Equal(t, len(data), consumed)
+				assert.True(t, consumed < 2 || consumed < fh.length())
+			default:
+				assert.Equal(t, uint8(127), fh.GetLengthCode())
+				assert.True(t, errors.Is(err, internal.CloseProtocolError) || errors.Is(err, internal.CloseMessageTooLarge))
+			}
+			return
+		}
+
+		assert.Equal(t, fh.length(), consumed)
+		assert.GreaterOrEqual(t, n, 0)
+		switch fh.GetLengthCode() {
+		case 126:
+			assert.Equal(t, int(binary.BigEndian.Uint16(data[2:4])), n)
+		case 127:
+			assert.Equal(t, binary.BigEndian.Uint64(data[2:10]), uint64(n))
+		default:
+			assert.Equal(t, int(fh.GetLengthCode()), n)
+		}
+		if fh.GetMask() {
+			assert.Equal(t, data[consumed-4:consumed], fh.GetMaskKey())
+		}
+	})
+}
+
 func TestConn_ReadMessage(t *testing.T) {
 	t.Run("", func(t *testing.T) {
 		var addr = ":" + nextPort()
@@ -426,3 +513,851 @@ func TestConn_ReadMessage(t *testing.T) {
 		client.ReadLoop()
 	})
 }
+
+func TestConn_ReadFragmentedUtf8(t *testing.T) {
+	var write = func(socket *Conn, opcode Opcode, fin bool, p []byte) {
+		frame, err := socket.genFrame(opcode, internal.Bytes(p), frameConfig{fin: fin})
+		assert.NoError(t, err)
+		_, err = socket.conn.Write(frame.Bytes())
+		assert.NoError(t, err)
+	}
+
+	t.Run("valid across boundary", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{}
+		var clientOption = &ClientOption{CheckUtf8Enabled: true}
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			assert.Equal(t, "ab中", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		write(server, OpcodeText, false, []byte("ab\xe4\xb8"))
+		write(server, OpcodeContinuation, true, []byte("\xad"))
+		wg.Wait()
+	})
+
+	t.Run("invalid across boundary", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{}
+		var clientOption = &ClientOption{CheckUtf8Enabled: true}
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			t.Error("unexpected message")
+		}
+		clientHandler.onClose = func(socket *Conn, err error) {
+			assert.ErrorIs(t, err, ErrTextEncoding)
+			wg.Done()
+		}
+		serverHandler.onClose = func(socket *Conn, err error) {
+			closeErr, ok := err.(*CloseError)
+			assert.True(t, ok)
+			if ok {
+				assert.Equal(t, internal.CloseUnsupportedData.Uint16(), closeErr.Code)
+			}
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		write(server, OpcodeText, false, []byte("ab\xe4\xb8"))
+		write(server, OpcodeContinuation, true, []byte("x"))
+		wg.Wait()
+	})
+}
+
+func TestConn_ReservedBits(t *testing.T) {
+	var as = assert.New(t)
+	var cases = []struct {
+		name      string
+		opcode    Opcode
+		flags     uint8
+		pdEnabled bool
+	}{
+		{name: "reserved data opcode", opcode: Opcode(3)},
+		{name: "reserved control opcode", opcode: Opcode(0xB)},
+		{name: "rsv2", opcode: OpcodeText, flags: 0x20},
+		{name: "rsv3", opcode: OpcodeText, flags: 0x10, pdEnabled: true},
+		{name: "rsv1 without deflate", opcode: OpcodeText, flags: 0x40},
+		{name: "rsv1 on control frame", opcode: OpcodePing, flags: 0x40, pdEnabled: true},
+	}
+
+	for _, item := range cases {
+		var item = item
+		t.Run(item.name, func(t *testing.T) {
+			var serverHandler = new(webSocketMocker)
+			var clientHandler = new(webSocketMocker)
+			var pd = PermessageDeflate{Enabled: item.pdEnabled}
+			var serverOption = &ServerOption{PermessageDeflate: pd}
+			var clientOption = &ClientOption{PermessageDeflate: pd}
+			var wg = &sync.WaitGroup{}
+			wg.Add(1)
+			serverHandler.onClose = func(socket *Conn, err error) {
+				var closeErr *CloseError
+				if as.True(errors.As(err, &closeErr)) {
+					as.Equal(internal.CloseProtocolError.Uint16(), closeErr.Code)
+				}
+				wg.Done()
+			}
+			server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+			go server.ReadLoop()
+			go client.ReadLoop()
+
+			var fh = frameHeader{}
+			var n, _ = fh.GenerateHeader(true, true, false, item.opcode, 0)
+			fh[0] |= item.flags
+			_, _ = server.conn.Write(fh[:n])
+			wg.Wait()
+		})
+	}
+}
+
+func TestConn_InvalidControlFrame(t *testing.T) {
+	var as = assert.New(t)
+	var cases = []struct {
+		name   string
+		opcode Opcode
+		fin    bool
+		length int
+	}{
+		{name: "oversized ping", opcode: OpcodePing, fin: true, length: 200},
+		{name: "fragmented ping", opcode: OpcodePing, fin: false, length: 0},
+		{name: "fragmented close", opcode: OpcodeCloseConnection, fin: false, length: 2},
+	}
+
+	for _, item := range cases {
+		var item = item
+		t.Run(item.name, func(t *testing.T) {
+			var serverHandler = new(webSocketMocker)
+			var clientHandler = new(webSocketMocker)
+			var wg = &sync.WaitGroup{}
+			wg.Add(1)
+			clientHandler.onPing = func(socket *Conn, payload []byte) {
+				t.Error("unexpected ping")
+			}
+			serverHandler.onClose = func(socket *Conn, err error) {
+				var closeErr *CloseError
+				if as.True(errors.As(err, &closeErr)) {
+					as.Equal(internal.CloseProtocolError.Uint16(), closeErr.Code)
+				}
+				wg.Done()
+			}
+			server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+			go server.ReadLoop()
+			go client.ReadLoop()
+
+			var fh = frameHeader{}
+			var n, _ = fh.GenerateHeader(true, item.fin, false, item.opcode, item.length)
+			var frame = append(fh[:n:n], make([]byte, item.length)...)
+			go func() { _, _ = server.conn.Write(frame) }()
+			wg.Wait()
+		})
+	}
+}
+
+func TestConn_MessageOrder(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	const count = 1000
+	var received = make([]int, 0, count)
+	var wg = &sync.WaitGroup{}
+	wg.Add(count)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		n, _ := strconv.Atoi(message.Data.String())
+		received = append(received, n)
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	// 多个协程并发写入, 每个协程内部有序; OnMessage 收到的顺序必须与写入连接的顺序一致
+	// Several goroutines write concurrently, each in order; OnMessage must see the order in which frames hit the wire
+	var written = make([]int, 0, count)
+	var mu = &sync.Mutex{}
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			for j := 0; j < count/10; j++ {
+				var n = i*count/10 + j
+				mu.Lock()
+				written = append(written, n)
+				_ = client.WriteString(strconv.Itoa(n))
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	as.Equal(written, received)
+}
+
+func TestConn_FragmentedOpcode(t *testing.T) {
+	var as = assert.New(t)
+	for _, opcode := range []Opcode{OpcodeText, OpcodeBinary} {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var messages = make(chan *Message, 1)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			messages <- message
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		go func() {
+			_ = testWrite(client, false, opcode, []byte("he"))
+			_ = testWrite(client, false, OpcodeContinuation, []byte("ll"))
+			_ = testWrite(client, true, OpcodeContinuation, []byte("o"))
+		}()
+		var message = <-messages
+		as.Equal(opcode, message.Opcode)
+		as.Equal("hello", message.Data.String())
+		_ = client.WriteClose(1000, nil)
+	}
+}
+
+func TestConn_CheckMask(t *testing.T) {
+	var as = assert.New(t)
+	var cases = []struct {
+		name     string
+		toServer bool
+	}{
+		{name: "unmasked frame to server", toServer: true},
+		{name: "masked frame to client", toServer: false},
+	}
+
+	for _, item := range cases {
+		var item = item
+		t.Run(item.name, func(t *testing.T) {
+			var serverHandler = new(webSocketMocker)
+			var clientHandler = new(webSocketMocker)
+			var wg = &sync.WaitGroup{}
+			wg.Add(1)
+			var onMessage = func(socket *Conn, message *Message) {
+				t.Error("unexpected message")
+			}
+			var onClose = func(socket *Conn, err error) {
+				var closeErr *CloseError
+				if as.True(errors.As(err, &closeErr)) {
+					as.Equal(internal.CloseProtocolError.Uint16(), closeErr.Code)
+				}
+				wg.Done()
+			}
+			serverHandler.onMessage, clientHandler.onMessage = onMessage, onMessage
+			internal.SelectValue(item.toServer, clientHandler, serverHandler).onClose = onClose
+			server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+			go server.ReadLoop()
+			go client.ReadLoop()
+
+			// 对端收到违规的帧后以 1002 关闭, 发送方通过关闭帧得知原因
+			// The receiver closes with 1002 on the offending frame, the sender learns it from the close frame
+			var fh = frameHeader{}
+			var sender = internal.SelectValue(item.toServer, client, server)
+			var n, _ = fh.GenerateHeader(!sender.isServer, true, false, OpcodeText, 5)
+			var frame = append(fh[:n:n], "hello"...)
+			go func() { _, _ = sender.conn.Write(frame) }()
+			wg.Wait()
+		})
+	}
+}
+
+func TestConn_ReadMaxFrameSize(t *testing.T) {
+	var as = assert.New(t)
+	var cases = []struct {
+		name   string
+		length uint64
+		code   uint16
+	}{
+		{name: "declared length", length: 1 << 20, code: internal.CloseMessageTooLarge.Uint16()},
+		{name: "most significant bit", length: 1 << 63, code: internal.CloseProtocolError.Uint16()},
+	}
+
+	for _, item := range cases {
+		var item = item
+		t.Run(item.name, func(t *testing.T) {
+			var serverHandler = new(webSocketMocker)
+			var clientHandler = new(webSocketMocker)
+			var wg = &sync.WaitGroup{}
+			wg.Add(1)
+			serverHandler.onMessage = func(socket *Conn, message *Message) {
+				t.Error("unexpected message")
+			}
+			clientHandler.onClose = func(socket *Conn, err error) {
+				var closeErr *CloseError
+				if as.True(errors.As(err, &closeErr)) {
+					as.Equal(item.code, closeErr.Code)
+				}
+				wg.Done()
+			}
+			var serverOption = &ServerOption{ReadMaxFrameSize: 1024}
+			server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+			as.Equal(1024, server.config.ReadMaxFrameSize)
+			go server.ReadLoop()
+			go client.ReadLoop()
+
+			// 只发送帧头, 声明的长度远大于实际数据
+			// Only the frame header is sent, the declared length is far beyond the actual data
+			var header = []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+			binary.BigEndian.PutUint64(header[2:10], item.length)
+			go func() { _, _ = client.conn.Write(header) }()
+			wg.Wait()
+		})
+	}
+}
+
+func TestConn_ReadMaxFragments(t *testing.T) {
+	var as = assert.New(t)
+
+	var run = func(fragments int, stream bool) (messages []string, code uint16) {
+		var serverHandler = &streamMocker{}
+		var clientHandler = new(webSocketMocker)
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			messages = append(messages, message.Data.String())
+			wg.Done()
+		}
+		serverHandler.onStream = func(socket *Conn, opcode Opcode, r io.Reader) {
+			if p, err := io.ReadAll(r); err == nil {
+				messages = append(messages, string(p))
+				wg.Done()
+			}
+		}
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				code = closeErr.Code
+			}
+			wg.Done()
+		}
+		var serverOption = &ServerOption{ReadMaxFragments: 4, StreamReadEnabled: stream}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		go func() {
+			for i := 0; i < fragments; i++ {
+				var opcode = internal.SelectValue(i == 0, OpcodeText, OpcodeContinuation)
+				var frame = FrameEncoder{}.EncodeClientFrame(i == fragments-1, false, opcode, []byte("a"))
+				if _, err := client.conn.Write(frame); err != nil {
+					return
+				}
+			}
+		}()
+		wg.Wait()
+		return
+	}
+
+	t.Run("within limit", func(t *testing.T) {
+		messages, _ := run(4, false)
+		as.Equal([]string{"aaaa"}, messages)
+	})
+
+	t.Run("exceeded", func(t *testing.T) {
+		messages, code := run(100, false)
+		as.Empty(messages)
+		as.Equal(internal.CloseMessageTooLarge.Uint16(), code)
+	})
+
+	t.Run("stream within limit", func(t *testing.T) {
+		messages, _ := run(4, true)
+		as.Equal([]string{"aaaa"}, messages)
+	})
+
+	t.Run("stream exceeded", func(t *testing.T) {
+		_, code := run(100, true)
+		as.Equal(internal.CloseMessageTooLarge.Uint16(), code)
+	})
+}
+
+func TestConn_InterleavedControlFrame(t *testing.T) {
+	var as = assert.New(t)
+	var write = func(socket *Conn, opcode Opcode, fin bool, p []byte) {
+		frame, err := socket.genFrame(opcode, internal.Bytes(p), frameConfig{fin: fin})
+		as.NoError(err)
+		_, err = socket.conn.Write(frame.Bytes())
+		as.NoError(err)
+	}
+
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var pinged = int64(0)
+	clientHandler.onPing = func(socket *Conn, payload []byte) {
+		as.Equal("ping", string(payload))
+		atomic.AddInt64(&pinged, 1)
+		wg.Done()
+	}
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(int64(1), atomic.LoadInt64(&pinged))
+		as.Equal(OpcodeText, message.Opcode)
+		as.Equal("hello world", message.Data.String())
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	write(server, OpcodeText, false, []byte("hello "))
+	write(server, OpcodePing, true, []byte("ping"))
+	write(server, OpcodeContinuation, true, []byte("world"))
+	wg.Wait()
+}
+
+func TestConn_ManualDecompression(t *testing.T) {
+	var as = assert.New(t)
+	var pd = PermessageDeflate{Enabled: true, Threshold: 1}
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{PermessageDeflate: pd}
+	var clientOption = &ClientOption{PermessageDeflate: pd, ManualDecompression: true}
+	var payload = bytes.Repeat([]byte("hello "), 100)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var messages []*Message
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages = append(messages, message)
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(server.WriteMessage(OpcodeText, payload))
+	as.NoError(server.WriteMessage(OpcodeText, []byte("")))
+	wg.Wait()
+
+	as.True(messages[0].Compressed())
+	as.Less(messages[0].Data.Len(), len(payload))
+	var reader = flate.NewReader(io.MultiReader(messages[0].Data, bytes.NewReader(flateTail[:4])))
+	plain, err := io.ReadAll(reader)
+	as.ErrorIs(err, io.ErrUnexpectedEOF)
+	as.Equal(string(payload), string(plain))
+
+	as.False(messages[1].Compressed())
+}
+
+func TestConn_OnDecompressError(t *testing.T) {
+	var as = assert.New(t)
+	var pd = PermessageDeflate{Enabled: true, Threshold: 1}
+	var encoder FrameEncoder
+	var corrupt = encoder.EncodeClientFrame(true, true, OpcodeText, []byte{0xff, 0xff, 0xff})
+
+	t.Run("discard", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		var messages []string
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			messages = append(messages, message.Data.String())
+			wg.Done()
+		}
+		var serverOption = &ServerOption{
+			PermessageDeflate: pd,
+			OnDecompressError: func(socket *Conn, err error) bool {
+				as.Error(err)
+				wg.Done()
+				return false
+			},
+		}
+		server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(client.WriteString("hello"))
+		_, err := client.conn.Write(corrupt)
+		as.NoError(err)
+		as.NoError(client.WriteString("world"))
+		wg.Wait()
+		as.Equal([]string{"hello", "world"}, messages)
+		as.False(server.IsClosed())
+	})
+
+	t.Run("close", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{PermessageDeflate: pd}, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		_, err := client.conn.Write(corrupt)
+		as.NoError(err)
+		wg.Wait()
+		as.True(server.IsClosed())
+	})
+}
+
+func TestConn_ReadInterceptor(t *testing.T) {
+	var as = assert.New(t)
+	var key = []byte("secret")
+	var errSignature = errors.New("invalid signature")
+	var sign = func(p []byte) []byte {
+		var h = hmac.New(sha256.New, key)
+		h.Write(p)
+		return append(h.Sum(nil), p...)
+	}
+
+	var wg = &sync.WaitGroup{}
+	wg.Add(3)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var received []string
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		received = append(received, message.Data.String())
+		wg.Done()
+	}
+	serverHandler.onClose = func(socket *Conn, err error) {
+		as.ErrorIs(err, errSignature)
+		wg.Done()
+	}
+	clientHandler.onClose = func(socket *Conn, err error) {
+		var closeErr *CloseError
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(ClosePolicyViolation, closeErr.Code)
+		}
+		wg.Done()
+	}
+	var serverOption = &ServerOption{
+		PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+		ReadInterceptor: func(opcode Opcode, payload []byte) ([]byte, error) {
+			if len(payload) < sha256.Size {
+				return nil, errSignature
+			}
+			var h = hmac.New(sha256.New, key)
+			h.Write(payload[sha256.Size:])
+			if !hmac.Equal(h.Sum(nil), payload[:sha256.Size]) {
+				return nil, errSignature
+			}
+			return payload[sha256.Size:], nil
+		},
+	}
+	var clientOption = &ClientOption{PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1}}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.NoError(client.WriteMessage(OpcodeText, sign([]byte("hello"))))
+	var tampered = sign([]byte("world"))
+	tampered[len(tampered)-1] = 'D'
+	as.NoError(client.WriteMessage(OpcodeText, tampered))
+	wg.Wait()
+	as.Equal([]string{"hello"}, received)
+}
+
+func TestConn_EmptyPayload(t *testing.T) {
+	var as = assert.New(t)
+
+	var roundTrip = func(pd PermessageDeflate) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(0, message.Len())
+			as.NoError(socket.WriteMessage(message.Opcode, message.Bytes()))
+		}
+		serverHandler.onPing = func(socket *Conn, payload []byte) {
+			as.Empty(payload)
+			as.NoError(socket.WritePong(nil))
+		}
+		var clientHandler = new(webSocketMocker)
+		var opcodes []Opcode
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(0, message.Len())
+			opcodes = append(opcodes, message.Opcode)
+			wg.Done()
+		}
+		clientHandler.onPong = func(socket *Conn, payload []byte) {
+			as.Empty(payload)
+			wg.Done()
+		}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{PermessageDeflate: pd, CheckUtf8Enabled: true})
+		server, client, err := NewPipeConns(upgrader, clientHandler, &ClientOption{PermessageDeflate: pd, CheckUtf8Enabled: true})
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(client.WriteString(""))
+		as.NoError(client.WriteMessage(OpcodeBinary, nil))
+		as.NoError(client.WritePing(nil))
+		wg.Wait()
+		as.ElementsMatch([]Opcode{OpcodeText, OpcodeBinary}, opcodes)
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		roundTrip(PermessageDeflate{})
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		roundTrip(PermessageDeflate{Enabled: true, Threshold: 1})
+	})
+
+	t.Run("context takeover", func(t *testing.T) {
+		roundTrip(PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true})
+	})
+
+	// 空的压缩负载和只有一个 0x00 字节的压缩负载都解压为空消息
+	// Both an empty compressed payload and a single 0x00 byte decompress to an empty message
+	t.Run("empty compressed frame", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		var serverHandler = new(webSocketMocker)
+		var received []string
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			received = append(received, message.Data.String())
+			wg.Done()
+		}
+		var pd = PermessageDeflate{Enabled: true}
+		server, client := newPeer(serverHandler, &ServerOption{PermessageDeflate: pd}, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var encoder FrameEncoder
+		_, _ = client.conn.Write(encoder.EncodeClientFrame(true, true, OpcodeText, nil))
+		_, _ = client.conn.Write(encoder.EncodeClientFrame(true, true, OpcodeText, []byte{0x00}))
+		as.NoError(client.WriteString("hello"))
+		wg.Wait()
+		as.Equal([]string{"", "", "hello"}, received)
+	})
+}
+
+func TestConn_NextMessage(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Fail("unexpected OnMessage")
+	}
+	server, client := newPeer(serverHandler, &ServerOption{PullMode: true}, new(webSocketMocker), nil)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			_ = client.WriteString(strconv.Itoa(i))
+		}
+		_ = client.WriteClose(1000, []byte("bye"))
+	}()
+
+	for i := 0; i < 3; i++ {
+		msg, err := server.NextMessage()
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(OpcodeText, msg.Opcode)
+		as.Equal(strconv.Itoa(i), msg.Data.String())
+		_ = msg.Close()
+	}
+
+	msg, err := server.NextMessage()
+	as.Nil(msg)
+	var closeErr *CloseError
+	if as.True(errors.As(err, &closeErr)) {
+		as.Equal(CloseNormalClosure, closeErr.Code)
+		as.Equal("bye", string(closeErr.Reason))
+	}
+}
+
+func TestConn_NextMessage_LocalClose(t *testing.T) {
+	var as = assert.New(t)
+	var closed = make(chan error, 1)
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {}
+	server, client := newPeer(serverHandler, &ServerOption{PullMode: true}, clientHandler, nil)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	// 应用不再拉取消息, 本地关闭之后读协程仍然能够退出
+	// The application stops pulling, the read goroutine still exits after a local close
+	go func() {
+		for i := 0; i < 3; i++ {
+			_ = client.WriteString(strconv.Itoa(i))
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	as.NoError(server.WriteClose(1000, nil))
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		as.Fail("ReadLoop is blocked")
+	}
+	_, err := server.NextMessage()
+	as.Error(err)
+}
+
+type headerMocker struct {
+	webSocketMocker
+	onMessageHeader func(socket *Conn, opcode Opcode, declaredLen int) bool
+}
+
+func (c *headerMocker) OnMessageHeader(socket *Conn, opcode Opcode, declaredLen int) bool {
+	return c.onMessageHeader(socket, opcode, declaredLen)
+}
+
+func TestConn_OnMessageHeader(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var serverHandler = new(headerMocker)
+	var headers []int
+	serverHandler.onMessageHeader = func(socket *Conn, opcode Opcode, declaredLen int) bool {
+		as.Equal(OpcodeBinary, opcode)
+		headers = append(headers, declaredLen)
+		return declaredLen <= 8
+	}
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(8, message.Len())
+		wg.Done()
+	}
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onClose = func(socket *Conn, err error) {
+		var closeErr *CloseError
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(CloseMessageTooLarge, closeErr.Code)
+		}
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, nil, clientHandler, nil)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.NoError(client.WriteMessage(OpcodeBinary, make([]byte, 8)))
+	as.NoError(client.WritePing(nil))
+	as.NoError(client.WriteMessage(OpcodeBinary, make([]byte, 9)))
+	wg.Wait()
+	as.Equal([]int{8, 9}, headers)
+}
+
+func TestConn_LazyReassembly(t *testing.T) {
+	var as = assert.New(t)
+
+	var write = func(client *Conn, opcode Opcode, fragments ...string) {
+		for i, item := range fragments {
+			var code = OpcodeContinuation
+			if i == 0 {
+				code = opcode
+			}
+			var frame = FrameEncoder{}.EncodeClientFrame(i == len(fragments)-1, false, code, []byte(item))
+			_, _ = client.conn.Write(frame)
+		}
+	}
+
+	var serverHandler = new(webSocketMocker)
+	var messages = make(chan *Message, 8)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message
+	}
+	var serverOption = &ServerOption{LazyReassembly: true, CheckUtf8Enabled: true}
+	server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	t.Run("read", func(t *testing.T) {
+		go write(client, OpcodeBinary, "hello", "", ", ", "world")
+		var message = <-messages
+		as.Nil(message.Data)
+		as.Len(message.fragments, 4)
+		as.Equal(12, message.Len())
+		var p, err = io.ReadAll(message)
+		as.NoError(err)
+		as.Equal("hello, world", string(p))
+		as.Equal(0, message.Len())
+		as.NoError(message.Close())
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		go write(client, OpcodeBinary, "hello", ", world")
+		var message = <-messages
+		var p = make([]byte, 2)
+		_, _ = message.Read(p)
+		as.Equal("llo, world", string(message.Bytes()))
+		as.Nil(message.fragments)
+		as.Equal("llo, world", message.Data.String())
+		as.NoError(message.Close())
+		as.Equal(0, message.Len())
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		go write(client, OpcodeBinary, `{"name":`, `"gws"}`)
+		var message = <-messages
+		var v = struct{ Name string }{}
+		as.NoError(message.Bind(&v))
+		as.Equal("gws", v.Name)
+		as.NoError(message.Close())
+	})
+
+	t.Run("single frame", func(t *testing.T) {
+		go write(client, OpcodeBinary, "hello")
+		var message = <-messages
+		as.Nil(message.fragments)
+		as.Equal("hello", message.Data.String())
+		as.NoError(message.Close())
+	})
+
+	t.Run("text encoding check", func(t *testing.T) {
+		go write(client, OpcodeText, "hello", ", world")
+		var message = <-messages
+		as.Nil(message.fragments)
+		as.Equal("hello, world", message.Data.String())
+		as.NoError(message.Close())
+	})
+}
+
+func TestConn_OnFrame(t *testing.T) {
+	var as = assert.New(t)
+
+	type frame struct {
+		fin        bool
+		rsv1       bool
+		opcode     Opcode
+		payloadLen int
+	}
+	var mu sync.Mutex
+	var frames []frame
+	var wg = &sync.WaitGroup{}
+	wg.Add(3)
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) { wg.Done() }
+	serverHandler.onPing = func(socket *Conn, payload []byte) { wg.Done() }
+	var serverOption = &ServerOption{
+		PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+		OnFrame: func(socket *Conn, fin bool, rsv1 bool, opcode Opcode, payloadLen int) {
+			mu.Lock()
+			frames = append(frames, frame{fin: fin, rsv1: rsv1, opcode: opcode, payloadLen: payloadLen})
+			mu.Unlock()
+		},
+	}
+	var clientOption = &ClientOption{PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1}}
+	server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var encoder = FrameEncoder{}
+	_, _ = client.conn.Write(encoder.EncodeClientFrame(false, false, OpcodeText, []byte("he")))
+	_, _ = client.conn.Write(encoder.EncodeClientFrame(true, false, OpcodePing, []byte("ping")))
+	_, _ = client.conn.Write(encoder.EncodeClientFrame(true, false, OpcodeContinuation, []byte("llo")))
+	as.NoError(client.WriteString("hello"))
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if as.Len(frames, 4) {
+		as.Equal(frame{fin: false, opcode: OpcodeText, payloadLen: 2}, frames[0])
+		as.Equal(frame{fin: true, opcode: OpcodePing, payloadLen: 4}, frames[1])
+		as.Equal(frame{fin: true, opcode: OpcodeContinuation, payloadLen: 3}, frames[2])
+		as.True(frames[3].fin)
+		as.True(frames[3].rsv1)
+		as.Equal(OpcodeText, frames[3].opcode)
+	}
+}
@@ -0,0 +1,286 @@
+package gws
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+)
+
+const (
+	// 默认的首次重连延迟
+	// Default delay before the first redial
+	defaultReconnectInitialDelay = 500 * time.Millisecond
+
+	// 默认的最大重连延迟
+	// Default maximum delay between redials
+	defaultReconnectMaxDelay = 30 * time.Second
+
+	// 默认的重连延迟倍数
+	// Default multiplier of the redial delay
+	defaultReconnectMultiplier = 2
+)
+
+// ReconnectOption 自动重连配置
+// Automatic reconnection options
+type ReconnectOption struct {
+	// 首次重连之前的延迟, 默认 500ms
+	// Delay before the first redial, defaults to 500ms
+	InitialDelay time.Duration
+
+	// 重连延迟的上限, 默认 30s
+	// Upper bound of the redial delay, defaults to 30s
+	MaxDelay time.Duration
+
+	// 每次重连失败之后延迟的倍数, 小于 1 时使用默认值 2
+	// Multiplier applied to the delay after each failed redial, the default 2 is used if it is less than 1
+	Multiplier float64
+
+	// 随机抖动比例, 取值范围 [0, 1], 默认为 0
+	// 每次等待的时间在 [delay*(1-Jitter), delay] 之间随机选取, 避免大量客户端同时重连.
+	// Jitter ratio in the range [0, 1], defaults to 0.
+	// Each wait is picked at random in [delay*(1-Jitter), delay], so that many clients do not redial at the same time.
+	Jitter float64
+
+	// 连续重连失败的最大次数, 默认为 0, 即不限制
+	// 达到上限之后停止重连, Done 被关闭, Err 返回最后一次拨号的错误.
+	// Maximum number of consecutive failed redials, defaults to 0, i.e. unlimited.
+	// Redialing stops once it is reached, Done is closed and Err returns the error of the last dial.
+	MaxAttempts int
+
+	// 重连成功的回调, 默认为 nil
+	// 在新连接的读循环开始之前调用, 此时已经可以写入, 例如重新订阅. OnOpen 同样会对每一个连接调用.
+	// Reconnection callback, defaults to nil.
+	// It is called before the read loop of the new connection starts, writes already work at this point,
+	// e.g. to subscribe again. OnOpen is called for every connection as well.
+	OnReconnect func(socket *Conn)
+
+	// 拨号函数, 默认为 nil, 即使用 NewClient 和客户端配置拨号
+	// 返回的连接不能调用 ReadLoop, 读循环由 ReconnectingClient 负责. 可以替换为其他传输方式, 例如测试中的 NewPipeConns.
+	// Dial function, defaults to nil, i.e. NewClient is called with the client options.
+	// ReadLoop must not be called on the returned connection, the read loop is owned by the ReconnectingClient.
+	// It can be replaced with other transports, e.g. NewPipeConns in tests.
+	Dial func(handler Event) (*Conn, error)
+}
+
+// 初始化自动重连配置
+// Initializes the automatic reconnection options
+func initReconnectOption(c *ReconnectOption) *ReconnectOption {
+	if c == nil {
+		c = new(ReconnectOption)
+	}
+	if c.InitialDelay <= 0 {
+		c.InitialDelay = defaultReconnectInitialDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaultReconnectMaxDelay
+	}
+	if c.MaxDelay < c.InitialDelay {
+		c.MaxDelay = c.InitialDelay
+	}
+	if c.Multiplier < 1 {
+		c.Multiplier = defaultReconnectMultiplier
+	}
+	if c.Jitter < 0 {
+		c.Jitter = 0
+	}
+	if c.Jitter > 1 {
+		c.Jitter = 1
+	}
+	if c.OnReconnect == nil {
+		c.OnReconnect = func(socket *Conn) {}
+	}
+	return c
+}
+
+// 计算下一次重连的延迟, 不超过 MaxDelay
+// Computes the delay of the next redial, capped at MaxDelay
+func (c *ReconnectOption) nextDelay(delay time.Duration) time.Duration {
+	var next = time.Duration(float64(delay) * c.Multiplier)
+	if next > c.MaxDelay || next < delay {
+		next = c.MaxDelay
+	}
+	return next
+}
+
+// 对延迟应用随机抖动
+// Applies random jitter to the delay
+func (c *ReconnectOption) withJitter(delay time.Duration) time.Duration {
+	var span = int(float64(delay/time.Microsecond) * c.Jitter)
+	if span <= 0 {
+		return delay
+	}
+	return delay - time.Duration(internal.Numeric.Intn(span+1))*time.Microsecond
+}
+
+// ReconnectingClient 自动重连的客户端
+// 连接意外断开(不是调用 Close 导致的)之后, 按照指数退避重新拨号, 成功后调用 OnReconnect.
+// 写入方法总是作用于当前的连接, 断开期间写入返回 ErrConnClosed, 消息不会被缓存.
+// 事件处理器被所有底层连接共享, OnOpen 和 OnClose 会对每一个连接调用.
+// Client that reconnects automatically.
+// When the connection drops unexpectedly (not because of Close), it redials with exponential backoff
+// and calls OnReconnect on success. Write methods always act on the current connection;
+// while disconnected they return ErrConnClosed, messages are not buffered.
+// The event handler is shared by all underlying connections, OnOpen and OnClose are called for each of them.
+type ReconnectingClient struct {
+	handler Event
+	option  *ReconnectOption
+	mu      sync.RWMutex
+	conn    *Conn
+	once    sync.Once
+	closed  chan struct{}
+	done    chan struct{}
+	err     error
+}
+
+// NewReconnectingClient 创建自动重连的客户端, 首次拨号失败时直接返回错误, 不会重试
+// 客户端在后台运行读循环, 调用方不需要也不能调用 ReadLoop.
+// Creates a client that reconnects automatically. If the first dial fails, the error is returned without retrying.
+// The client runs the read loop in the background, the caller neither needs to nor may call ReadLoop.
+func NewReconnectingClient(handler Event, option *ClientOption, reconnect *ReconnectOption) (*ReconnectingClient, error) {
+	reconnect = initReconnectOption(reconnect)
+	if reconnect.Dial == nil {
+		reconnect.Dial = func(handler Event) (*Conn, error) {
+			socket, _, err := NewClient(handler, option)
+			return socket, err
+		}
+	}
+	socket, err := reconnect.Dial(handler)
+	if err != nil {
+		return nil, err
+	}
+	var c = &ReconnectingClient{
+		handler: handler,
+		option:  reconnect,
+		conn:    socket,
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// Conn 返回当前的底层连接
+// Returns the current underlying connection
+func (c *ReconnectingClient) Conn() *Conn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+// Done 返回一个在客户端停止运行(调用了 Close 或者放弃重连)之后关闭的通道
+// Returns a channel that is closed once the client stops running, after Close or when it gives up redialing
+func (c *ReconnectingClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err 返回放弃重连时最后一次拨号的错误, 调用了 Close 或者仍在运行时返回 nil
+// Returns the error of the last dial when the client gave up redialing, nil after Close or while still running
+func (c *ReconnectingClient) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close 停止重连, 发送 1000 状态码的关闭帧并断开当前连接
+// 当前连接已经断开(例如正在等待重连)或者重复调用时返回 ErrConnClosed, 此时同样会停止重连.
+// Stops reconnecting, sends a close frame with status code 1000 and disconnects the current connection.
+// ErrConnClosed is returned if the current connection has already dropped (e.g. while waiting to redial)
+// or on repeated calls, reconnecting is stopped in that case as well.
+func (c *ReconnectingClient) Close() error {
+	var err = ErrConnClosed
+	c.once.Do(func() {
+		c.mu.Lock()
+		close(c.closed)
+		var socket = c.conn
+		c.mu.Unlock()
+		err = socket.WriteClose(CloseNormalClosure, nil)
+	})
+	return err
+}
+
+// WriteMessage 向当前连接写入消息
+// Writes a message to the current connection
+func (c *ReconnectingClient) WriteMessage(opcode Opcode, payload []byte) error {
+	return c.Conn().WriteMessage(opcode, payload)
+}
+
+// WriteString 向当前连接写入文本消息
+// Writes a text message to the current connection
+func (c *ReconnectingClient) WriteString(s string) error {
+	return c.Conn().WriteString(s)
+}
+
+// WriteAsync 向当前连接异步写入消息
+// Writes a message to the current connection asynchronously
+func (c *ReconnectingClient) WriteAsync(opcode Opcode, payload []byte, callback func(error)) {
+	c.Conn().WriteAsync(opcode, payload, callback)
+}
+
+// 运行读循环, 连接断开之后重连, 直到调用 Close 或者放弃重连
+// Runs the read loop and redials after the connection drops, until Close is called or redialing is given up
+func (c *ReconnectingClient) run() {
+	defer close(c.done)
+	for {
+		c.Conn().ReadLoop()
+		socket, err := c.redial()
+		if err != nil {
+			if !c.isClosed() {
+				c.err = err
+			}
+			return
+		}
+
+		c.mu.Lock()
+		if c.isClosed() {
+			c.mu.Unlock()
+			_ = socket.WriteClose(CloseNormalClosure, nil)
+			return
+		}
+		c.conn = socket
+		c.mu.Unlock()
+		c.emitReconnect(socket)
+	}
+}
+
+// 按照指数退避重新拨号
+// Redials with exponential backoff
+func (c *ReconnectingClient) redial() (*Conn, error) {
+	var delay = c.option.InitialDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.closed:
+			return nil, ErrConnClosed
+		case <-time.After(c.option.withJitter(delay)):
+		}
+		socket, err := c.option.Dial(c.handler)
+		if err == nil {
+			return socket, nil
+		}
+		if n := c.option.MaxAttempts; n > 0 && attempt >= n {
+			return nil, err
+		}
+		delay = c.option.nextDelay(delay)
+	}
+}
+
+// 调用重连回调
+// Calls the reconnection callback
+func (c *ReconnectingClient) emitReconnect(socket *Conn) {
+	defer socket.config.Recovery(socket.config.Logger)
+	c.option.OnReconnect(socket)
+}
+
+// 是否已经调用了 Close
+// Reports whether Close has been called
+func (c *ReconnectingClient) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
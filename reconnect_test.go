@@ -0,0 +1,174 @@
+package gws
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectOption(t *testing.T) {
+	var as = assert.New(t)
+
+	var option = initReconnectOption(nil)
+	as.Equal(defaultReconnectInitialDelay, option.InitialDelay)
+	as.Equal(defaultReconnectMaxDelay, option.MaxDelay)
+	as.Equal(float64(defaultReconnectMultiplier), option.Multiplier)
+	as.NotNil(option.OnReconnect)
+
+	option = initReconnectOption(&ReconnectOption{
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     time.Second,
+		Multiplier:   3,
+		Jitter:       2,
+	})
+	as.Equal(1.0, option.Jitter)
+	as.Equal(300*time.Millisecond, option.nextDelay(100*time.Millisecond))
+	as.Equal(900*time.Millisecond, option.nextDelay(300*time.Millisecond))
+	as.Equal(time.Second, option.nextDelay(900*time.Millisecond))
+	as.Equal(time.Second, option.nextDelay(time.Second))
+	for i := 0; i < 100; i++ {
+		var d = option.withJitter(time.Second)
+		as.True(d >= 0 && d <= time.Second)
+	}
+
+	option.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		var d = option.withJitter(time.Second)
+		as.True(d >= 500*time.Millisecond && d <= time.Second)
+	}
+
+	option.Jitter = 0
+	as.Equal(time.Second, option.withJitter(time.Second))
+}
+
+func TestReconnectingClient(t *testing.T) {
+	var as = assert.New(t)
+
+	// 通过内存管道拨号, 并把服务端连接交给测试, 用于模拟断线
+	// Dials over an in-memory pipe and hands the server-side connection to the test to simulate drops
+	var pipeDial = func(upgrader *Upgrader, servers chan *Conn) func(handler Event) (*Conn, error) {
+		return func(handler Event) (*Conn, error) {
+			server, client, err := NewPipeConns(upgrader, handler, nil)
+			if err != nil {
+				return nil, err
+			}
+			go server.ReadLoop()
+			servers <- server
+			return client, nil
+		}
+	}
+
+	t.Run("reconnect", func(t *testing.T) {
+		var received = make(chan string, 8)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			received <- message.Data.String()
+		}
+		var servers = make(chan *Conn, 4)
+		var opened, closed int64
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onOpen = func(socket *Conn) { atomic.AddInt64(&opened, 1) }
+		clientHandler.onClose = func(socket *Conn, err error) { atomic.AddInt64(&closed, 1) }
+		var reconnected int64
+		client, err := NewReconnectingClient(clientHandler, nil, &ReconnectOption{
+			InitialDelay: 10 * time.Millisecond,
+			Dial:         pipeDial(NewUpgrader(serverHandler, nil), servers),
+			OnReconnect: func(socket *Conn) {
+				atomic.AddInt64(&reconnected, 1)
+				_ = socket.WriteString("subscribe")
+			},
+		})
+		if !as.NoError(err) {
+			return
+		}
+
+		var server = <-servers
+		as.NoError(client.WriteString("a"))
+		as.Equal("a", <-received)
+
+		var first = client.Conn()
+		_ = server.NetConn().Close()
+		server = <-servers
+		as.Equal("subscribe", <-received)
+		as.NotSame(first, client.Conn())
+		as.NoError(client.WriteString("b"))
+		as.Equal("b", <-received)
+
+		var errs = make(chan error, 1)
+		client.WriteAsync(OpcodeText, []byte("c"), func(err error) { errs <- err })
+		as.NoError(<-errs)
+		as.Equal("c", <-received)
+
+		as.NoError(client.Close())
+		as.ErrorIs(client.Close(), ErrConnClosed)
+		<-client.Done()
+		as.NoError(client.Err())
+		as.Equal(int64(1), atomic.LoadInt64(&reconnected))
+		as.Equal(int64(2), atomic.LoadInt64(&opened))
+		as.Equal(int64(2), atomic.LoadInt64(&closed))
+		as.ErrorIs(client.WriteString("d"), ErrConnClosed)
+		as.Len(servers, 0)
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		var servers = make(chan *Conn, 1)
+		var dial = pipeDial(NewUpgrader(new(BuiltinEventHandler), nil), servers)
+		var dialErr = errors.New("connection refused")
+		var attempts int64
+		client, err := NewReconnectingClient(new(BuiltinEventHandler), nil, &ReconnectOption{
+			InitialDelay: time.Millisecond,
+			MaxAttempts:  3,
+			Dial: func(handler Event) (*Conn, error) {
+				if atomic.AddInt64(&attempts, 1) == 1 {
+					return dial(handler)
+				}
+				return nil, dialErr
+			},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		as.NoError(client.Err())
+
+		_ = (<-servers).NetConn().Close()
+		<-client.Done()
+		as.ErrorIs(client.Err(), dialErr)
+		as.Equal(int64(4), atomic.LoadInt64(&attempts))
+	})
+
+	t.Run("close while redialing", func(t *testing.T) {
+		var servers = make(chan *Conn, 1)
+		var dial = pipeDial(NewUpgrader(new(BuiltinEventHandler), nil), servers)
+		var attempts int64
+		client, err := NewReconnectingClient(new(BuiltinEventHandler), nil, &ReconnectOption{
+			InitialDelay: time.Hour,
+			Dial: func(handler Event) (*Conn, error) {
+				atomic.AddInt64(&attempts, 1)
+				return dial(handler)
+			},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		_ = (<-servers).NetConn().Close()
+		time.Sleep(50 * time.Millisecond)
+		as.ErrorIs(client.Close(), ErrConnClosed)
+		<-client.Done()
+		as.NoError(client.Err())
+		as.Equal(int64(1), atomic.LoadInt64(&attempts))
+	})
+
+	t.Run("first dial", func(t *testing.T) {
+		var dialErr = errors.New("connection refused")
+		_, err := NewReconnectingClient(new(BuiltinEventHandler), nil, &ReconnectOption{
+			Dial: func(handler Event) (*Conn, error) { return nil, dialErr },
+		})
+		as.ErrorIs(err, dialErr)
+
+		_, err = NewReconnectingClient(new(BuiltinEventHandler), &ClientOption{Addr: "ftp://127.0.0.1"}, nil)
+		as.ErrorIs(err, ErrUnsupportedProtocol)
+	})
+}
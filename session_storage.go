@@ -7,7 +7,11 @@ import (
 	"github.com/lxzan/gws/internal"
 )
 
-// SessionStorage 会话存储
+// SessionStorage 会话存储, 在连接的整个生命周期内有效
+// 自定义实现必须是并发安全的, 因为它会被鉴权函数, 事件回调和其他协程同时访问.
+// Session storage, valid for the whole life of the connection.
+// Custom implementations must be safe for concurrent use,
+// since the storage is accessed by the authorize function, event callbacks and other goroutines alike.
 type SessionStorage interface {
 	// Len 返回存储中的键值对数量
 	// Returns the number of key-value pairs in the storage
@@ -37,8 +41,10 @@ func newSmap() *smap {
 	return &smap{data: make(map[string]any)}
 }
 
-// smap 基于 map 的会话存储实现
-// map-based implementation of the session storage
+// smap 基于 map 的会话存储实现, 所有方法由互斥锁保护, 可以在任意协程中调用
+// Range 在遍历期间持有锁, 回调函数中不能再访问同一个存储, 否则会死锁.
+// map-based implementation of the session storage. Every method is guarded by a mutex and may be called from any goroutine.
+// Range holds the lock while iterating, so the callback must not access the same storage or it deadlocks.
 type smap struct {
 	sync.Mutex
 	data map[string]any
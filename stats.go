@@ -0,0 +1,141 @@
+package gws
+
+import "sync/atomic"
+
+// ConnStats 连接统计信息
+// Connection statistics
+type ConnStats struct {
+	// 读取的消息数量(不含控制帧)
+	// Number of messages read (control frames excluded)
+	MessagesRead int64
+
+	// 写入的消息数量(不含控制帧)
+	// Number of messages written (control frames excluded)
+	MessagesWritten int64
+
+	// 读取的字节数, 包含帧头
+	// Number of bytes read, including frame headers
+	BytesRead int64
+
+	// 写入的字节数, 包含帧头
+	// Number of bytes written, including frame headers
+	BytesWritten int64
+
+	// 压缩节省的字节数
+	// Number of bytes saved by compression
+	CompressionSaved int64
+
+	// 发送队列中等待执行的任务数量
+	// Number of pending jobs in the write queue
+	QueueDepth int
+
+	// 发送队列的统计信息, Pending 与 QueueDepth 相同
+	// Statistics of the write queue, Pending equals QueueDepth
+	WriteQueue QueueStats
+
+	// 并行读取(ParallelEnabled)时的分发队列的统计信息, Pending 为正在执行的 OnMessage 数量.
+	// 分发队列已满时读协程会等待, 不会丢弃消息, 所以 Dropped 总是为0
+	// Statistics of the dispatch queue with parallel reading (ParallelEnabled), Pending is the number of running OnMessage calls.
+	// The read goroutine waits when the dispatch queue is full and never drops messages, so Dropped is always 0.
+	ReadQueue QueueStats
+}
+
+// QueueStats 任务队列统计信息
+// Task queue statistics
+type QueueStats struct {
+	// 等待执行的任务数量
+	// Number of pending jobs
+	Pending int
+
+	// 已执行的任务数量
+	// Number of processed jobs
+	Processed int64
+
+	// 队列已满时被拒绝或丢弃的任务数量
+	// Number of jobs rejected or dropped because the queue was full
+	Dropped int64
+}
+
+// 统计计数器, 使用原子操作更新
+// 在 32 位平台上必须位于 64 位对齐的地址, 即结构体的第一个字段或者单独分配
+// Statistics counter, updated with atomic operations.
+// On 32-bit platforms it must sit at a 64-bit aligned address, i.e. be the first field of a struct or allocated on its own.
+type statsCounter struct {
+	messagesRead     int64
+	messagesWritten  int64
+	bytesRead        int64
+	bytesWritten     int64
+	compressionSaved int64
+}
+
+// 返回计数器的快照
+// Returns a snapshot of the counter
+func (c *statsCounter) snapshot() ConnStats {
+	return ConnStats{
+		MessagesRead:     atomic.LoadInt64(&c.messagesRead),
+		MessagesWritten:  atomic.LoadInt64(&c.messagesWritten),
+		BytesRead:        atomic.LoadInt64(&c.bytesRead),
+		BytesWritten:     atomic.LoadInt64(&c.bytesWritten),
+		CompressionSaved: atomic.LoadInt64(&c.compressionSaved),
+	}
+}
+
+// 同时累加连接自身和配置级别的计数
+// Adds to both the connection's own counter and the config-level counter
+func (c *Conn) addStats(f func(s *statsCounter)) {
+	f(&c.stats)
+	if c.config != nil && c.config.stats != nil {
+		f(c.config.stats)
+	}
+}
+
+// 记录读取的消息数量和字节数
+// Records the number of messages and bytes read
+func (c *Conn) statsRead(messages, n int) {
+	c.addStats(func(s *statsCounter) {
+		atomic.AddInt64(&s.messagesRead, int64(messages))
+		atomic.AddInt64(&s.bytesRead, int64(n))
+	})
+}
+
+// 记录写入的消息数量和字节数
+// Records the number of messages and bytes written
+func (c *Conn) statsWrite(messages, n int) {
+	c.addStats(func(s *statsCounter) {
+		atomic.AddInt64(&s.messagesWritten, int64(messages))
+		atomic.AddInt64(&s.bytesWritten, int64(n))
+	})
+}
+
+// 记录压缩节省的字节数
+// Records the number of bytes saved by compression
+func (c *Conn) statsCompressed(saved int) {
+	c.addStats(func(s *statsCounter) {
+		atomic.AddInt64(&s.compressionSaved, int64(saved))
+	})
+}
+
+// Stats 返回连接的统计信息
+// Returns the statistics of the connection
+func (c *Conn) Stats() ConnStats {
+	var stats = c.stats.snapshot()
+	stats.WriteQueue = c.writeQueue.Stats()
+	stats.QueueDepth = stats.WriteQueue.Pending
+	stats.ReadQueue = QueueStats{
+		Pending:   len(c.readQueue),
+		Processed: atomic.LoadInt64(&c.readCounter.processed),
+	}
+	return stats
+}
+
+// Stats 返回该升级器创建的所有连接的统计信息之和, 需要开启 ServerOption.AggregateStats, 否则总是返回0
+// 队列统计信息(QueueDepth, WriteQueue, ReadQueue)不参与汇总, 总是为0
+// Returns the sum of the statistics of all connections created by this upgrader.
+// ServerOption.AggregateStats must be enabled, otherwise zeros are always returned.
+// Queue statistics (QueueDepth, WriteQueue, ReadQueue) are not aggregated and are always 0.
+func (c *Upgrader) Stats() ConnStats {
+	if stats := c.option.getConfig().stats; stats != nil {
+		return stats.snapshot()
+	}
+	return ConnStats{}
+}
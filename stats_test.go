@@ -0,0 +1,148 @@
+package gws
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConn_Stats(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("plain text", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{}
+		var clientOption = &ClientOption{}
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		for i := 0; i < 3; i++ {
+			as.NoError(server.WriteString("hello"))
+		}
+		as.NoError(server.WritePing(nil))
+		wg.Wait()
+
+		var stats = server.Stats()
+		as.Equal(int64(3), stats.MessagesWritten)
+		as.Equal(int64(3*7+2), stats.BytesWritten)
+		as.Equal(0, stats.QueueDepth)
+
+		stats = client.Stats()
+		as.Equal(int64(3), stats.MessagesRead)
+		as.Equal(int64(3*7), stats.BytesRead)
+		as.Equal(int64(0), stats.CompressionSaved)
+	})
+
+	t.Run("compress", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1}}
+		var clientOption = &ClientOption{PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1}}
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		var payload = bytes.Repeat([]byte("a"), 1024)
+		as.NoError(server.WriteMessage(OpcodeBinary, payload))
+		wg.Wait()
+
+		var stats = server.Stats()
+		as.Equal(int64(1), stats.MessagesWritten)
+		as.Greater(stats.CompressionSaved, int64(0))
+		as.Equal(int64(1024)-stats.CompressionSaved+2, stats.BytesWritten)
+		as.Equal(stats.BytesWritten, client.Stats().BytesRead)
+	})
+}
+
+func TestConn_QueueStats(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{ParallelEnabled: true, ParallelGolimit: 4}
+	var clientOption = &ClientOption{}
+	var wg = &sync.WaitGroup{}
+	wg.Add(6)
+	var release = make(chan struct{})
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		wg.Done()
+		<-release
+	}
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	for i := 0; i < 3; i++ {
+		as.NoError(client.WriteString("hello"))
+		server.WriteAsync(OpcodeText, []byte("world"), nil)
+	}
+	wg.Wait()
+	var stats = server.Stats()
+	as.Equal(3, stats.ReadQueue.Pending)
+	as.Equal(int64(0), stats.ReadQueue.Processed)
+
+	close(release)
+	as.Eventually(func() bool {
+		stats = server.Stats()
+		return stats.ReadQueue.Processed == 3 && stats.WriteQueue.Processed == 3
+	}, time.Second, time.Millisecond)
+	as.Equal(QueueStats{Pending: 0, Processed: 3}, stats.ReadQueue)
+	as.Equal(QueueStats{Pending: 0, Processed: 3}, stats.WriteQueue)
+	as.Equal(stats.WriteQueue.Pending, stats.QueueDepth)
+}
+
+func TestUpgrader_Stats(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	as.Equal(ConnStats{}, NewUpgrader(serverHandler, nil).Stats())
+
+	var upgrader = NewUpgrader(serverHandler, &ServerOption{AggregateStats: true})
+	var config = upgrader.option.getConfig()
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		wg.Done()
+	}
+
+	for i := 0; i < 2; i++ {
+		svrConn, cliConn := net.Pipe()
+		var server = serveWebSocket(true, config, newSmap(), svrConn, bufio.NewReader(svrConn), serverHandler, false, "", PermessageDeflate{})
+		var client = serveWebSocket(false, initClientOption(nil).getConfig(), newSmap(), cliConn, bufio.NewReader(cliConn), new(webSocketMocker), false, "", PermessageDeflate{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(client.WriteString("hello"))
+	}
+	wg.Wait()
+
+	var stats = upgrader.Stats()
+	as.Equal(int64(2), stats.MessagesRead)
+	as.Equal(int64(2*11), stats.BytesRead)
+}
+
+// 原子操作的 64 位计数器在 32 位平台上必须对齐, 使用 GOARCH=386 运行时该测试才有意义
+// 64-bit counters updated atomically must be aligned on 32-bit platforms, this test is meaningful when run with GOARCH=386
+func TestAtomicAlignment(t *testing.T) {
+	var as = assert.New(t)
+	var conn Conn
+	as.Zero(unsafe.Offsetof(conn.stats) % 8)
+	as.Zero(unsafe.Offsetof(conn.readCounter) % 8)
+	as.Zero((unsafe.Offsetof(conn.writeQueue) + unsafe.Offsetof(conn.writeQueue.counter)) % 8)
+}
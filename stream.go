@@ -0,0 +1,195 @@
+package gws
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/lxzan/gws/internal"
+)
+
+// StreamHandler 流式读取事件, 开启 StreamReadEnabled 后, 事件处理器实现该接口即可按帧读取数据消息
+// Stream read event. With StreamReadEnabled on, an event handler implementing it reads data messages frame by frame.
+type StreamHandler interface {
+	// OnStream 收到数据消息的第一帧时调用, r 在最后一帧(FIN)读完后返回 io.EOF
+	// 协商了压缩时 r 返回解压后的数据. 必须在返回之前读完 r, 未读取的数据会被丢弃.
+	// 消息的总长度(压缩时为解压后的长度)超过 ReadMaxPayloadSize 时 r 返回错误, 连接以 1009 状态码关闭.
+	// 该事件总是在读协程中同步执行, 不受 ParallelEnabled 影响. 开启手动解压或者使用自定义解压器时, 压缩的消息仍然通过 OnMessage 分发.
+	// Called on the first frame of a data message, r returns io.EOF after the final (FIN) frame has been read.
+	// If compression is negotiated, r returns the decompressed data. r must be consumed before returning,
+	// any unread data is discarded. If the total message length (decompressed length with compression) exceeds
+	// ReadMaxPayloadSize, r returns an error and the connection is closed with status code 1009.
+	// The event always runs synchronously on the read goroutine, regardless of ParallelEnabled.
+	// With manual decompression or a custom decompressor, compressed messages still go to OnMessage.
+	OnStream(socket *Conn, opcode Opcode, r io.Reader)
+}
+
+// 流式读取器, 依次读取一条消息的所有数据帧, 并处理穿插其中的控制帧
+// Stream reader, reads all data frames of a message in turn and handles the control frames interleaved with them
+type streamReader struct {
+	conn    *Conn
+	frames  int
+	size    int
+	remain  int
+	offset  int
+	fin     bool
+	masked  bool
+	maskKey [4]byte
+	err     error
+}
+
+// 使用当前帧头初始化读取器
+// Initializes the reader with the current frame header
+func (c *streamReader) reset(contentLength int) {
+	c.frames++
+	c.size += contentLength
+	c.remain = contentLength
+	c.offset = 0
+	c.fin = c.conn.fh.GetFIN()
+	c.masked = c.conn.fh.GetMask()
+	if c.masked {
+		copy(c.maskKey[:], c.conn.fh.GetMaskKey())
+	}
+	c.conn.statsRead(0, c.conn.fh.length()+contentLength)
+}
+
+// 读取下一个延续帧, 控制帧就地处理
+// Reads the next continuation frame, control frames are handled in place
+func (c *streamReader) next() error {
+	for {
+		contentLength, err := c.conn.readFrameHeader()
+		if err != nil {
+			return err
+		}
+		var opcode = c.conn.fh.GetOpcode()
+		if !opcode.isDataFrame() {
+			if err := c.conn.readControl(); err != nil {
+				return err
+			}
+			continue
+		}
+		if opcode != OpcodeContinuation {
+			return internal.CloseProtocolError
+		}
+		c.reset(contentLength)
+		if c.size > c.conn.config.ReadMaxPayloadSize {
+			return internal.CloseMessageTooLarge
+		}
+		return c.conn.checkFragments(c.frames)
+	}
+}
+
+// Read 读取消息内容, 读到最后一帧的结尾时返回 io.EOF
+// Reads the message payload, io.EOF is returned at the end of the final frame
+func (c *streamReader) Read(p []byte) (int, error) {
+	for c.remain == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.fin {
+			return 0, io.EOF
+		}
+		if c.err = c.next(); c.err == io.EOF {
+			c.err = io.ErrUnexpectedEOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+	}
+
+	if c.err = c.conn.resetReadDeadline(); c.err != nil {
+		return 0, c.err
+	}
+	if len(p) > c.remain {
+		p = p[:c.remain]
+	}
+	n, err := c.conn.br.Read(p)
+	if c.masked {
+		var key [4]byte
+		for i := range key {
+			key[i] = c.maskKey[(c.offset+i)&3]
+		}
+		internal.MaskXOR(p[:n], key[:])
+	}
+	c.offset += n
+	c.remain -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+		return n, err
+	}
+	return n, nil
+}
+
+// 是否以流的方式读取该消息
+// 手动解压和自定义解压器无法流式解压, 压缩的消息仍然通过 OnMessage 分发.
+// Whether the message is read as a stream.
+// Manual decompression and custom decompressors cannot decompress a stream, such compressed messages still go to OnMessage.
+func (c *Conn) streamEnabled(opcode Opcode, compressed bool) bool {
+	if c.streamHandler == nil || opcode == OpcodeContinuation || c.continuationFrame.initialized {
+		return false
+	}
+	return !compressed || (!c.config.ManualDecompression && c.decompressor == nil)
+}
+
+// 以流的方式读取消息并触发 OnStream 事件
+// Reads the message as a stream and emits the OnStream event
+func (c *Conn) readStream(opcode Opcode, contentLength int, compressed bool) error {
+	var sr = &streamReader{conn: c}
+	sr.reset(contentLength)
+
+	// 空的压缩负载不是有效的 deflate 数据, 视为空消息
+	// An empty compressed payload is not valid deflate data, it is treated as an empty message
+	if compressed && sr.fin && sr.remain == 0 {
+		compressed = false
+	}
+
+	var r io.Reader = sr
+	var lr *limitedReader
+	if compressed {
+		fr := flate.NewReaderDict(io.MultiReader(sr, bytes.NewReader(flateTail)), c.decompressDict())
+		defer fr.Close()
+		// 解压后的长度同样受 ReadMaxPayloadSize 限制, 防止很小的帧解压出大量数据
+		// The decompressed length is bounded by ReadMaxPayloadSize as well, so that a tiny frame cannot inflate into a huge one
+		lr = &limitedReader{R: fr, M: c.config.ReadMaxPayloadSize}
+		r = io.TeeReader(lr, &c.dpsWindow)
+	}
+
+	c.dispatchStream(opcode, r)
+
+	// 丢弃未读取的数据, 保持帧边界同步. 只有开启了上下文接管时才需要解压剩余的数据以维护字典, 否则直接丢弃原始帧
+	// Discard unread data to keep the frame boundaries in sync. The rest only has to be decompressed
+	// to maintain the dictionary with context takeover, otherwise the raw frames are discarded.
+	var err error
+	if compressed && c.dpsWindow.enabled {
+		_, err = io.Copy(io.Discard, r)
+	}
+	if sr.err != nil {
+		return sr.err
+	}
+	if lr != nil && lr.N > lr.M {
+		return internal.CloseMessageTooLarge
+	}
+	if err != nil {
+		if err = c.checkDecompressError(err); err != nil {
+			return err
+		}
+	}
+	if _, err = io.Copy(io.Discard, sr); err != nil {
+		return err
+	}
+	c.statsRead(1, 0)
+	return nil
+}
+
+// 分发流式消息和异常恢复
+// Dispatch stream message & Recovery
+func (c *Conn) dispatchStream(opcode Opcode, r io.Reader) {
+	var done = false
+	defer c.config.Recovery(c.config.Logger)
+	defer c.closeOnPanic(&done)
+	c.streamHandler.OnStream(c, opcode, r)
+	done = true
+}
@@ -0,0 +1,243 @@
+package gws
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+type streamMocker struct {
+	webSocketMocker
+	onStream func(socket *Conn, opcode Opcode, r io.Reader)
+}
+
+func (c *streamMocker) OnStream(socket *Conn, opcode Opcode, r io.Reader) {
+	if c.onStream != nil {
+		c.onStream(socket, opcode, r)
+	}
+}
+
+func TestConn_StreamRead(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("fragmented", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		var serverHandler = new(streamMocker)
+		serverHandler.onPing = func(socket *Conn, payload []byte) {
+			as.Equal("ping", string(payload))
+			wg.Done()
+		}
+		serverHandler.onStream = func(socket *Conn, opcode Opcode, r io.Reader) {
+			as.Equal(OpcodeBinary, opcode)
+			p, err := io.ReadAll(r)
+			as.NoError(err)
+			as.Equal("hello, world!", string(p))
+			wg.Done()
+		}
+		var option = &ServerOption{StreamReadEnabled: true}
+		server, client := newPeer(serverHandler, option, new(webSocketMocker), nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var encoder FrameEncoder
+		var frames = [][]byte{
+			encoder.EncodeClientFrame(false, false, OpcodeBinary, []byte("hello")),
+			encoder.EncodeClientFrame(true, false, OpcodePing, []byte("ping")),
+			encoder.EncodeClientFrame(false, false, OpcodeContinuation, []byte(", ")),
+			encoder.EncodeClientFrame(true, false, OpcodeContinuation, []byte("world!")),
+		}
+		go func() {
+			for _, frame := range frames {
+				_, _ = client.conn.Write(frame)
+			}
+		}()
+		wg.Wait()
+	})
+
+	t.Run("unread data is discarded", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		var serverHandler = new(streamMocker)
+		var messages []string
+		serverHandler.onStream = func(socket *Conn, opcode Opcode, r io.Reader) {
+			var p = make([]byte, 3)
+			_, _ = io.ReadFull(r, p)
+			messages = append(messages, string(p))
+			wg.Done()
+		}
+		var option = &ServerOption{StreamReadEnabled: true}
+		server, client := newPeer(serverHandler, option, new(webSocketMocker), nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(client.WriteString("abcdef"))
+		as.NoError(client.WriteString("ghijkl"))
+		wg.Wait()
+		as.Equal([]string{"abc", "ghi"}, messages)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(streamMocker)
+		serverHandler.onStream = func(socket *Conn, opcode Opcode, r io.Reader) {
+			as.Fail("unexpected stream")
+		}
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, nil, new(webSocketMocker), nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(client.WriteString("hello"))
+		wg.Wait()
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		const count = 8
+		wg.Add(count)
+		var serverHandler = new(streamMocker)
+		var received [][]byte
+		serverHandler.onStream = func(socket *Conn, opcode Opcode, r io.Reader) {
+			p, err := io.ReadAll(r)
+			as.NoError(err)
+			received = append(received, p)
+			wg.Done()
+		}
+		var pd = PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{StreamReadEnabled: true, PermessageDeflate: pd})
+		server, client, err := NewPipeConns(upgrader, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var sent [][]byte
+		for i := 0; i < count; i++ {
+			var p = bytes.Repeat(internal.AlphabetNumeric.Generate(64), 256)
+			sent = append(sent, p)
+			as.NoError(client.WriteMessage(OpcodeBinary, p))
+		}
+		wg.Wait()
+		as.Equal(sent, received)
+	})
+
+	t.Run("empty compressed frame", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		var serverHandler = new(streamMocker)
+		var received []string
+		serverHandler.onStream = func(socket *Conn, opcode Opcode, r io.Reader) {
+			p, err := io.ReadAll(r)
+			as.NoError(err)
+			received = append(received, string(p))
+			wg.Done()
+		}
+		var pd = PermessageDeflate{Enabled: true}
+		var option = &ServerOption{StreamReadEnabled: true, PermessageDeflate: pd}
+		server, client := newPeer(serverHandler, option, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var encoder FrameEncoder
+		_, _ = client.conn.Write(encoder.EncodeClientFrame(true, true, OpcodeText, nil))
+		as.NoError(client.WriteString("hello"))
+		wg.Wait()
+		as.Equal([]string{"", "hello"}, received)
+	})
+
+	t.Run("closed while streaming", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		var serverHandler = new(streamMocker)
+		serverHandler.onStream = func(socket *Conn, opcode Opcode, r io.Reader) {
+			_, err := io.ReadAll(r)
+			as.Error(err)
+			wg.Done()
+		}
+		serverHandler.onClose = func(socket *Conn, err error) {
+			wg.Done()
+		}
+		var option = &ServerOption{StreamReadEnabled: true}
+		server, client := newPeer(serverHandler, option, new(webSocketMocker), nil)
+		go server.ReadLoop()
+
+		var encoder FrameEncoder
+		go func() {
+			_, _ = client.conn.Write(encoder.EncodeClientFrame(false, false, OpcodeText, []byte("hello")))
+			_ = client.conn.Close()
+		}()
+		wg.Wait()
+	})
+
+	t.Run("payload limit", func(t *testing.T) {
+		var run = func(readAll bool, write func(client *Conn)) (messages []string, closeErr error) {
+			var pd = PermessageDeflate{Enabled: true, Threshold: 1}
+			var serverHandler = new(streamMocker)
+			var closed = make(chan struct{})
+			serverHandler.onStream = func(socket *Conn, opcode Opcode, r io.Reader) {
+				if !readAll {
+					var p = make([]byte, 5)
+					_, _ = io.ReadFull(r, p)
+					messages = append(messages, string(p))
+					return
+				}
+				if p, err := io.ReadAll(r); err == nil {
+					messages = append(messages, string(p))
+				}
+			}
+			serverHandler.onClose = func(socket *Conn, err error) {
+				closeErr = err
+				close(closed)
+			}
+			var serverOption = &ServerOption{StreamReadEnabled: true, ReadMaxPayloadSize: 1024, PermessageDeflate: pd}
+			server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+			go server.ReadLoop()
+			go client.ReadLoop()
+			write(client)
+			_ = client.WriteClose(1000, nil)
+			<-closed
+			return
+		}
+
+		// 未压缩的分片消息总长度超出上限
+		// The total length of an uncompressed fragmented message exceeds the limit
+		_, err := run(true, func(client *Conn) {
+			var encoder FrameEncoder
+			for i := 0; i < 3; i++ {
+				var opcode = internal.SelectValue(i == 0, OpcodeBinary, OpcodeContinuation)
+				_, _ = client.conn.Write(encoder.EncodeClientFrame(i == 2, false, opcode, make([]byte, 512)))
+			}
+		})
+		as.ErrorIs(err, internal.CloseMessageTooLarge)
+
+		// 很小的压缩帧解压之后超出上限
+		// A tiny compressed frame exceeds the limit once decompressed
+		_, err = run(true, func(client *Conn) {
+			_ = client.WriteMessage(OpcodeBinary, make([]byte, 256*1024))
+		})
+		as.ErrorIs(err, internal.CloseMessageTooLarge)
+
+		// 没有上下文接管时, 未读取的数据直接丢弃原始帧, 不会解压
+		// Without context takeover, unread data is discarded as raw frames without decompressing it
+		messages, err := run(false, func(client *Conn) {
+			_ = client.WriteMessage(OpcodeBinary, append([]byte("hello"), make([]byte, 256*1024)...))
+			_ = client.WriteString("world")
+		})
+		as.Equal([]string{"hello", "world"}, messages)
+		var closeErr *CloseError
+		if as.True(errors.As(err, &closeErr)) {
+			as.Equal(CloseNormalClosure, closeErr.Code)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package gws
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/lxzan/gws/internal"
 )
@@ -10,13 +11,17 @@ type (
 	// 任务队列
 	// Task queue
 	workerQueue struct {
+		// counter 已执行和被丢弃的任务数量. 必须是第一个字段, 以保证 32 位平台上 64 位原子操作的对齐
+		// number of processed and dropped jobs. It must be the first field to keep 64-bit atomic operations aligned on 32-bit platforms
+		counter queueCounter
+
 		// mu 互斥锁
 		// mutex
 		mu sync.Mutex
 
 		// q 双端队列，用于存储异步任务
 		// double-ended queue to store asynchronous jobs
-		q internal.Deque[asyncJob]
+		q internal.Deque[queuedJob]
 
 		// maxConcurrency 最大并发数
 		// maximum concurrency
@@ -25,11 +30,33 @@ type (
 		// curConcurrency 当前并发数
 		// current concurrency
 		curConcurrency int32
+
+		// capacity 等待执行的任务数量上限, 0表示不限制
+		// maximum number of pending jobs, 0 means unlimited
+		capacity int
+
+		// policy 队列已满时的处理策略
+		// policy applied when the queue is full
+		policy QueueFullPolicy
+	}
+
+	// 任务队列计数器, 使用原子操作更新. 在 32 位平台上必须位于 64 位对齐的地址
+	// Task queue counter, updated with atomic operations. On 32-bit platforms it must sit at a 64-bit aligned address.
+	queueCounter struct {
+		processed int64
+		dropped   int64
 	}
 
 	// 异步任务
 	// Asynchronous job
 	asyncJob func()
+
+	// 队列中的任务, drop 在任务被 QueueFullDropOldest 策略丢弃时调用, 可以为空
+	// Job in the queue, drop is called if the job is evicted by the QueueFullDropOldest policy and may be nil
+	queuedJob struct {
+		run  asyncJob
+		drop asyncJob
+	}
 )
 
 // 创建一个任务队列
@@ -43,25 +70,50 @@ func newWorkerQueue(maxConcurrency int32) *workerQueue {
 	return c
 }
 
+// 创建连接的发送队列, 并发度为1
+// Creates the write queue of a connection, with concurrency 1
+func newWriteQueue(config *Config) workerQueue {
+	return workerQueue{
+		maxConcurrency: 1,
+		capacity:       config.WriteQueueCapacity,
+		policy:         config.QueueFullPolicy,
+	}
+}
+
+// Len 返回等待执行的任务数量
+// Returns the number of pending jobs
+func (c *workerQueue) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.q.Len()
+}
+
+// Stats 返回任务队列的统计信息
+// Returns the statistics of the task queue
+func (c *workerQueue) Stats() QueueStats {
+	return QueueStats{
+		Pending:   c.Len(),
+		Processed: atomic.LoadInt64(&c.counter.processed),
+		Dropped:   atomic.LoadInt64(&c.counter.dropped),
+	}
+}
+
 // 获取一个任务
 // Retrieves a job from the worker queue
-func (c *workerQueue) getJob(newJob asyncJob, delta int32) asyncJob {
+func (c *workerQueue) getJob(delta int32) asyncJob {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if newJob != nil {
-		c.q.PushBack(newJob)
-	}
 	c.curConcurrency += delta
 	if c.curConcurrency >= c.maxConcurrency {
 		return nil
 	}
 	var job = c.q.PopFront()
-	if job == nil {
+	if job.run == nil {
 		return nil
 	}
 	c.curConcurrency++
-	return job
+	return job.run
 }
 
 // 循环执行任务
@@ -69,16 +121,57 @@ func (c *workerQueue) getJob(newJob asyncJob, delta int32) asyncJob {
 func (c *workerQueue) do(job asyncJob) {
 	for job != nil {
 		job()
-		job = c.getJob(nil, -1)
+		atomic.AddInt64(&c.counter.processed, 1)
+		job = c.getJob(-1)
 	}
 }
 
 // Push 追加任务, 有资源空闲的话会立即执行
-// Adds a job to the queue and executes it immediately if resources are available
-func (c *workerQueue) Push(job asyncJob) {
-	if nextJob := c.getJob(job, 0); nextJob != nil {
+// 队列已满时, 除 QueueFullDropOldest 策略外都会拒绝任务并返回 false
+// Adds a job to the queue and executes it immediately if resources are available.
+// When the queue is full, the job is rejected and false is returned unless the policy is QueueFullDropOldest.
+func (c *workerQueue) Push(job asyncJob) bool {
+	return c.PushDroppable(job, nil)
+}
+
+// PushDroppable 类似 Push, 区别是任务被 QueueFullDropOldest 策略丢弃时会在调用 Push 的协程中调用 drop, 以通知任务的所有者
+// Like Push, except that drop is called on the goroutine calling Push if the job is evicted
+// by the QueueFullDropOldest policy, so that the owner of the job is notified
+func (c *workerQueue) PushDroppable(job asyncJob, drop asyncJob) bool {
+	return c.push(queuedJob{run: job, drop: drop}, c.policy == QueueFullDropOldest)
+}
+
+// TryPush 追加任务, 队列已满时总是拒绝任务并返回 false, 不受 QueueFullPolicy 影响
+// Adds a job to the queue, always rejects it and returns false when the queue is full, regardless of QueueFullPolicy
+func (c *workerQueue) TryPush(job asyncJob) bool {
+	return c.push(queuedJob{run: job}, false)
+}
+
+// 追加任务, 队列已满时 evict 为 true 则丢弃最旧的任务并调用它的 drop, 否则拒绝新任务
+// Adds a job, when the queue is full the oldest job is evicted and its drop is called if evict is true,
+// otherwise the new job is rejected
+func (c *workerQueue) push(job queuedJob, evict bool) bool {
+	var evicted queuedJob
+	c.mu.Lock()
+	if c.capacity > 0 && c.q.Len() >= c.capacity {
+		atomic.AddInt64(&c.counter.dropped, 1)
+		if !evict {
+			c.mu.Unlock()
+			return false
+		}
+		evicted = c.q.PopFront()
+	}
+	c.q.PushBack(job)
+	c.mu.Unlock()
+
+	if evicted.drop != nil {
+		evicted.drop()
+	}
+
+	if nextJob := c.getJob(0); nextJob != nil {
 		go c.do(nextJob)
 	}
+	return true
 }
 
 type channel chan struct{}
@@ -87,6 +180,17 @@ func (c channel) add() { c <- struct{}{} }
 
 func (c channel) done() { <-c }
 
+// 等待所有已分发的任务执行完毕, 期间占满所有并发额度, 不会有新任务开始执行
+// Waits until all dispatched jobs have finished, holding every concurrency slot meanwhile so that no new job starts
+func (c channel) wait() {
+	for i := 0; i < cap(c); i++ {
+		c.add()
+	}
+	for i := 0; i < cap(c); i++ {
+		c.done()
+	}
+}
+
 func (c channel) Go(m *Message, f func(*Message) error) error {
 	c.add()
 	go func() {
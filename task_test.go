@@ -2,8 +2,11 @@ package gws
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -34,7 +37,8 @@ func serveWebSocket(
 		fh:          frameHeader{},
 		handler:     handler,
 		subprotocol: subprotocol,
-		writeQueue:  workerQueue{maxConcurrency: 1},
+		writeQueue:  newWriteQueue(config),
+		limiter:     newRateLimiter(config.WriteRateLimit),
 		readQueue:   make(channel, 8),
 		pd:          pd,
 	}
@@ -50,6 +54,7 @@ func serveWebSocket(
 		} else {
 			socket.deflater = new(deflater).initialize(false, pd, config.ReadMaxPayloadSize)
 		}
+		socket.presetDictionary()
 	}
 	return socket
 }
@@ -208,6 +213,52 @@ func TestConn_WriteAsync(t *testing.T) {
 
 		wg.Wait()
 	})
+
+	t.Run("callback", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{}
+		var clientOption = &ClientOption{}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var errs = make(chan error, 1)
+		server.WriteAsync(OpcodeText, []byte("hello"), func(err error) { errs <- err })
+		as.NoError(<-errs)
+
+		_ = server.WriteClose(1000, nil)
+		server.WriteAsync(OpcodeText, []byte("hello"), func(err error) { errs <- err })
+		as.ErrorIs(<-errs, ErrConnClosed)
+	})
+
+	// 写入不依赖 ReadLoop
+	t.Run("before read loop", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+
+		var list []string
+		var wg sync.WaitGroup
+		wg.Add(3)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			list = append(list, message.Data.String())
+			wg.Done()
+		}
+		go client.ReadLoop()
+
+		var errs = make(chan error, 2)
+		server.WriteAsync(OpcodeText, []byte("a"), func(err error) { errs <- err })
+		server.WriteAsync(OpcodeText, []byte("b"), func(err error) { errs <- err })
+		as.NoError(<-errs)
+		as.NoError(<-errs)
+		as.NoError(server.WriteString("c"))
+		wg.Wait()
+		as.Equal([]string{"a", "b", "c"}, list)
+
+		go server.ReadLoop()
+		as.NoError(client.WriteString("ping"))
+	})
 }
 
 // 测试异步读
@@ -395,3 +446,271 @@ func TestRQueue(t *testing.T) {
 		<-done
 	})
 }
+
+func TestWorkerQueue_Capacity(t *testing.T) {
+	var as = assert.New(t)
+
+	var run = func(policy QueueFullPolicy) (q *workerQueue, accepted []bool, executed []int) {
+		q = &workerQueue{maxConcurrency: 1, capacity: 2, policy: policy}
+		var mu = &sync.Mutex{}
+		var wg = &sync.WaitGroup{}
+		var block = make(chan struct{})
+		var started = make(chan struct{})
+		wg.Add(1)
+		q.Push(func() {
+			close(started)
+			<-block
+			wg.Done()
+		})
+		<-started
+		for i := 1; i <= 3; i++ {
+			v := i
+			ok := q.Push(func() {
+				mu.Lock()
+				executed = append(executed, v)
+				mu.Unlock()
+				wg.Done()
+			})
+			if ok {
+				wg.Add(1)
+			}
+			accepted = append(accepted, ok)
+		}
+		as.Equal(QueueStats{Pending: 2, Processed: 0, Dropped: 1}, q.Stats())
+		if policy == QueueFullDropOldest {
+			wg.Add(-1)
+		}
+		close(block)
+		wg.Wait()
+		return
+	}
+
+	var processed = func(q *workerQueue, n int64) func() bool {
+		return func() bool { return q.Stats().Processed == n }
+	}
+
+	t.Run("drop newest", func(t *testing.T) {
+		q, accepted, executed := run(QueueFullDropNewest)
+		as.Equal([]bool{true, true, false}, accepted)
+		as.Equal([]int{1, 2}, executed)
+		as.Eventually(processed(q, 3), time.Second, time.Millisecond)
+		as.Equal(QueueStats{Pending: 0, Processed: 3, Dropped: 1}, q.Stats())
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		q, accepted, executed := run(QueueFullDropOldest)
+		as.Equal([]bool{true, true, true}, accepted)
+		as.Equal([]int{2, 3}, executed)
+		as.Eventually(processed(q, 3), time.Second, time.Millisecond)
+		as.Equal(QueueStats{Pending: 0, Processed: 3, Dropped: 1}, q.Stats())
+	})
+
+	t.Run("try push", func(t *testing.T) {
+		var q = &workerQueue{maxConcurrency: 1, capacity: 1, policy: QueueFullDropOldest}
+		var block = make(chan struct{})
+		var started = make(chan struct{})
+		as.True(q.TryPush(func() {
+			close(started)
+			<-block
+		}))
+		<-started
+		as.True(q.TryPush(func() {}))
+		as.False(q.TryPush(func() {}))
+		as.Equal(QueueStats{Pending: 1, Processed: 0, Dropped: 1}, q.Stats())
+		close(block)
+		as.Eventually(processed(q, 2), time.Second, time.Millisecond)
+	})
+}
+
+func TestConn_QueueFullPolicy(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("drop newest", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{WriteQueueCapacity: 1}
+		var clientOption = &ClientOption{}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+
+		var errs = make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			server.WriteAsync(OpcodeText, []byte("hello"), func(err error) { errs <- err })
+		}
+		as.ErrorIs(<-errs, ErrQueueFull)
+		go client.ReadLoop()
+		as.NoError(<-errs)
+		as.NoError(<-errs)
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var messages = make(chan string, 4)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			messages <- message.Data.String()
+		}
+		var serverOption = &ServerOption{WriteQueueCapacity: 1, QueueFullPolicy: QueueFullDropOldest}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+
+		// 第一个任务阻塞在写入上, 之后的任务依次挤掉前一个, 被挤掉的回调收到 ErrQueueFull
+		// The first job blocks on writing, each later job evicts the previous one, whose callback receives ErrQueueFull
+		var errs = make([]chan error, 3)
+		for i := range errs {
+			errs[i] = make(chan error, 1)
+			var ch = errs[i]
+			server.WriteAsync(OpcodeText, []byte(strconv.Itoa(i)), func(err error) { ch <- err })
+		}
+		var broadcaster = NewBroadcaster(OpcodeText, []byte("broadcast"))
+		as.NoError(broadcaster.Broadcast(server))
+		as.ErrorIs(<-errs[1], ErrQueueFull)
+		as.ErrorIs(<-errs[2], ErrQueueFull)
+
+		// 被挤掉的广播同样结束, 关闭之后资源被释放
+		// The evicted broadcast ends as well, so the resources are released on close
+		server.WriteAsync(OpcodeText, []byte("3"), nil)
+		as.Equal(int64(math.MaxInt32), atomic.LoadInt64(&broadcaster.state))
+		as.NoError(broadcaster.Close())
+		as.Equal(int64(0), atomic.LoadInt64(&broadcaster.state))
+
+		go client.ReadLoop()
+		as.NoError(<-errs[0])
+		as.Equal("0", <-messages)
+		as.Equal("3", <-messages)
+		_ = server.WriteClose(1000, nil)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{WriteQueueCapacity: 1, QueueFullPolicy: QueueFullClose}
+		var clientOption = &ClientOption{}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(internal.CloseTryAgainLater.Uint16(), closeErr.Code)
+			}
+			wg.Done()
+		}
+		for i := 0; i < 3; i++ {
+			server.WriteAsync(OpcodeText, []byte("hello"), nil)
+		}
+		go client.ReadLoop()
+		wg.Wait()
+	})
+}
+
+func TestConn_TryWriteAsync(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{WriteQueueCapacity: 1, QueueFullPolicy: QueueFullClose, CheckUtf8Enabled: true}
+	var messages = make(chan string, 3)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+
+	// 第一个任务阻塞在写入上, 第二个任务占满队列
+	// The first job blocks on writing, the second one fills the queue
+	for _, s := range []string{"a", "b"} {
+		ok, err := server.TryWriteAsync(OpcodeText, []byte(s))
+		as.True(ok)
+		as.NoError(err)
+	}
+	ok, err := server.TryWriteAsync(OpcodeText, []byte("c"))
+	as.False(ok)
+	as.NoError(err)
+
+	ok, err = server.TryWriteAsync(OpcodeText, []byte{0xff})
+	as.False(ok)
+	as.ErrorIs(err, ErrTextEncoding)
+
+	go client.ReadLoop()
+	as.Equal("a", <-messages)
+	as.Equal("b", <-messages)
+	as.False(server.IsClosed())
+
+	_ = server.WriteClose(1000, nil)
+	ok, err = server.TryWriteAsync(OpcodeText, []byte("d"))
+	as.False(ok)
+	as.ErrorIs(err, ErrConnClosed)
+}
+
+type writeCounter struct {
+	net.Conn
+	writes int64
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+func TestConn_WriteBatchSize(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var messages = make(chan string, 32)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	server, client := newPeer(serverHandler, &ServerOption{WriteBatchSize: 8}, clientHandler, &ClientOption{})
+	var counter = &writeCounter{Conn: server.conn}
+	server.conn = counter
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	// 单条消息在队列为空时立即写出
+	// A lone message is written as soon as the queue is empty
+	server.WriteAsync(OpcodeText, []byte("lone"), nil)
+	as.Equal("lone", <-messages)
+	as.Equal(int64(1), atomic.LoadInt64(&counter.writes))
+
+	// 先阻塞发送队列, 让20条消息排队, 它们会合并为 8+8+4 三次写入
+	// Block the write queue first so that 20 messages queue up, they are coalesced into 8+8+4, i.e. three writes
+	var release = make(chan struct{})
+	server.Async(func() { <-release })
+	for i := 0; i < 20; i++ {
+		server.WriteAsync(OpcodeText, []byte(strconv.Itoa(i)), nil)
+	}
+	close(release)
+	for i := 0; i < 20; i++ {
+		as.Equal(strconv.Itoa(i), <-messages)
+	}
+	as.Equal(int64(4), atomic.LoadInt64(&counter.writes))
+
+	// 同步写入会带走缓冲区中的帧, 保持顺序
+	// A synchronous write takes the buffered frames with it and keeps the order
+	as.NoError(server.WriteString("sync"))
+	as.Equal("sync", <-messages)
+
+	// 队列不为空时帧留在缓冲区中, Flush 立即写出它们
+	// Frames stay buffered while the queue is not empty, Flush writes them out right away
+	var done = make(chan struct{})
+	release = make(chan struct{})
+	server.Async(func() { <-release })
+	for i := 0; i < 3; i++ {
+		server.WriteAsync(OpcodeText, []byte(strconv.Itoa(i)), nil)
+	}
+	server.Async(func() {
+		as.Equal(3, server.wbatch.frames)
+		as.NoError(server.Flush())
+		as.Equal(0, server.wbatch.frames)
+		for i := 0; i < 3; i++ {
+			as.Equal(strconv.Itoa(i), <-messages)
+		}
+		close(done)
+	})
+	close(release)
+	<-done
+	_ = server.WriteClose(1000, nil)
+	as.ErrorIs(server.Flush(), ErrConnClosed)
+}
@@ -3,12 +3,15 @@ package gws
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"runtime"
+	"strings"
 	"unsafe"
 
 	"github.com/lxzan/gws/internal"
@@ -34,6 +37,32 @@ func (c Opcode) isDataFrame() bool {
 	return c <= OpcodeBinary
 }
 
+// 常用的关闭状态码, 可用于 WriteClose 和 CloseError
+// Common close status codes, usable with WriteClose and CloseError
+// https://www.rfc-editor.org/rfc/rfc6455.html#section-7.4.1
+const (
+	CloseNormalClosure   uint16 = 1000 // 正常关闭 / normal closure
+	CloseGoingAway       uint16 = 1001 // 终端离开 / endpoint going away
+	CloseProtocolError   uint16 = 1002 // 协议错误 / protocol error
+	CloseUnsupported     uint16 = 1003 // 不支持的数据类型 / unsupported data type
+	CloseUnsupportedData uint16 = 1007 // 数据格式错误 / invalid payload data
+	ClosePolicyViolation uint16 = 1008 // 违反约定 / policy violation
+	CloseMessageTooLarge uint16 = 1009 // 消息过大 / message too large
+	CloseInternalErr     uint16 = 1011 // 内部错误 / internal error
+
+	// 以下两个保留状态码只会通过 OnClose 报告, 不会出现在网络上
+	// The following two reserved codes are only reported to OnClose and never appear on the wire
+	CloseNoStatusReceived uint16 = 1005 // 关闭帧没有状态码 / close frame without status code
+	CloseAbnormalClosure  uint16 = 1006 // 没有收到关闭帧连接就断开了 / connection dropped without close frame
+)
+
+// CloseError 关闭错误, 对端发送关闭帧时 OnClose 收到的错误; 也可以通过 WriteCloseError 发送
+// 关闭帧没有状态码时 Code 为 CloseNoStatusReceived(1005); 没有收到关闭帧连接就断开时 Code 为 CloseAbnormalClosure(1006),
+// 此时可以通过 errors.Is/As 检查底层的读取错误, 例如 io.EOF.
+// Close error, received by OnClose when the peer sends a close frame; it can also be sent with WriteCloseError.
+// Code is CloseNoStatusReceived (1005) if the close frame carries no status code, and CloseAbnormalClosure (1006)
+// if the connection dropped without a close frame, in which case the underlying read error, e.g. io.EOF,
+// can be inspected with errors.Is/As.
 type CloseError struct {
 	// 关闭代码，表示关闭连接的原因
 	// Close code, indicating the reason for closing the connection
@@ -42,14 +71,91 @@ type CloseError struct {
 	// 关闭原因，详细描述关闭的原因
 	// Close reason, providing a detailed description of the closure
 	Reason []byte
+
+	// 连接异常断开时的底层错误
+	// Underlying error when the connection dropped abnormally
+	err error
 }
 
 // Error 关闭错误的描述
 // Returns a description of the close error
 func (c *CloseError) Error() string {
+	if c.err != nil {
+		return fmt.Sprintf("gws: connection closed, code=%d, reason=%s: %v", c.Code, string(c.Reason), c.err)
+	}
 	return fmt.Sprintf("gws: connection closed, code=%d, reason=%s", c.Code, string(c.Reason))
 }
 
+// Unwrap 返回连接异常断开时的底层错误
+// Returns the underlying error when the connection dropped abnormally
+func (c *CloseError) Unwrap() error {
+	return c.err
+}
+
+// VersionError 不支持的 WebSocket 协议版本, 携带客户端请求的版本号
+// 可以通过 errors.Is(err, ErrUnsupportedVersion) 判断
+// Unsupported WebSocket protocol version, carrying the version requested by the client.
+// It matches errors.Is(err, ErrUnsupportedVersion).
+type VersionError struct {
+	version string
+}
+
+// Error 版本错误的描述
+// Returns a description of the version error
+func (c *VersionError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrUnsupportedVersion.Error(), c.version)
+}
+
+// Version 返回客户端请求的版本号
+// Returns the version requested by the client
+func (c *VersionError) Version() string { return c.version }
+
+// Unwrap 返回 ErrUnsupportedVersion
+// Returns ErrUnsupportedVersion
+func (c *VersionError) Unwrap() error { return ErrUnsupportedVersion }
+
+// HandshakeErrors 开启 VerboseHandshakeErrors 后, 握手请求未通过的所有校验项
+// 任意一项匹配时 errors.Is / errors.As 即匹配
+// All failed checks of a handshake request when VerboseHandshakeErrors is enabled.
+// errors.Is / errors.As match if any of the errors matches.
+type HandshakeErrors []error
+
+// Error 以分号连接所有错误的描述
+// Joins the descriptions of all errors with semicolons
+func (c HandshakeErrors) Error() string {
+	var list = make([]string, 0, len(c))
+	for _, err := range c {
+		list = append(list, err.Error())
+	}
+	return strings.Join(list, "; ")
+}
+
+// Is 任意一项错误匹配 target 时返回 true
+// Reports whether any of the errors matches target
+func (c HandshakeErrors) Is(target error) bool {
+	for _, err := range c {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As 在错误列表中查找第一个可以赋值给 target 的错误
+// Finds the first error in the list that can be assigned to target
+func (c HandshakeErrors) As(target any) bool {
+	for _, err := range c {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap 返回所有错误
+// Returns all errors
+func (c HandshakeErrors) Unwrap() []error { return c }
+
 var (
 	errEmpty = errors.New("")
 
@@ -57,10 +163,24 @@ var (
 	// Failure to pass forensic authentication
 	ErrUnauthorized = errors.New("unauthorized")
 
+	// ErrTooManyConnections 连接数已达到 MaxConcurrentConnections 上限
+	// The number of connections has reached the MaxConcurrentConnections limit
+	ErrTooManyConnections = errors.New("too many connections")
+
 	// ErrHandshake 握手错误, 请求头未通过校验
 	// Handshake error, request header does not pass checksum.
 	ErrHandshake = errors.New("handshake error")
 
+	// ErrBadMethod 握手请求的方法不是 GET, 可以通过 errors.Is(err, ErrHandshake) 判断
+	// The handshake request method is not GET, it also matches errors.Is(err, ErrHandshake)
+	ErrBadMethod = fmt.Errorf("%w: http method must be GET", ErrHandshake)
+
+	errBadConnection = fmt.Errorf("%w: Connection header must contain Upgrade", ErrHandshake)
+
+	errBadUpgrade = fmt.Errorf("%w: Upgrade header must be websocket", ErrHandshake)
+
+	errMissingKey = fmt.Errorf("%w: missing Sec-WebSocket-Key header", ErrHandshake)
+
 	// ErrCompressionNegotiation 压缩拓展协商失败, 请尝试关闭压缩
 	// Compression extension negotiation failed, please try to disable compression.
 	ErrCompressionNegotiation = errors.New("invalid compression negotiation")
@@ -84,6 +204,51 @@ var (
 	// ErrUnsupportedProtocol 不支持的网络协议
 	// Unsupported network protocols
 	ErrUnsupportedProtocol = errors.New("unsupported protocol")
+
+	// ErrPingTimeout 心跳超时, 没有按时收到 Pong 帧
+	// Ping timeout, no pong frame was received in time
+	ErrPingTimeout = errors.New("ping timeout")
+
+	// ErrReadTimeout 读超时, 超过 ReadTimeout 没有收到任何帧
+	// Read timeout, no frame was received within ReadTimeout
+	ErrReadTimeout = errors.New("read timeout")
+
+	// ErrUnsupportedVersion 不支持的 WebSocket 协议版本, 服务端只支持 13
+	// Unsupported WebSocket protocol version, only 13 is supported by the server
+	ErrUnsupportedVersion = errors.New("websocket version not supported")
+
+	// ErrQueueFull 发送队列已满, 消息被拒绝
+	// The write queue is full and the message was rejected
+	ErrQueueFull = errors.New("write queue is full")
+
+	// ErrCompressionLevel 无效的压缩级别
+	// Invalid compression level
+	ErrCompressionLevel = errors.New("invalid compression level")
+
+	// ErrHandlerPanic 事件回调发生了 panic, 连接以 1011 状态码关闭
+	// An event callback panicked, the connection is closed with status code 1011
+	ErrHandlerPanic = errors.New("event handler panic")
+)
+
+// QueueFullPolicy 发送队列已满时的处理策略
+// Policy applied when the write queue is full
+type QueueFullPolicy uint8
+
+const (
+	// QueueFullDropNewest 拒绝新任务, 异步写入的回调会收到 ErrQueueFull
+	// Rejects the new job, the callback of the asynchronous write receives ErrQueueFull
+	QueueFullDropNewest QueueFullPolicy = iota
+
+	// QueueFullDropOldest 丢弃队首(最早)的等待任务, 被丢弃的任务不会执行
+	// 被丢弃的异步写入会在入队新任务的协程中收到 ErrQueueFull 回调, 此后可以回收它的 payload. Async 的任务被丢弃时没有通知.
+	// Drops the oldest pending job, the dropped job is never run.
+	// The callback of a dropped asynchronous write receives ErrQueueFull on the goroutine queuing the new job,
+	// its payload can be recycled afterwards. Jobs added through Async are dropped without notice.
+	QueueFullDropOldest
+
+	// QueueFullClose 拒绝新任务并以 1013 (try again later) 关闭连接
+	// Rejects the new job and closes the connection with 1013 (try again later)
+	QueueFullClose
 )
 
 type Event interface {
@@ -96,6 +261,11 @@ type Event interface {
 	// 如果是前者, err可以断言为*CloseError
 	// Received a close frame from the other end of the network connection, or disconnected voluntarily due to an error in the IO process
 	// In the former case, err can be asserted as *CloseError
+	// 调用时所有已经读取的消息都已处理完毕(包括 ParallelEnabled 时并行执行的 OnMessage), 之后不会再有 OnMessage;
+	// 发送队列中尚未执行的写入不会再发送, 执行时返回 ErrConnClosed 并通过回调通知.
+	// When it is called, every message already read has been handled (including OnMessage calls running in parallel
+	// with ParallelEnabled) and no further OnMessage follows; writes still pending in the write queue are not sent,
+	// they fail with ErrConnClosed when they run and their callbacks are notified.
 	OnClose(socket *Conn, err error)
 
 	// OnPing 心跳探测事件
@@ -112,6 +282,17 @@ type Event interface {
 	OnMessage(socket *Conn, message *Message)
 }
 
+// MessageHeaderHandler 消息头事件, 事件处理器实现该接口即可在缓存消息之前决定是否接收它
+// Message header event, an event handler implementing it decides whether to accept a message before it is buffered
+type MessageHeaderHandler interface {
+	// OnMessageHeader 解析完数据消息第一帧的帧头后调用, declaredLen 是第一帧的负载长度
+	// 分片消息只包含第一个分片的长度, 压缩消息为压缩后的长度. 返回 false 时以 1009 状态码关闭连接.
+	// Called after the header of the first frame of a data message is parsed, declaredLen is the payload length of that frame.
+	// It is only the length of the first fragment for fragmented messages, and the compressed length for compressed messages.
+	// Returning false closes the connection with status code 1009.
+	OnMessageHeader(socket *Conn, opcode Opcode, declaredLen int) bool
+}
+
 type BuiltinEventHandler struct{}
 
 func (b BuiltinEventHandler) OnOpen(socket *Conn) {}
@@ -150,6 +331,12 @@ func (c *frameHeader) GetRSV3() bool {
 	return ((*c)[0] << 3 >> 7) == 1
 }
 
+// 返回 RSV2 和 RSV3 位
+// Returns the RSV2 and RSV3 bits
+func (c *frameHeader) getExtensionRSV() RSVBit {
+	return RSVBit((*c)[0]) & (RSV2 | RSV3)
+}
+
 // GetOpcode 返回操作码
 // Returns the opcode
 func (c *frameHeader) GetOpcode() Opcode {
@@ -215,8 +402,8 @@ func (c *frameHeader) GenerateHeader(isServer bool, fin bool, compress bool, opc
 
 	if !isServer {
 		(*c)[1] |= 128
-		maskNum := internal.AlphabetNumeric.Uint32()
-		binary.LittleEndian.PutUint32((*c)[headerLength:headerLength+4], maskNum)
+		maskKey := newMaskKey()
+		copy((*c)[headerLength:headerLength+4], maskKey[:])
 		maskBytes = (*c)[headerLength : headerLength+4]
 		headerLength += 4
 	}
@@ -224,7 +411,10 @@ func (c *frameHeader) GenerateHeader(isServer bool, fin bool, compress bool, opc
 }
 
 // Parse 解析完整协议头, 最多14字节, 返回payload长度
-// Parses the complete protocol header, up to 14 bytes, and returns the payload length
+// 只有读取到扩展长度和掩码的全部字节后才会解释它们, 前两个字节之后的截断返回 io.ErrUnexpectedEOF
+// Parses the complete protocol header, up to 14 bytes, and returns the payload length.
+// The extended length and the mask are only interpreted once all their bytes have been read,
+// a truncation after the first two bytes returns io.ErrUnexpectedEOF.
 func (c *frameHeader) Parse(reader io.Reader) (int, error) {
 	if err := internal.ReadN(reader, (*c)[0:2]); err != nil {
 		return 0, err
@@ -234,23 +424,32 @@ func (c *frameHeader) Parse(reader io.Reader) (int, error) {
 	var lengthCode = c.GetLengthCode()
 	switch lengthCode {
 	case 126:
-		if err := internal.ReadN(reader, (*c)[2:4]); err != nil {
+		if err := readHeaderN(reader, (*c)[2:4]); err != nil {
 			return 0, err
 		}
 		payloadLength = int(binary.BigEndian.Uint16((*c)[2:4]))
 
 	case 127:
-		if err := internal.ReadN(reader, (*c)[2:10]); err != nil {
+		if err := readHeaderN(reader, (*c)[2:10]); err != nil {
 			return 0, err
 		}
-		payloadLength = int(binary.BigEndian.Uint64((*c)[2:10]))
+		// RFC6455: 64位长度的最高有效位必须为 0
+		// RFC6455: The most significant bit of the 64-bit length MUST be 0
+		var length = binary.BigEndian.Uint64((*c)[2:10])
+		if length > math.MaxInt64 {
+			return 0, internal.CloseProtocolError
+		}
+		if length > math.MaxInt {
+			return 0, internal.CloseMessageTooLarge
+		}
+		payloadLength = int(length)
 	default:
 		payloadLength = int(lengthCode)
 	}
 
 	var maskOn = c.GetMask()
 	if maskOn {
-		if err := internal.ReadN(reader, (*c)[10:14]); err != nil {
+		if err := readHeaderN(reader, (*c)[10:14]); err != nil {
 			return 0, err
 		}
 	}
@@ -258,6 +457,32 @@ func (c *frameHeader) Parse(reader io.Reader) (int, error) {
 	return payloadLength, nil
 }
 
+// 读取帧头剩余的部分, 此时帧头已经开始, io.EOF 意味着帧头被截断
+// Reads the rest of the frame header. The header has already started, so io.EOF means it was truncated.
+func readHeaderN(reader io.Reader, data []byte) error {
+	var err = internal.ReadN(reader, data)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// 返回帧头的实际长度
+// Returns the actual length of the frame header
+func (c *frameHeader) length() int {
+	var n = 2
+	switch c.GetLengthCode() {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if c.GetMask() {
+		n += 4
+	}
+	return n
+}
+
 // GetMaskKey 返回掩码
 // Returns the mask
 func (c *frameHeader) GetMaskKey() []byte {
@@ -269,30 +494,108 @@ type Message struct {
 	// if the message is compressed
 	compressed bool
 
+	// 第一帧设置的自定义扩展保留位
+	// Custom extension reserved bits set on the first frame
+	rsv RSVBit
+
+	// 延迟拼接的分片, 合并到 Data 之后为 nil
+	// Lazily reassembled fragments, nil once merged into Data
+	fragments []*bytes.Buffer
+
 	// 操作码
 	// opcode of the message
 	Opcode Opcode
 
 	// 消息内容
-	// content of the message
+	// 缓冲区来自内存池, 调用 Close 之后会被回收复用, 需要在 OnMessage 返回后保留内容时请使用 Bytes
+	// 开启 LazyReassembly 时, 分片消息的 Data 为 nil, 直到调用 Bytes 或 Bind 合并分片, 请使用 Read 读取内容
+	// content of the message.
+	// The buffer comes from a memory pool and is recycled by Close,
+	// use Bytes to keep the content after OnMessage returns.
+	// With LazyReassembly enabled, Data of a fragmented message is nil until Bytes or Bind merges the fragments,
+	// use Read to consume the content.
 	Data *bytes.Buffer
 }
 
-// Read 从消息中读取数据到给定的字节切片 p 中
-// Reads data from the message into the given byte slice p
+// Read 从消息中读取数据到给定的字节切片 p 中, 延迟拼接的消息依次读取各个分片
+// Reads data from the message into the given byte slice p, a lazily reassembled message is read fragment by fragment
 func (c *Message) Read(p []byte) (n int, err error) {
-	return c.Data.Read(p)
+	if c.fragments == nil {
+		return c.Data.Read(p)
+	}
+	for len(c.fragments) > 0 && c.fragments[0].Len() == 0 {
+		binaryPool.Put(c.fragments[0])
+		c.fragments = c.fragments[1:]
+	}
+	if len(c.fragments) == 0 {
+		return 0, io.EOF
+	}
+	return c.fragments[0].Read(p)
 }
 
-// Bytes 返回消息的数据缓冲区的字节切片
-// Returns the byte slice of the message's data buffer
+// 将延迟拼接的分片中未读取的部分合并到 Data 中
+// Merges the unread part of the lazily reassembled fragments into Data
+func (c *Message) materialize() {
+	if c.fragments == nil {
+		return
+	}
+	var buf = binaryPool.Get(c.Len())
+	for _, item := range c.fragments {
+		buf.Write(item.Bytes())
+		binaryPool.Put(item)
+	}
+	c.fragments = nil
+	c.Data = buf
+}
+
+// Bytes 返回消息内容的副本, 不受 Close 和内存池复用的影响, 可以安全地保存
+// 不需要保留内容时, 直接使用 Data.Bytes() 可以避免复制. 延迟拼接的消息会先合并到 Data 中.
+// Returns a copy of the message content, which is not affected by Close or buffer reuse and is safe to keep.
+// Use Data.Bytes() to avoid the copy if the content does not need to be kept.
+// A lazily reassembled message is merged into Data first.
 func (c *Message) Bytes() []byte {
-	return c.Data.Bytes()
+	c.materialize()
+	var b = make([]byte, c.Data.Len())
+	copy(b, c.Data.Bytes())
+	return b
+}
+
+// Len 返回消息内容(未读部分)的长度, 消息关闭后返回 0
+// Returns the length of the (unread) message content, 0 after the message is closed
+func (c *Message) Len() int {
+	if c.fragments != nil {
+		var n = 0
+		for _, item := range c.fragments {
+			n += item.Len()
+		}
+		return n
+	}
+	if c.Data == nil {
+		return 0
+	}
+	return c.Data.Len()
+}
+
+// Compressed 返回消息内容是否仍处于压缩状态, 只有开启 ManualDecompression 时才可能为 true
+// Reports whether the message content is still compressed, which is only possible with ManualDecompression enabled
+func (c *Message) Compressed() bool {
+	return c.compressed
+}
+
+// Bind 将消息内容作为JSON解码到 v 中, 延迟拼接的消息会先合并到 Data 中
+// Decodes the message content as JSON into v, a lazily reassembled message is merged into Data first
+func (c *Message) Bind(v any) error {
+	c.materialize()
+	return json.Unmarshal(c.Data.Bytes(), v)
 }
 
 // Close 关闭消息, 回收资源
 // Close message, recycling resources
 func (c *Message) Close() error {
+	for _, item := range c.fragments {
+		binaryPool.Put(item)
+	}
+	c.fragments = nil
 	binaryPool.Put(c.Data)
 	c.Data = nil
 	return nil
@@ -307,6 +610,10 @@ type continuationFrame struct {
 	// Indicates if the frame is compressed
 	compressed bool
 
+	// 第一帧设置的自定义扩展保留位
+	// Custom extension reserved bits set on the first frame
+	rsv RSVBit
+
 	// 操作码
 	// The opcode of the frame
 	opcode Opcode
@@ -314,6 +621,18 @@ type continuationFrame struct {
 	// 缓冲区
 	// The buffer for the frame data
 	buffer *bytes.Buffer
+
+	// 延迟拼接时各个帧的缓冲区
+	// Buffers of the individual frames when reassembling lazily
+	fragments []*bytes.Buffer
+
+	// 已接收的负载长度
+	// Length of the payload received so far
+	size int
+
+	// 已接收的帧数
+	// Number of frames received so far
+	frames int
 }
 
 // 重置延续帧的状态
@@ -321,8 +640,12 @@ type continuationFrame struct {
 func (c *continuationFrame) reset() {
 	c.initialized = false
 	c.compressed = false
+	c.rsv = 0
 	c.opcode = 0
 	c.buffer = nil
+	c.fragments = nil
+	c.size = 0
+	c.frames = 0
 }
 
 // Logger 日志接口
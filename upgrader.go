@@ -3,6 +3,7 @@ package gws
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
@@ -15,10 +16,6 @@ import (
 )
 
 type responseWriter struct {
-	// 错误信息
-	// Error information
-	err error
-
 	// 字节缓冲区
 	// Byte buffer
 	b *bytes.Buffer
@@ -54,33 +51,85 @@ func (c *responseWriter) WithHeader(k, v string) {
 	c.b.WriteString("\r\n")
 }
 
-// WithExtraHeader 添加额外的 HTTP Header
-// Adds extra http header
+// WithExtraHeader 添加额外的 HTTP Header, 多值的 Header 会逐行写入, 键名保持原样
+// Adds extra http headers, each value of a multi-value header is written on its own line and keys are kept as is
 func (c *responseWriter) WithExtraHeader(h http.Header) {
-	for k, _ := range h {
-		c.WithHeader(k, h.Get(k))
+	for k, vs := range h {
+		for _, v := range vs {
+			c.WithHeader(k, v)
+		}
 	}
 }
 
 // WithSubProtocol 根据请求头和预期的子协议列表设置子协议
-// Sets the subprotocol based on the request header and the expected subprotocols list
+// 按服务端的优先级选取第一个双方都支持的子协议; 没有交集时不返回该响应头, 由客户端决定是否断开连接.
+// Sets the subprotocol based on the request header and the expected subprotocols list.
+// The first mutually supported subprotocol in server priority order is selected;
+// if there is none, the header is omitted and the client decides whether to fail the connection.
 func (c *responseWriter) WithSubProtocol(requestHeader http.Header, expectedSubProtocols []string) {
 	if len(expectedSubProtocols) > 0 {
-		c.subprotocol = internal.GetIntersectionElem(expectedSubProtocols, internal.Split(requestHeader.Get(internal.SecWebSocketProtocol.Key), ","))
-		if c.subprotocol == "" {
-			c.err = ErrSubprotocolNegotiation
-			return
+		c.subprotocol = internal.GetIntersectionElem(expectedSubProtocols, parseSubProtocols(requestHeader))
+		if c.subprotocol != "" {
+			c.WithHeader(internal.SecWebSocketProtocol.Key, c.subprotocol)
 		}
-		c.WithHeader(internal.SecWebSocketProtocol.Key, c.subprotocol)
 	}
 }
 
+// SubProtocols 返回客户端在握手请求中提供的子协议列表, 按客户端的优先级排列, 没有时返回空切片
+// 可以在 Authorize 等回调中使用.
+// Returns the sub-protocols offered by the client in the handshake request, in the client's order of preference,
+// or an empty slice if there are none. It can be used in callbacks such as Authorize.
+func SubProtocols(r *http.Request) []string {
+	return parseSubProtocols(r.Header)
+}
+
+// IsSecure 报告握手请求是否经由 TLS 到达, 即原始协议是否为 wss://
+// 除 r.TLS 外也会无条件地检查 X-Forwarded-Proto 请求头, 只有在可信的反向代理之后才应该依赖该请求头.
+// 服务端连接使用 Upgrader.IsSecure, 它只采信可信代理的请求头.
+// Reports whether the handshake request arrived over TLS, that is whether the original scheme was wss://.
+// Besides r.TLS the X-Forwarded-Proto header is checked unconditionally, which should only be relied on behind
+// a trusted reverse proxy. Server-side connections use Upgrader.IsSecure, which only believes trusted proxies.
+func IsSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return isForwardedSecure(r)
+}
+
+// 报告 X-Forwarded-Proto 请求头声明的原始协议是否为 https 或者 wss
+// Reports whether the original scheme declared by the X-Forwarded-Proto header is https or wss
+func isForwardedSecure(r *http.Request) bool {
+	var proto = strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0])
+	return strings.EqualFold(proto, "https") || strings.EqualFold(proto, "wss")
+}
+
+// Query 返回握手请求中查询参数 key 的第一个值, 不存在时返回空字符串
+// 浏览器无法在握手时设置自定义请求头, 鉴权令牌通常通过查询参数(例如 ?token=...)传递, 可以在 Authorize 等回调中使用.
+// 对于 GET 请求, 解析结果缓存在 r.Form 中, 重复调用不会再次解析; 该函数从不读取请求体, 不会影响被劫持的连接.
+// Returns the first value of the query parameter key in the handshake request, or an empty string if it is absent.
+// Browsers cannot set custom headers on the handshake, so auth tokens are usually passed as query parameters
+// (e.g. ?token=...); it can be used in callbacks such as Authorize.
+// For GET requests the parsed values are cached in r.Form, so repeated calls do not parse again;
+// the request body is never read, so the hijacked connection is not disturbed.
+func Query(r *http.Request, key string) string {
+	if r.Method != http.MethodGet {
+		return r.URL.Query().Get(key)
+	}
+	if r.Form == nil {
+		r.Form = r.URL.Query()
+	}
+	return r.Form.Get(key)
+}
+
+// 解析 Sec-WebSocket-Protocol 请求头, 该字段可以出现多次, 每次都是逗号分隔的列表
+// Parses the Sec-WebSocket-Protocol header, which may appear several times, each a comma separated list
+func parseSubProtocols(h http.Header) []string {
+	return internal.Split(strings.Join(h.Values(internal.SecWebSocketProtocol.Key), ","), ",")
+}
+
 // Write 将缓冲区内容写入连接，并设置超时
 // Writes the buffer content to the connection and sets the timeout
 func (c *responseWriter) Write(conn net.Conn, timeout time.Duration) error {
-	if c.err != nil {
-		return c.err
-	}
 	c.b.WriteString("\r\n")
 	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
 		return err
@@ -92,9 +141,11 @@ func (c *responseWriter) Write(conn net.Conn, timeout time.Duration) error {
 }
 
 type Upgrader struct {
-	option       *ServerOption
-	deflaterPool *deflaterPool
-	eventHandler Event
+	option         *ServerOption
+	deflaterPool   *deflaterPool
+	eventHandler   Event
+	conns          *ConcurrentMap[*Conn, struct{}]
+	trustedProxies []*net.IPNet
 }
 
 // NewUpgrader 创建一个新的 Upgrader 实例
@@ -104,13 +155,100 @@ func NewUpgrader(eventHandler Event, option *ServerOption) *Upgrader {
 		option:       initServerOption(option),
 		eventHandler: eventHandler,
 		deflaterPool: new(deflaterPool),
+		conns:        NewConcurrentMap[*Conn, struct{}](),
 	}
 	if u.option.PermessageDeflate.Enabled {
 		u.deflaterPool.initialize(u.option.PermessageDeflate, option.ReadMaxPayloadSize)
 	}
+	for _, item := range u.option.TrustedProxies {
+		if ipNet := parseIPNet(item); ipNet != nil {
+			u.trustedProxies = append(u.trustedProxies, ipNet)
+		} else {
+			u.option.Logger.Error("gws: invalid trusted proxy " + item)
+		}
+	}
 	return u
 }
 
+// 解析 CIDR 或者 IP 地址, 无效时返回 nil
+// Parses a CIDR or an IP address, returns nil if it is invalid
+func parseIPNet(s string) *net.IPNet {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return ipNet
+	}
+	var ip = net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// 判断 IP 是否属于可信代理
+// Reports whether the IP belongs to a trusted proxy
+func (c *Upgrader) isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range c.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP 返回握手请求的客户端真实 IP
+// 直接对端不是可信代理时返回对端地址, 否则从右向左遍历 X-Forwarded-For, 返回第一个不是可信代理的地址.
+// 客户端可以伪造 X-Forwarded-For 的左侧部分, 所以只有可信代理追加的地址才会被采信.
+// Returns the real client IP of the handshake request.
+// If the direct peer is not a trusted proxy, its address is returned. Otherwise X-Forwarded-For is walked
+// from right to left and the first address that is not a trusted proxy is returned.
+// Clients can forge the left part of X-Forwarded-For, so only the addresses appended by trusted proxies are believed.
+func (c *Upgrader) ClientIP(r *http.Request) string {
+	var remote, ip = remoteIP(r)
+	if ip == nil || !c.isTrustedProxy(ip) {
+		return remote
+	}
+
+	var hops = strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		var hop = net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !c.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// IsSecure 报告握手请求是否经由 TLS 到达, 即原始协议是否为 wss://
+// 类似 IsSecure 函数, 区别是只有直接对端是可信代理(参见 TrustedProxies)时才采信 X-Forwarded-Proto 请求头,
+// 以免客户端伪造该请求头. Conn.IsSecure 的值由它决定.
+// Reports whether the handshake request arrived over TLS, that is whether the original scheme was wss://.
+// Like the IsSecure function, except that the X-Forwarded-Proto header is only believed when the direct peer
+// is a trusted proxy (see TrustedProxies), so that clients cannot forge it. Conn.IsSecure is decided by it.
+func (c *Upgrader) IsSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	var _, ip = remoteIP(r)
+	return ip != nil && c.isTrustedProxy(ip) && isForwardedSecure(r)
+}
+
+// 返回握手请求的直接对端地址(去掉端口)及其解析结果, 无法解析时 IP 为空
+// Returns the address of the direct peer of the handshake request without the port and its parsed IP,
+// which is nil if it cannot be parsed
+func remoteIP(r *http.Request) (string, net.IP) {
+	var remote = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	return remote, net.ParseIP(remote)
+}
+
 // 劫持 HTTP 连接并返回底层的网络连接和缓冲读取器
 // Hijacks the HTTP connection and returns the underlying network connection and buffered reader
 func (c *Upgrader) hijack(w http.ResponseWriter) (net.Conn, *bufio.Reader, error) {
@@ -129,37 +267,71 @@ func (c *Upgrader) hijack(w http.ResponseWriter) (net.Conn, *bufio.Reader, error
 
 // 根据客户端和服务器的扩展协商结果获取 PermessageDeflate 配置
 // Gets the PermessageDeflate configuration based on the negotiation results between the client and server extensions
+// 服务端滑动窗口不能超过客户端要求的 server_max_window_bits.
+// 客户端没有声明 client_max_window_bits 时, 它的滑动窗口只能是 32KB; 声明了数值时, 回应的数值不能超过它.
+// The server window must not exceed the server_max_window_bits requested by the client.
+// If the client does not offer client_max_window_bits, its window can only be 32KB;
+// if it offers a value, the value in the response must not exceed it.
 func (c *Upgrader) getPermessageDeflate(extensions string) PermessageDeflate {
 	clientPD := permessageNegotiation(extensions)
 	serverPD := c.option.PermessageDeflate
+	clientWindowBits := 15
+	if strings.Contains(extensions, internal.ClientMaxWindowBits) {
+		clientWindowBits = internal.Min(serverPD.ClientMaxWindowBits, clientPD.ClientMaxWindowBits)
+	}
 	pd := PermessageDeflate{
 		Enabled:               serverPD.Enabled && strings.Contains(extensions, internal.PermessageDeflate),
 		Threshold:             serverPD.Threshold,
 		Level:                 serverPD.Level,
 		PoolSize:              serverPD.PoolSize,
+		Dictionary:            serverPD.Dictionary,
+		NewCompressor:         serverPD.NewCompressor,
+		Adaptive:              serverPD.Adaptive,
 		ServerContextTakeover: clientPD.ServerContextTakeover && serverPD.ServerContextTakeover,
 		ClientContextTakeover: clientPD.ClientContextTakeover && serverPD.ClientContextTakeover,
-		ServerMaxWindowBits:   serverPD.ServerMaxWindowBits,
-		ClientMaxWindowBits:   serverPD.ClientMaxWindowBits,
+		ServerMaxWindowBits:   internal.Min(serverPD.ServerMaxWindowBits, clientPD.ServerMaxWindowBits),
+		ClientMaxWindowBits:   clientWindowBits,
 	}
 	pd.setThreshold(true)
 	return pd
 }
 
 // Upgrade 升级 HTTP 连接到 WebSocket 连接
-// Upgrades the HTTP connection to a WebSocket connection
+// 鉴权和请求头校验在劫持连接之前完成, 失败时通过 http.ResponseWriter 返回错误响应.
+// Upgrades the HTTP connection to a WebSocket connection.
+// Authorization and header validation are done before hijacking,
+// so failures are answered through the http.ResponseWriter.
 func (c *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	var session = c.option.NewSession()
+	if err := c.checkRequest(r, session); err != nil {
+		if errors.Is(err, ErrUnsupportedVersion) {
+			w.Header().Set(internal.SecWebSocketVersion.Key, internal.SecWebSocketVersion.Val)
+		}
+		c.option.OnUpgradeReject(w, r, err)
+		return nil, err
+	}
+
 	netConn, br, err := c.hijack(w)
 	if err != nil {
 		return nil, err
 	}
-	return c.UpgradeFromConn(netConn, br, r)
+	socket, err := c.doUpgradeFromConn(netConn, br, r, session)
+	if err != nil {
+		_ = c.writeErr(netConn, err)
+		_ = netConn.Close()
+	}
+	return socket, err
 }
 
 // UpgradeFromConn 从现有的网络连接升级到 WebSocket 连接
 // Upgrades from an existing network connection to a WebSocket connection
 func (c *Upgrader) UpgradeFromConn(conn net.Conn, br *bufio.Reader, r *http.Request) (*Conn, error) {
-	socket, err := c.doUpgradeFromConn(conn, br, r)
+	var session = c.option.NewSession()
+	var socket *Conn
+	var err = c.checkRequest(r, session)
+	if err == nil {
+		socket, err = c.doUpgradeFromConn(conn, br, r, session)
+	}
 	if err != nil {
 		_ = c.writeErr(conn, err)
 		_ = conn.Close()
@@ -167,15 +339,50 @@ func (c *Upgrader) UpgradeFromConn(conn net.Conn, br *bufio.Reader, r *http.Requ
 	return socket, err
 }
 
+// Handler 返回一个 http.HandlerFunc, 升级成功后在新的协程中运行 ReadLoop, 失败时通过 Logger 记录错误
+// Returns an http.HandlerFunc that runs ReadLoop in a new goroutine after a successful upgrade,
+// and logs the error through the Logger on failure.
+func (c *Upgrader) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		socket, err := c.Upgrade(w, r)
+		if err != nil {
+			c.option.Logger.Error("gws: " + err.Error())
+			return
+		}
+		go socket.ReadLoop()
+	}
+}
+
+// UpgradeErrorStatus 返回拒绝升级请求时使用的 HTTP 状态码, 可以在 OnUpgradeReject 中使用
+// 鉴权失败为 403, 版本不匹配为 426, 连接数达到上限为 503, 其他为 400.
+// Returns the HTTP status code used to reject an upgrade request, it can be used in OnUpgradeReject.
+// It is 403 for failed authorization, 426 for a version mismatch, 503 when the connection limit is reached and 400 otherwise.
+func UpgradeErrorStatus(err error) int {
+	if errors.Is(err, ErrUnauthorized) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, ErrUnsupportedVersion) {
+		return http.StatusUpgradeRequired
+	}
+	if errors.Is(err, ErrTooManyConnections) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
 // 向客户端写入 HTTP 错误响应
 // Writes an HTTP error response to the client
 func (c *Upgrader) writeErr(conn net.Conn, err error) error {
 	var str = err.Error()
+	var code = UpgradeErrorStatus(err)
 	var buf = binaryPool.Get(256)
-	buf.WriteString("HTTP/1.1 400 Bad Request\r\n")
+	buf.WriteString("HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code) + "\r\n")
 	buf.WriteString("Date: " + time.Now().Format(time.RFC1123) + "\r\n")
 	buf.WriteString("Content-Length: " + strconv.Itoa(len(str)) + "\r\n")
 	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	if code == http.StatusUpgradeRequired {
+		buf.WriteString(internal.SecWebSocketVersion.Key + ": " + internal.SecWebSocketVersion.Val + "\r\n")
+	}
 	buf.WriteString("\r\n")
 	buf.WriteString(str)
 	_, result := buf.WriteTo(conn)
@@ -183,56 +390,138 @@ func (c *Upgrader) writeErr(conn net.Conn, err error) error {
 	return result
 }
 
-// 从现有的网络连接升级到 WebSocket 连接
-// Upgrades from an existing network connection to a WebSocket connection
-func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http.Request) (*Conn, error) {
+// 鉴权并检查请求头
+// Authorizes the request and checks the request headers
+func (c *Upgrader) checkRequest(r *http.Request, session SessionStorage) error {
+	// 连接数达到上限时拒绝握手
+	// Reject the handshake once the connection limit is reached
+	if n := c.option.MaxConcurrentConnections; n > 0 && c.conns.Len() >= n {
+		return ErrTooManyConnections
+	}
+
 	// 授权请求，如果授权失败，返回未授权错误
 	// Authorize the request, if authorization fails, return an unauthorized error
-	var session = c.option.NewSession()
 	if !c.option.Authorize(r, session) {
-		return nil, ErrUnauthorized
+		return ErrUnauthorized
 	}
 
-	// 检查请求头
-	// check request headers
+	// 检查请求头, 默认在第一个失败项返回; 开启 VerboseHandshakeErrors 时收集所有失败项
+	// check request headers, returns on the first failure by default; collects all failures with VerboseHandshakeErrors
+	var errs HandshakeErrors
 	if r.Method != http.MethodGet {
-		return nil, ErrHandshake
-	}
-	if !strings.EqualFold(r.Header.Get(internal.SecWebSocketVersion.Key), internal.SecWebSocketVersion.Val) {
-		return nil, errors.New("gws: websocket version not supported")
+		errs = append(errs, ErrBadMethod)
 	}
 	if !internal.HttpHeaderContains(r.Header.Get(internal.Connection.Key), internal.Connection.Val) {
-		return nil, ErrHandshake
+		errs = append(errs, errBadConnection)
 	}
 	if !strings.EqualFold(r.Header.Get(internal.Upgrade.Key), internal.Upgrade.Val) {
-		return nil, ErrHandshake
+		errs = append(errs, errBadUpgrade)
+	}
+	// 版本不匹配时响应 426, 并通过 Sec-WebSocket-Version 告知支持的版本
+	// Responds with 426 on a version mismatch and advertises the supported version via Sec-WebSocket-Version
+	if version := r.Header.Get(internal.SecWebSocketVersion.Key); !strings.EqualFold(version, internal.SecWebSocketVersion.Val) {
+		errs = append(errs, &VersionError{version: version})
 	}
+	if r.Header.Get(internal.SecWebSocketKey.Key) == "" {
+		errs = append(errs, errMissingKey)
+	}
+	switch {
+	case len(errs) == 0:
+		return nil
+	case len(errs) == 1 || !c.option.VerboseHandshakeErrors:
+		return errs[0]
+	default:
+		return errs
+	}
+}
 
+// 从现有的网络连接升级到 WebSocket 连接, 请求必须已经通过校验
+// Upgrades from an existing network connection to a WebSocket connection, the request must have been checked
+func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http.Request, session SessionStorage) (*Conn, error) {
 	var rw = new(responseWriter).Init()
 	defer rw.Close()
 
 	var extensions = r.Header.Get(internal.SecWebSocketExtensions.Key)
-	var pd = c.getPermessageDeflate(extensions)
+	var pd = c.getPermessageDeflate(deflateExtensions(extensions))
+	var enabled, responses = negotiateExtensions(c.option.Extensions, extensions)
 	if pd.Enabled {
-		rw.WithHeader(internal.SecWebSocketExtensions.Key, pd.genResponseHeader())
+		responses = append([]string{pd.genResponseHeader()}, responses...)
+	}
+	var extensionHeader = strings.Join(responses, ", ")
+	if extensionHeader != "" {
+		rw.WithHeader(internal.SecWebSocketExtensions.Key, extensionHeader)
 	}
 
 	var websocketKey = r.Header.Get(internal.SecWebSocketKey.Key)
-	if websocketKey == "" {
-		return nil, ErrHandshake
-	}
 	rw.WithHeader(internal.SecWebSocketAccept.Key, internal.ComputeAcceptKey(websocketKey))
 	rw.WithSubProtocol(r.Header, c.option.SubProtocols)
-	rw.WithExtraHeader(c.option.ResponseHeader)
+	rw.WithExtraHeader(c.getResponseHeader(r))
+	if c.option.AdvertiseMaxPayload {
+		rw.WithHeader(internal.SecWebSocketMaxPayload.Key, strconv.Itoa(c.option.ReadMaxPayloadSize))
+	}
 	if err := rw.Write(netConn, c.option.HandshakeTimeout); err != nil {
 		return nil, err
 	}
+	var socket = c.newConn(netConn, br, session, rw.subprotocol, pd)
+	socket.extensions = enabled
+	socket.extensionHeader = extensionHeader
+	socket.secure = c.IsSecure(r)
+	socket.clientIP = c.ClientIP(r)
+	if c.option.AdvertiseMaxPayload {
+		socket.peerMaxPayloadSize = parseMaxPayloadSize(r.Header)
+	}
+	return socket, nil
+}
+
+// 解析对端通过 Sec-WebSocket-MaxPayload 声明的最大消息长度, 无效时返回 0
+// Parses the maximum message size advertised by the peer through Sec-WebSocket-MaxPayload, 0 if invalid
+func parseMaxPayloadSize(header http.Header) int {
+	n, err := strconv.Atoi(header.Get(internal.SecWebSocketMaxPayload.Key))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// 返回握手的额外响应头, 设置了 ModifyResponseHeader 时使用修改后的副本
+// Returns the extra handshake response headers, a modified copy if ModifyResponseHeader is set
+func (c *Upgrader) getResponseHeader(r *http.Request) http.Header {
+	if c.option.ModifyResponseHeader == nil {
+		return c.option.ResponseHeader
+	}
+	var header = c.option.ResponseHeader.Clone()
+	c.option.ModifyResponseHeader(r, header)
+	deleteProtectedHeaders(header)
+	return header
+}
+
+// ServeConn 跳过 HTTP 握手, 直接把已建立(并已鉴权)的网络连接包装成服务端 WebSocket 连接
+// 不会协商压缩和子协议, 对端发送的帧必须带掩码. 返回的连接需要调用 ReadLoop 开始读取.
+// Wraps an established (and already authenticated) network connection as a server-side WebSocket connection,
+// skipping the HTTP handshake. Compression and sub-protocols are not negotiated, and frames from the peer must be masked.
+// Call ReadLoop on the returned connection to start reading.
+func (c *Upgrader) ServeConn(netConn net.Conn) *Conn {
+	br := c.option.config.brPool.Get()
+	br.Reset(netConn)
+	var socket = c.newConn(netConn, br, c.option.NewSession(), "", PermessageDeflate{})
+	_, socket.secure = netConn.(*tls.Conn)
+	if addr := netConn.RemoteAddr(); addr != nil {
+		socket.clientIP = addr.String()
+		if host, _, err := net.SplitHostPort(socket.clientIP); err == nil {
+			socket.clientIP = host
+		}
+	}
+	return socket
+}
 
+// 创建服务端连接
+// Creates a server-side connection
+func (c *Upgrader) newConn(netConn net.Conn, br *bufio.Reader, session SessionStorage, subprotocol string, pd PermessageDeflate) *Conn {
 	config := c.option.getConfig()
 	socket := &Conn{
 		ss:                session,
 		isServer:          true,
-		subprotocol:       rw.subprotocol,
+		subprotocol:       subprotocol,
 		pd:                pd,
 		conn:              netConn,
 		config:            config,
@@ -241,7 +530,8 @@ func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http
 		fh:                frameHeader{},
 		handler:           c.eventHandler,
 		closed:            0,
-		writeQueue:        workerQueue{maxConcurrency: 1},
+		writeQueue:        newWriteQueue(config),
+		limiter:           newRateLimiter(config.WriteRateLimit),
 		readQueue:         make(channel, c.option.ParallelGolimit),
 	}
 
@@ -255,8 +545,54 @@ func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http
 		if pd.ClientContextTakeover {
 			socket.dpsWindow.initialize(config.dswPool, pd.ClientMaxWindowBits)
 		}
+		// 协商后的滑动窗口比压缩器池的小, 需要独占一个压缩器
+		// The negotiated window is smaller than the one of the compressor pool, so the connection needs its own compressor
+		if pd.ServerMaxWindowBits != c.option.PermessageDeflate.ServerMaxWindowBits {
+			socket.cpsDeflater.Store(&deflater{cpsWriter: newFlateWriter(pd.ServerMaxWindowBits, pd.Level)})
+		}
+		socket.presetDictionary()
+		if pd.NewCompressor != nil {
+			socket.compressor, socket.decompressor = pd.NewCompressor()
+		}
 	}
-	return socket, nil
+
+	// 保活只是尽力而为, 设置失败不影响连接的使用
+	// Keep-alive is best effort, a failure does not prevent the connection from being used
+	_ = socket.setKeepAlive(c.option.TCPKeepAlive)
+
+	socket.conns = c.conns
+	c.conns.Store(socket, struct{}{})
+	return socket
+}
+
+// Shutdown 向该升级器创建的所有活跃连接发送 1001 (going away) 关闭帧,
+// 并等待它们的 ReadLoop 返回, 直到全部关闭或者 ctx 结束.
+// 连接在 ReadLoop 返回时自动注销. 建议先调用 http.Server.Shutdown 停止接受新连接.
+// Sends a 1001 (going away) close frame to every active connection created by this upgrader
+// and waits for their ReadLoop to return, until all of them are closed or ctx is done.
+// Connections are deregistered automatically when ReadLoop returns.
+// It is recommended to call http.Server.Shutdown first to stop accepting new connections.
+func (c *Upgrader) Shutdown(ctx context.Context) error {
+	var conns []*Conn
+	c.conns.Range(func(socket *Conn, _ struct{}) bool {
+		conns = append(conns, socket)
+		return true
+	})
+
+	for _, socket := range conns {
+		go func(socket *Conn) {
+			_ = socket.WriteClose(internal.CloseGoingAway.Uint16(), nil)
+		}(socket)
+	}
+
+	for _, socket := range conns {
+		select {
+		case <-socket.getReadDone():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
 // Server WebSocket服务器
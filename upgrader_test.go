@@ -5,13 +5,18 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -101,6 +106,61 @@ func TestNoDelay(t *testing.T) {
 	})
 }
 
+func TestKeepAlive(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("tcp conn", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if !as.NoError(err) {
+			return
+		}
+		defer ln.Close()
+		netConn, err := net.Dial("tcp", ln.Addr().String())
+		if !as.NoError(err) {
+			return
+		}
+		defer netConn.Close()
+
+		var socket = &Conn{conn: netConn}
+		as.NoError(socket.setKeepAlive(0))
+		as.NoError(socket.setKeepAlive(time.Second))
+		as.NoError(socket.setKeepAlive(-1))
+		_, ok := tcpConn(tls.Client(netConn, nil))
+		as.True(ok)
+	})
+
+	t.Run("other", func(t *testing.T) {
+		conn, _ := net.Pipe()
+		socket := &Conn{conn: conn}
+		as.NoError(socket.setKeepAlive(time.Second))
+		_, ok := tcpConn(conn)
+		as.False(ok)
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		var addr = "127.0.0.1:" + nextPort()
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		var server = NewServer(serverHandler, &ServerOption{TCPKeepAlive: time.Second})
+		as.Equal(time.Second, server.upgrader.option.TCPKeepAlive)
+		go server.Run(addr)
+		time.Sleep(100 * time.Millisecond)
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		as.NoError(client.WriteString("hello"))
+		wg.Wait()
+	})
+}
+
 func TestAccept(t *testing.T) {
 	var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{
 		PermessageDeflate: PermessageDeflate{Enabled: true},
@@ -226,6 +286,247 @@ func TestFailHijack(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestUpgradeBeforeHijack(t *testing.T) {
+	var as = assert.New(t)
+	var newRequest = func() *http.Request {
+		var request = &http.Request{Header: http.Header{}, Method: http.MethodGet}
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Sec-WebSocket-Version", "13")
+		request.Header.Set("Sec-WebSocket-Key", "3tTS/Y+YGaM7TTnPuafHng==")
+		return request
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			Authorize: func(r *http.Request, session SessionStorage) bool { return false },
+		})
+		var writer = &hijackCounter{ResponseRecorder: httptest.NewRecorder()}
+		_, err := upgrader.Upgrade(writer, newRequest())
+		as.ErrorIs(err, ErrUnauthorized)
+		as.Equal(http.StatusForbidden, writer.Code)
+		as.Equal(0, writer.hijacked)
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), nil)
+		var request = newRequest()
+		request.Header.Del("Sec-WebSocket-Key")
+		var writer = &hijackCounter{ResponseRecorder: httptest.NewRecorder()}
+		_, err := upgrader.Upgrade(writer, request)
+		as.ErrorIs(err, ErrHandshake)
+		as.Equal(http.StatusBadRequest, writer.Code)
+		as.Equal(0, writer.hijacked)
+	})
+
+	t.Run("bad method", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), nil)
+		var request = newRequest()
+		request.Method = http.MethodPost
+		var writer = &hijackCounter{ResponseRecorder: httptest.NewRecorder()}
+		_, err := upgrader.Upgrade(writer, request)
+		as.ErrorIs(err, ErrBadMethod)
+		as.ErrorIs(err, ErrHandshake)
+		as.Equal(http.StatusBadRequest, writer.Code)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), nil)
+		var request = newRequest()
+		request.Header.Set("Sec-WebSocket-Version", "8")
+		var writer = &hijackCounter{ResponseRecorder: httptest.NewRecorder()}
+		_, err := upgrader.Upgrade(writer, request)
+		as.ErrorIs(err, ErrUnsupportedVersion)
+		var versionErr *VersionError
+		if as.True(errors.As(err, &versionErr)) {
+			as.Equal("8", versionErr.Version())
+		}
+		as.Equal(http.StatusUpgradeRequired, writer.Code)
+		as.Equal("13", writer.Header().Get("Sec-WebSocket-Version"))
+		as.Equal(0, writer.hijacked)
+	})
+
+	t.Run("custom reject response", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			Authorize: func(r *http.Request, session SessionStorage) bool {
+				return r.Header.Get("Authorization") != ""
+			},
+			OnUpgradeReject: func(w http.ResponseWriter, r *http.Request, reason error) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(UpgradeErrorStatus(reason))
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": reason.Error()})
+			},
+		})
+
+		var writer = &hijackCounter{ResponseRecorder: httptest.NewRecorder()}
+		_, err := upgrader.Upgrade(writer, newRequest())
+		as.ErrorIs(err, ErrUnauthorized)
+		as.Equal(http.StatusForbidden, writer.Code)
+		as.Equal("application/json", writer.Header().Get("Content-Type"))
+		as.JSONEq(`{"error":"unauthorized"}`, writer.Body.String())
+		as.Equal(0, writer.hijacked)
+
+		var request = newRequest()
+		request.Header.Set("Authorization", "token")
+		request.Header.Set("Sec-WebSocket-Version", "8")
+		writer = &hijackCounter{ResponseRecorder: httptest.NewRecorder()}
+		_, err = upgrader.Upgrade(writer, request)
+		as.ErrorIs(err, ErrUnsupportedVersion)
+		as.Equal(http.StatusUpgradeRequired, writer.Code)
+		as.Equal("13", writer.Header().Get("Sec-WebSocket-Version"))
+		as.Equal(0, writer.hijacked)
+	})
+
+	t.Run("verbose handshake errors", func(t *testing.T) {
+		var newBadRequest = func() *http.Request {
+			var request = newRequest()
+			request.Method = http.MethodPost
+			request.Header.Del("Upgrade")
+			request.Header.Set("Sec-WebSocket-Version", "8")
+			return request
+		}
+
+		// 默认在第一个失败项返回
+		// fail fast by default
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), nil)
+		_, err := upgrader.Upgrade(&hijackCounter{ResponseRecorder: httptest.NewRecorder()}, newBadRequest())
+		as.Equal(ErrBadMethod, err)
+
+		upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{VerboseHandshakeErrors: true})
+		var writer = &hijackCounter{ResponseRecorder: httptest.NewRecorder()}
+		_, err = upgrader.Upgrade(writer, newBadRequest())
+		var errs HandshakeErrors
+		if as.True(errors.As(err, &errs)) {
+			as.Len(errs, 3)
+		}
+		as.ErrorIs(err, ErrBadMethod)
+		as.ErrorIs(err, errBadUpgrade)
+		as.ErrorIs(err, ErrUnsupportedVersion)
+		as.NotErrorIs(err, errMissingKey)
+		var versionErr *VersionError
+		if as.True(errors.As(err, &versionErr)) {
+			as.Equal("8", versionErr.Version())
+		}
+		as.Contains(err.Error(), "http method must be GET")
+		as.Contains(err.Error(), "Upgrade header must be websocket")
+		as.Equal(http.StatusUpgradeRequired, writer.Code)
+		as.Equal(0, writer.hijacked)
+
+		// 只有一个失败项时直接返回该错误
+		// a single failure is returned as is
+		var request = newRequest()
+		request.Header.Del("Sec-WebSocket-Key")
+		_, err = upgrader.Upgrade(&hijackCounter{ResponseRecorder: httptest.NewRecorder()}, request)
+		as.Equal(errMissingKey, err)
+	})
+
+	t.Run("unsupported version from conn", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), nil)
+		var request = newRequest()
+		request.Header.Set("Sec-WebSocket-Version", "7")
+		server, client := net.Pipe()
+		go func() {
+			_, _ = upgrader.UpgradeFromConn(server, bufio.NewReader(server), request)
+		}()
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		as.NoError(err)
+		as.Equal(http.StatusUpgradeRequired, resp.StatusCode)
+		as.Equal("13", resp.Header.Get("Sec-WebSocket-Version"))
+	})
+
+	t.Run("upgrade from conn", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			Authorize: func(r *http.Request, session SessionStorage) bool { return false },
+		})
+		server, client := net.Pipe()
+		go func() {
+			_, _ = upgrader.UpgradeFromConn(server, bufio.NewReader(server), newRequest())
+		}()
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		as.NoError(err)
+		as.Equal(http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("multi-value header", func(t *testing.T) {
+		var header = http.Header{}
+		header.Add("Set-Cookie", "a=1")
+		header.Add("Set-Cookie", "b=2")
+		header["x-raw-Key"] = []string{"raw"}
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{ResponseHeader: header})
+		server, client := net.Pipe()
+		go func() {
+			_, _ = upgrader.UpgradeFromConn(server, bufio.NewReader(server), newRequest())
+		}()
+		var br = bufio.NewReader(client)
+		var lines []string
+		for {
+			line, err := br.ReadString('\n')
+			if !as.NoError(err) || line == "\r\n" {
+				break
+			}
+			lines = append(lines, strings.TrimSpace(line))
+		}
+		as.Contains(lines, "Set-Cookie: a=1")
+		as.Contains(lines, "Set-Cookie: b=2")
+		as.Contains(lines, "x-raw-Key: raw")
+	})
+
+	t.Run("modify response header", func(t *testing.T) {
+		var header = http.Header{}
+		header.Set("X-Server", "gws")
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			ResponseHeader: header,
+			ModifyResponseHeader: func(r *http.Request, h http.Header) {
+				h.Set("Set-Cookie", "sid="+r.Header.Get("X-User-Id"))
+				h.Set(internal.SecWebSocketAccept.Key, "forged")
+			},
+		})
+		var request = newRequest()
+		request.Header.Set("X-User-Id", "42")
+		server, client := net.Pipe()
+		go func() {
+			_, _ = upgrader.UpgradeFromConn(server, bufio.NewReader(server), request)
+		}()
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal("gws", resp.Header.Get("X-Server"))
+		as.Equal("sid=42", resp.Header.Get("Set-Cookie"))
+		as.Equal(internal.ComputeAcceptKey(request.Header.Get(internal.SecWebSocketKey.Key)), resp.Header.Get(internal.SecWebSocketAccept.Key))
+		as.Equal(1, len(header))
+	})
+
+	t.Run("seed session", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			Authorize: func(r *http.Request, session SessionStorage) bool {
+				session.Store("uid", r.Header.Get("X-User-Id"))
+				return true
+			},
+		})
+		var request = newRequest()
+		request.Header.Set("X-User-Id", "42")
+		server, client := net.Pipe()
+		go func() {
+			_, _ = http.ReadResponse(bufio.NewReader(client), nil)
+		}()
+		socket, err := upgrader.UpgradeFromConn(server, bufio.NewReader(server), request)
+		as.NoError(err)
+		uid, _ := socket.Session().Load("uid")
+		as.Equal("42", uid)
+	})
+}
+
+type hijackCounter struct {
+	*httptest.ResponseRecorder
+	hijacked int
+}
+
+func (c *hijackCounter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c.hijacked++
+	return nil, nil, errors.New("test")
+}
+
 func TestNewServer(t *testing.T) {
 	var as = assert.New(t)
 
@@ -314,7 +615,8 @@ func TestNewServer(t *testing.T) {
 		}})
 		var dir = os.Getenv("PWD")
 		go server.RunTLS(addr, dir+"/examples/wss/cert/server.crt", dir+"/examples/wss/cert/server.pem")
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		<-ctx.Done()
 	})
 
@@ -393,14 +695,16 @@ func TestBuiltinEventEngine(t *testing.T) {
 }
 
 func TestSubprotocol(t *testing.T) {
-	t.Run("server close", func(t *testing.T) {
+	t.Run("server no match", func(t *testing.T) {
 		var addr = "127.0.0.1:" + nextPort()
 		app := NewServer(new(BuiltinEventHandler), &ServerOption{SubProtocols: []string{"chat"}})
 		go func() { app.Run(addr) }()
 
 		time.Sleep(100 * time.Millisecond)
-		_, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr})
-		assert.Error(t, err)
+		socket, resp, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr})
+		assert.NoError(t, err)
+		assert.Equal(t, "", socket.SubProtocol())
+		assert.Equal(t, "", resp.Header.Get("Sec-WebSocket-Protocol"))
 	})
 
 	t.Run("client close", func(t *testing.T) {
@@ -432,6 +736,189 @@ func TestSubprotocol(t *testing.T) {
 		})
 		assert.NoError(t, err)
 	})
+
+	t.Run("priority", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{SubProtocols: []string{"json", "chat"}})
+		var request = &http.Request{Header: http.Header{}, Method: http.MethodGet}
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Sec-WebSocket-Version", "13")
+		request.Header.Set("Sec-WebSocket-Key", "3tTS/Y+YGaM7TTnPuafHng==")
+		request.Header.Set("Sec-WebSocket-Protocol", "chat, json")
+		socket, err := upgrader.Upgrade(newHttpWriter(), request)
+		assert.NoError(t, err)
+		assert.Equal(t, "json", socket.SubProtocol())
+	})
+
+	t.Run("offered", func(t *testing.T) {
+		var request = &http.Request{Header: http.Header{}}
+		assert.Equal(t, []string{}, SubProtocols(request))
+
+		request.Header.Add("Sec-WebSocket-Protocol", " chat ,json,, v2.mqtt")
+		request.Header.Add("Sec-WebSocket-Protocol", "graphql-ws")
+		assert.Equal(t, []string{"chat", "json", "v2.mqtt", "graphql-ws"}, SubProtocols(request))
+
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{SubProtocols: []string{"graphql-ws"}})
+		request.Method = http.MethodGet
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Sec-WebSocket-Version", "13")
+		request.Header.Set("Sec-WebSocket-Key", "3tTS/Y+YGaM7TTnPuafHng==")
+		socket, err := upgrader.Upgrade(newHttpWriter(), request)
+		assert.NoError(t, err)
+		assert.Equal(t, "graphql-ws", socket.SubProtocol())
+	})
+}
+
+func TestIsSecure(t *testing.T) {
+	var request = &http.Request{Header: http.Header{}}
+	assert.False(t, IsSecure(request))
+
+	request.Header.Set("X-Forwarded-Proto", "HTTPS")
+	assert.True(t, IsSecure(request))
+	request.Header.Set("X-Forwarded-Proto", "wss, http")
+	assert.True(t, IsSecure(request))
+	request.Header.Set("X-Forwarded-Proto", "http")
+	assert.False(t, IsSecure(request))
+
+	request.TLS = &tls.ConnectionState{}
+	assert.True(t, IsSecure(request))
+
+	var upgrader = NewUpgrader(new(BuiltinEventHandler), nil)
+	request.Method = http.MethodGet
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "3tTS/Y+YGaM7TTnPuafHng==")
+	socket, err := upgrader.Upgrade(newHttpWriter(), request)
+	assert.NoError(t, err)
+	assert.True(t, socket.IsSecure())
+
+	t.Run("trusted proxies", func(t *testing.T) {
+		var as = assert.New(t)
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{TrustedProxies: []string{"10.0.0.0/8"}})
+		var newRequest = func(remoteAddr string, proto string) *http.Request {
+			var r = &http.Request{RemoteAddr: remoteAddr, Header: http.Header{}}
+			r.Header.Set("X-Forwarded-Proto", proto)
+			return r
+		}
+
+		// 不可信的对端伪造请求头 / spoofed header from an untrusted peer
+		as.False(upgrader.IsSecure(newRequest("1.2.3.4:8000", "https")))
+		as.False(upgrader.IsSecure(newRequest("invalid", "https")))
+		as.True(upgrader.IsSecure(newRequest("10.0.0.1:8000", "https")))
+		as.False(upgrader.IsSecure(newRequest("10.0.0.1:8000", "http")))
+
+		var request = newRequest("1.2.3.4:8000", "http")
+		request.TLS = &tls.ConnectionState{}
+		as.True(upgrader.IsSecure(request))
+
+		request = newRequest("1.2.3.4:8000", "wss")
+		request.Method = http.MethodGet
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Sec-WebSocket-Version", "13")
+		request.Header.Set("Sec-WebSocket-Key", "3tTS/Y+YGaM7TTnPuafHng==")
+		socket, err := upgrader.Upgrade(newHttpWriter(), request)
+		as.NoError(err)
+		as.False(socket.IsSecure())
+	})
+}
+
+func TestQuery(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("cached", func(t *testing.T) {
+		var request = &http.Request{Method: http.MethodGet, URL: &url.URL{RawQuery: "token=abc&token=def&x=1"}}
+		as.Equal("abc", Query(request, "token"))
+		as.Equal("", Query(request, "missing"))
+		as.Equal("1", request.Form.Get("x"))
+
+		// 缓存后不再解析 URL
+		// The URL is not parsed again once cached
+		request.URL.RawQuery = "token=changed"
+		as.Equal("abc", Query(request, "token"))
+	})
+
+	t.Run("not get", func(t *testing.T) {
+		var request = &http.Request{Method: http.MethodPost, URL: &url.URL{RawQuery: "token=abc"}}
+		as.Equal("abc", Query(request, "token"))
+		as.Nil(request.Form)
+	})
+
+	t.Run("authorize", func(t *testing.T) {
+		var addr = "127.0.0.1:" + nextPort()
+		var serverHandler = new(webSocketMocker)
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler.onOpen = func(socket *Conn) {
+			token, _ := socket.Session().Load("token")
+			as.Equal("abc", token)
+			wg.Done()
+		}
+		var server = NewServer(serverHandler, &ServerOption{
+			Authorize: func(r *http.Request, session SessionStorage) bool {
+				var token = Query(r, "token")
+				session.Store("token", token)
+				return token == "abc"
+			},
+		})
+		go func() { _ = server.Run(addr) }()
+		time.Sleep(100 * time.Millisecond)
+
+		_, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr + "/?token=wrong"})
+		as.Error(err)
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr + "/?token=abc"})
+		if !as.NoError(err) {
+			return
+		}
+		wg.Wait()
+		_ = client.WriteClose(1000, nil)
+	})
+}
+
+func TestUpgrader_ClientIP(t *testing.T) {
+	var as = assert.New(t)
+	var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+		TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1", "::1", "invalid"},
+	})
+	as.Equal(3, len(upgrader.trustedProxies))
+
+	var newRequest = func(remoteAddr string, xff ...string) *http.Request {
+		var r = &http.Request{RemoteAddr: remoteAddr, Header: http.Header{}}
+		for _, item := range xff {
+			r.Header.Add("X-Forwarded-For", item)
+		}
+		return r
+	}
+
+	// 不可信的对端伪造请求头 / spoofed header from an untrusted peer
+	as.Equal("1.2.3.4", upgrader.ClientIP(newRequest("1.2.3.4:8000", "5.6.7.8")))
+	as.Equal("1.2.3.4", upgrader.ClientIP(newRequest("1.2.3.4")))
+
+	// 可信代理 / trusted proxies
+	as.Equal("5.6.7.8", upgrader.ClientIP(newRequest("10.0.0.1:8000", "5.6.7.8")))
+	as.Equal("5.6.7.8", upgrader.ClientIP(newRequest("[::1]:8000", "5.6.7.8")))
+	as.Equal("5.6.7.8", upgrader.ClientIP(newRequest("10.0.0.1:8000", "9.9.9.9, 5.6.7.8, 192.168.1.1")))
+	as.Equal("5.6.7.8", upgrader.ClientIP(newRequest("10.0.0.1:8000", "9.9.9.9", "5.6.7.8 ,10.1.1.1")))
+	as.Equal("10.2.2.2", upgrader.ClientIP(newRequest("10.0.0.1:8000", "10.2.2.2, 10.1.1.1")))
+	as.Equal("10.0.0.1", upgrader.ClientIP(newRequest("10.0.0.1:8000")))
+	as.Equal("5.6.7.8", upgrader.ClientIP(newRequest("10.0.0.1:8000", "unknown, 5.6.7.8")))
+	as.Equal("10.0.0.1", upgrader.ClientIP(newRequest("10.0.0.1:8000", "5.6.7.8, unknown")))
+
+	t.Run("conn", func(t *testing.T) {
+		var request = newRequest("10.0.0.1:8000", "5.6.7.8")
+		request.Method = http.MethodGet
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Sec-WebSocket-Version", "13")
+		request.Header.Set("Sec-WebSocket-Key", "3tTS/Y+YGaM7TTnPuafHng==")
+		socket, err := upgrader.Upgrade(newHttpWriter(), request)
+		if as.NoError(err) {
+			as.Equal("5.6.7.8", socket.ClientIP())
+		}
+	})
 }
 
 func TestResponseWriter_Write(t *testing.T) {
@@ -461,3 +948,208 @@ func TestServer_RunListener(t *testing.T) {
 	}()
 	time.Sleep(time.Microsecond)
 }
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (c *testLogger) Error(v ...any) {
+	c.mu.Lock()
+	c.logs = append(c.logs, fmt.Sprint(v...))
+	c.mu.Unlock()
+}
+
+func TestUpgrader_Handler(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	var logger = new(testLogger)
+	var upgrader = NewUpgrader(serverHandler, &ServerOption{Logger: logger})
+	var server = httptest.NewServer(upgrader.Handler())
+	defer server.Close()
+
+	t.Run("ok", func(t *testing.T) {
+		var clientHandler = new(webSocketMocker)
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		client, _, err := NewClient(clientHandler, &ClientOption{
+			Addr: "ws" + strings.TrimPrefix(server.URL, "http"),
+		})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		as.NoError(client.WriteString("hello"))
+		wg.Wait()
+		_ = client.WriteClose(1000, nil)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		resp, err := http.Get(server.URL)
+		if !as.NoError(err) {
+			return
+		}
+		_ = resp.Body.Close()
+		as.Equal(http.StatusBadRequest, resp.StatusCode)
+		logger.mu.Lock()
+		as.Equal(1, len(logger.logs))
+		logger.mu.Unlock()
+	})
+}
+
+func TestUpgrader_ServeConn(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal("hello", message.Data.String())
+		wg.Done()
+	}
+
+	var upgrader = NewUpgrader(serverHandler, nil)
+	s, c := net.Pipe()
+	var server = upgrader.ServeConn(s)
+	var client = serveWebSocket(false, initClientOption(nil).getConfig(), newSmap(), c, bufio.NewReader(c), clientHandler, false, "", PermessageDeflate{})
+	as.True(server.isServer)
+	as.NotNil(server.Session())
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WriteString("hello"))
+	wg.Wait()
+}
+
+func TestUpgrader_MaxConcurrentConnections(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var closed = make(chan struct{}, 1)
+	serverHandler.onClose = func(socket *Conn, err error) { closed <- struct{}{} }
+	var upgrader = NewUpgrader(serverHandler, &ServerOption{MaxConcurrentConnections: 2})
+	var server = httptest.NewServer(upgrader.Handler())
+	defer server.Close()
+
+	var addr = "ws" + strings.TrimPrefix(server.URL, "http")
+	var clients []*Conn
+	for i := 0; i < 2; i++ {
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		clients = append(clients, client)
+	}
+
+	_, resp, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: addr})
+	as.Error(err)
+	if as.NotNil(resp) {
+		as.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	_ = clients[0].WriteClose(1000, nil)
+	<-closed
+	time.Sleep(10 * time.Millisecond)
+	client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: addr})
+	if as.NoError(err) {
+		_ = client.NetConn().Close()
+	}
+}
+
+func TestUpgrader_Shutdown(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("ok", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var opened = &sync.WaitGroup{}
+		opened.Add(3)
+		serverHandler.onOpen = func(socket *Conn) { opened.Done() }
+		var upgrader = NewUpgrader(serverHandler, nil)
+		var server = httptest.NewServer(upgrader.Handler())
+		defer server.Close()
+
+		var closed = &sync.WaitGroup{}
+		closed.Add(3)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(internal.CloseGoingAway.Uint16(), closeErr.Code)
+			}
+			closed.Done()
+		}
+		for i := 0; i < 3; i++ {
+			client, _, err := NewClient(clientHandler, &ClientOption{
+				Addr: "ws" + strings.TrimPrefix(server.URL, "http"),
+			})
+			if !as.NoError(err) {
+				return
+			}
+			go client.ReadLoop()
+		}
+		opened.Wait()
+		as.Equal(3, upgrader.conns.Len())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		as.NoError(upgrader.Shutdown(ctx))
+		as.Equal(0, upgrader.conns.Len())
+		closed.Wait()
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(webSocketMocker), nil)
+		s, c := net.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, c) }()
+		_ = upgrader.ServeConn(s) // ReadLoop is never started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		as.ErrorIs(upgrader.Shutdown(ctx), context.DeadlineExceeded)
+	})
+}
+
+func TestUpgrader_AdvertiseMaxPayload(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("enabled", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			ReadMaxPayloadSize:  1024,
+			AdvertiseMaxPayload: true,
+		})
+		server, client, err := NewPipeConns(upgrader, new(BuiltinEventHandler), &ClientOption{
+			ReadMaxPayloadSize:  2048,
+			AdvertiseMaxPayload: true,
+		})
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(2048, server.PeerMaxPayloadSize())
+		as.Equal(1024, client.PeerMaxPayloadSize())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{AdvertiseMaxPayload: true})
+		server, client, err := NewPipeConns(upgrader, new(BuiltinEventHandler), nil)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(0, server.PeerMaxPayloadSize())
+		as.Equal(0, client.PeerMaxPayloadSize())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		as.Equal(0, parseMaxPayloadSize(http.Header{"Sec-Websocket-Maxpayload": []string{"-1"}}))
+		as.Equal(0, parseMaxPayloadSize(http.Header{"Sec-Websocket-Maxpayload": []string{"abc"}}))
+		as.Equal(16, parseMaxPayloadSize(http.Header{"Sec-Websocket-Maxpayload": []string{"16"}}))
+	})
+}
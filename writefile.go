@@ -13,30 +13,33 @@ import (
 
 const segmentSize = 128 * 1024
 
-// 获取大文件压缩器
-// Get bigDeflater
-func (c *Conn) getBigDeflater() *bigDeflater {
-	if c.isServer {
-		return c.config.bdPool.Get()
+// 获取大文件压缩器, 同时返回归还它的函数
+// 连接独占的压缩器或者客户端的压缩器可能同时被广播使用, 所以在整个写入期间持有它的锁.
+// 归还函数在获取时就确定了, 写入期间修改压缩级别不会导致池中的压缩器无法归还.
+// Gets a bigDeflater together with the function that returns it.
+// The compressor owned by the connection, or the one of a client, may be used by broadcasts at the same time,
+// so its lock is held for the whole write. The return function is decided when the deflater is taken,
+// so changing the compression level during the write never leaks a deflater of the pool.
+func (c *Conn) getBigDeflater() (*bigDeflater, func()) {
+	if d := c.getCpsDeflater(); d != nil {
+		d.cpsLocker.Lock()
+		return (*bigDeflater)(d.cpsWriter), d.cpsLocker.Unlock
 	}
-	return (*bigDeflater)(c.deflater.cpsWriter)
-}
-
-// 回收大文件压缩器
-// Recycle bigDeflater
-func (c *Conn) putBigDeflater(d *bigDeflater) {
 	if c.isServer {
-		c.config.bdPool.Put(d)
+		var d = c.config.bdPool.Get()
+		return d, func() { c.config.bdPool.Put(d) }
 	}
+	c.deflater.cpsLocker.Lock()
+	return (*bigDeflater)(c.deflater.cpsWriter), c.deflater.cpsLocker.Unlock
 }
 
 // 拆分io.Reader为小切片
 // Split io.Reader into small slices
-func (c *Conn) splitReader(r io.Reader, f func(index int, eof bool, p []byte) error) error {
-	var buf = binaryPool.Get(segmentSize)
+func (c *Conn) splitReader(r io.Reader, size int, f func(index int, eof bool, p []byte) error) error {
+	var buf = binaryPool.Get(size)
 	defer binaryPool.Put(buf)
 
-	var p = buf.Bytes()[:segmentSize]
+	var p = buf.Bytes()[:size]
 	var n, index = 0, 0
 	var err error
 	for n, err = r.Read(p); err == nil || errors.Is(err, io.EOF); n, err = r.Read(p) {
@@ -56,15 +59,42 @@ func (c *Conn) splitReader(r io.Reader, f func(index int, eof bool, p []byte) er
 // 采用分段写入技术, 减少写入过程中的内存占用
 // Segmented write technology to reduce memory usage during write process
 func (c *Conn) WriteFile(opcode Opcode, payload io.Reader) error {
-	err := c.doWriteFile(opcode, payload)
+	return c.WriteFragments(opcode, segmentSize, payload)
+}
+
+// WriteFragments 分片写入
+// 按 chunkSize 切分 payload, 首帧使用 opcode, 后续帧使用 OpcodeContinuation, 最后一帧设置 FIN.
+// 开启压缩时切分的是压缩后的数据, 除最后一帧外每一帧的长度都是 chunkSize, 仅首帧设置 RSV1. WriteMaxPayloadSize 限制的是单帧长度.
+// chunkSize <= 0 时使用默认分片大小.
+// Writes payload as a fragmented message.
+// The payload is split into chunkSize pieces, the first frame carries the opcode,
+// the following ones use OpcodeContinuation and the last one sets FIN.
+// With compression enabled, the compressed stream is split, every frame except the last one is exactly chunkSize long
+// and only the first frame sets RSV1.
+// WriteMaxPayloadSize limits the length of each frame. If chunkSize <= 0, the default segment size is used.
+func (c *Conn) WriteFragments(opcode Opcode, chunkSize int, payload io.Reader) error {
+	chunkSize = internal.SelectValue(chunkSize <= 0, segmentSize, chunkSize)
+	err := c.doWriteFile(opcode, chunkSize, payload)
 	c.emitError(false, err)
 	return err
 }
 
-func (c *Conn) doWriteFile(opcode Opcode, payload io.Reader) error {
+func (c *Conn) doWriteFile(opcode Opcode, size int, payload io.Reader) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.waitFragments()
+	if err := c.flushBatch(); err != nil {
+		return err
+	}
+	var done = make(chan struct{})
+	c.fragments = done
+	defer func() {
+		c.fragments = nil
+		close(done)
+	}()
+
+	var compressed = c.CompressionEnabled()
 	var cb = func(index int, eof bool, p []byte) error {
 		if index > 0 {
 			opcode = OpcodeContinuation
@@ -78,29 +108,68 @@ func (c *Conn) doWriteFile(opcode Opcode, payload io.Reader) error {
 		if err != nil {
 			return err
 		}
-		if c.pd.Enabled && index == 0 {
+		if compressed && index == 0 {
 			frame.Bytes()[0] |= uint8(64)
 		}
-		if c.isClosed() {
+		// 等待令牌时释放写锁, 避免阻塞控制帧. 其他数据帧由 c.fragments 挡住
+		// Release the write lock while waiting for tokens, so that control frames are not blocked.
+		// Other data frames are held back by c.fragments.
+		if c.limiter != nil {
+			c.mu.Unlock()
+			err = c.limiter.wait(frame.Len())
+			c.mu.Lock()
+			if err != nil {
+				binaryPool.Put(frame)
+				return err
+			}
+		}
+		if c.IsClosed() {
+			binaryPool.Put(frame)
 			return ErrConnClosed
 		}
 		err = internal.WriteN(c.conn, frame.Bytes())
+		if err == nil {
+			c.statsWrite(internal.SelectValue(eof, 1, 0), frame.Len())
+		}
 		binaryPool.Put(frame)
 		return err
 	}
 
-	if c.pd.Enabled {
-		var deflater = c.getBigDeflater()
-		var fw = &flateWriter{cb: cb}
+	if compressed && c.compressor != nil {
+		return c.compressFile(size, payload, cb)
+	}
+	if compressed {
+		var deflater, put = c.getBigDeflater()
+		var fw = &flateWriter{size: size, cb: cb}
 		var reader = &readerWrapper{r: payload, sw: &c.cpsWindow}
-		err := deflater.Compress(reader, fw, c.cpsWindow.dict)
-		c.putBigDeflater(deflater)
+		err := deflater.Compress(reader, fw, c.compressDict())
+		put()
 		return err
 	} else {
-		return c.splitReader(payload, cb)
+		return c.splitReader(payload, size, cb)
 	}
 }
 
+// 自定义压缩器不支持流式压缩, 先整体压缩再分段写入
+// Custom compressors do not support streaming, so the payload is compressed as a whole and then written in segments
+func (c *Conn) compressFile(size int, payload io.Reader, cb func(index int, eof bool, p []byte) error) error {
+	var src, dst = binaryPool.Get(size), binaryPool.Get(size)
+	defer func() {
+		binaryPool.Put(src)
+		binaryPool.Put(dst)
+	}()
+
+	if _, err := src.ReadFrom(payload); err != nil {
+		return err
+	}
+	var p = src.Bytes()
+	if err := c.compressor.Compress(src, dst, c.compressDict()); err != nil {
+		return err
+	}
+	_, _ = c.cpsWindow.Write(p)
+	return c.splitReader(dst, size, cb)
+}
+
 // 大文件压缩器
 type bigDeflater flate.Writer
 
@@ -108,13 +177,7 @@ type bigDeflater flate.Writer
 // Create a bigDeflater
 func newBigDeflater(isServer bool, options PermessageDeflate) *bigDeflater {
 	windowBits := internal.SelectValue(isServer, options.ServerMaxWindowBits, options.ClientMaxWindowBits)
-	if windowBits == 15 {
-		cpsWriter, _ := flate.NewWriter(nil, options.Level)
-		return (*bigDeflater)(cpsWriter)
-	} else {
-		cpsWriter, _ := flate.NewWriterWindow(nil, internal.BinaryPow(windowBits))
-		return (*bigDeflater)(cpsWriter)
-	}
+	return (*bigDeflater)(newFlateWriter(windowBits, options.Level))
 }
 
 func (c *bigDeflater) FlateWriter() *flate.Writer { return (*flate.Writer)(c) }
@@ -128,71 +191,59 @@ func (c *bigDeflater) Compress(r io.WriterTo, w *flateWriter, dict []byte) error
 }
 
 // 写入代理
-// 将切片透传给回调函数, 以实现分段写入功能
+// 将压缩后的数据按照 size 切分为帧并透传给回调函数, 以实现分段写入功能. 除最后一帧之外每一帧的长度都是 size.
 // Write proxy
-// Passthrough slices to the callback function for segmented writes.
+// Splits the compressed data into frames of length size and passes them to the callback function for segmented writes.
+// Every frame except the last one is exactly size bytes long.
 type flateWriter struct {
-	index   int
-	buffers []*bytes.Buffer
-	cb      func(index int, eof bool, p []byte) error
+	index int
+	size  int
+	buf   *bytes.Buffer
+	cb    func(index int, eof bool, p []byte) error
 }
 
-// 是否可以执行回调函数
-// Whether the callback function can be executed
-func (c *flateWriter) shouldCall() bool {
-	var n = len(c.buffers)
-	if n < 2 {
-		return false
-	}
-	var sum = 0
-	for i := 1; i < n; i++ {
-		sum += c.buffers[i].Len()
-	}
-	return sum >= 4
+// 调用回调函数写入一帧
+// Calls the callback function to write a frame
+func (c *flateWriter) call(eof bool, p []byte) error {
+	var err = c.cb(c.index, eof, p)
+	c.index++
+	return err
 }
 
-// 聚合写入, 减少syscall.write调用次数
-// Aggregate writes, reducing the number of syscall.write calls
-func (c *flateWriter) write(p []byte) {
-	var size = internal.Max(segmentSize, len(p))
-	if len(c.buffers) == 0 {
-		c.buffers = append(c.buffers, binaryPool.Get(size))
+// 凑够一帧时立即写入. 末尾的4个字节可能是需要去掉的同步标记, 留到 Flush 时处理
+// Writes a frame as soon as one is complete. The last 4 bytes may be the sync marker to be removed, they are kept until Flush.
+func (c *flateWriter) Write(p []byte) (int, error) {
+	if c.buf == nil {
+		c.buf = binaryPool.Get(c.size + 4)
 	}
-	var n = len(c.buffers)
-	var tail = c.buffers[n-1]
-	if tail.Len()+len(p)+frameHeaderSize > tail.Cap() {
-		tail = binaryPool.Get(size)
-		c.buffers = append(c.buffers, tail)
+	c.buf.Write(p)
+	for c.buf.Len() >= c.size+4 {
+		if err := c.call(false, c.buf.Next(c.size)); err != nil {
+			return 0, err
+		}
 	}
-	tail.Write(p)
+	return len(p), nil
 }
 
-func (c *flateWriter) Write(p []byte) (n int, err error) {
-	c.write(p)
-	if c.shouldCall() {
-		err = c.cb(c.index, false, c.buffers[0].Bytes())
-		binaryPool.Put(c.buffers[0])
-		c.buffers = c.buffers[1:]
-		c.index++
+// Flush 去掉同步标记并写入剩余的数据, 最后一帧设置 FIN
+// Removes the sync marker and writes the remaining data, the last frame sets FIN
+func (c *flateWriter) Flush() error {
+	if c.buf == nil {
+		c.buf = binaryPool.Get(0)
 	}
-	return n, err
-}
+	defer binaryPool.Put(c.buf)
 
-func (c *flateWriter) Flush() error {
-	var buf = c.buffers[0]
-	for i := 1; i < len(c.buffers); i++ {
-		buf.Write(c.buffers[i].Bytes())
-		binaryPool.Put(c.buffers[i])
-	}
-	if n := buf.Len(); n >= 4 {
-		if tail := buf.Bytes()[n-4:]; binary.BigEndian.Uint32(tail) == math.MaxUint16 {
-			buf.Truncate(n - 4)
+	if n := c.buf.Len(); n >= 4 {
+		if tail := c.buf.Bytes()[n-4:]; binary.BigEndian.Uint32(tail) == math.MaxUint16 {
+			c.buf.Truncate(n - 4)
 		}
 	}
-	var err = c.cb(c.index, true, buf.Bytes())
-	c.index++
-	binaryPool.Put(buf)
-	return err
+	for c.buf.Len() > c.size {
+		if err := c.call(false, c.buf.Next(c.size)); err != nil {
+			return err
+		}
+	}
+	return c.call(true, c.buf.Bytes())
 }
 
 // 将io.Reader包装为io.WriterTo
@@ -2,53 +2,121 @@ package gws
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"math"
+	"os"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/lxzan/gws/internal"
 )
 
 // WriteClose 发送关闭帧并断开连接
 // 没有特殊需求的话, 推荐code=1000, reason=nil
+// 保留的 1005 和 1006 不能出现在网络上, 此时发送不带状态码和原因的关闭帧
+// ReadLoop 正在运行时, 连接在收到对端回复的关闭帧或者 CloseTimeout 超时之后才断开, 期间收到的消息被丢弃; 否则立即断开.
 // Send shutdown frame, active disconnection
 // If you don't have any special needs, we recommend code=1000, reason=nil
+// The reserved codes 1005 and 1006 must not appear on the wire, a close frame without code and reason is sent instead.
+// If ReadLoop is running, the connection is dropped once the close frame of the peer arrives or CloseTimeout expires,
+// messages received meanwhile are discarded; otherwise it is dropped right away.
 // https://developer.mozilla.org/zh-CN/docs/Web/API/CloseEvent#status_codes
 func (c *Conn) WriteClose(code uint16, reason []byte) error {
-	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+	if c.markClosed() {
 		var buf = binaryPool.Get(128)
 		code = internal.SelectValue(code < 1000, 1000, code)
-		buf.Write(internal.StatusCode(code).Bytes())
-		buf.Write(reason)
-		err := c.writeClose(internal.StatusCode(code), buf.Bytes())
+		if code != CloseNoStatusReceived && code != CloseAbnormalClosure {
+			buf.Write(internal.StatusCode(code).Bytes())
+			buf.Write(reason)
+		}
+		err := c.writeClose(internal.StatusCode(code), buf.Bytes(), true)
 		binaryPool.Put(buf)
 		return err
 	}
 	return ErrConnClosed
 }
 
+// WriteCloseError 发送携带 err 状态码和原因的关闭帧并断开连接, err 为 nil 时使用 1000
+// Sends a close frame carrying the code and reason of err, and disconnects. 1000 is used if err is nil.
+func (c *Conn) WriteCloseError(err *CloseError) error {
+	if err == nil {
+		return c.WriteClose(CloseNormalClosure, nil)
+	}
+	return c.WriteClose(err.Code, err.Reason)
+}
+
+// CloseWithError 根据 err 选择状态码, 发送关闭帧并断开连接
+// *CloseError 使用其状态码和原因, 原因不是有效的 UTF-8 时被丢弃; context.DeadlineExceeded 和 context.Canceled 使用 1001;
+// nil 和 io.EOF 使用 1000; 其他错误使用 1011, 原因固定为 "internal error", 不会把内部错误信息泄露给对端.
+// 原因超过 123 字节时会在字符边界截断.
+// Chooses the close code from err, sends a close frame and disconnects.
+// A *CloseError uses its code and reason, the reason is dropped if it is not valid UTF-8;
+// context.DeadlineExceeded and context.Canceled use 1001; nil and io.EOF use 1000;
+// any other error uses 1011 with the fixed reason "internal error", so internal details never leak to the peer.
+// Reasons longer than 123 bytes are truncated at a character boundary.
+func (c *Conn) CloseWithError(err error) error {
+	var closeErr *CloseError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return c.WriteClose(CloseNormalClosure, nil)
+	case errors.As(err, &closeErr):
+		var reason = internal.SelectValue(utf8.Valid(closeErr.Reason), closeErr.Reason, nil)
+		return c.WriteClose(closeErr.Code, reason)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return c.WriteClose(CloseGoingAway, nil)
+	default:
+		return c.WriteClose(CloseInternalErr, []byte("internal error"))
+	}
+}
+
 // 关闭连接并存储错误信息
-// Closes the connection and stores the error information
-func (c *Conn) writeClose(ev error, reason []byte) error {
-	if len(reason) > internal.ThresholdV1 {
-		reason = reason[:internal.ThresholdV1]
+// 关闭帧的负载不能超过125字节, 截断时不会拆开多字节的UTF-8字符.
+// waitAck 为 true 且 ReadLoop 正在运行时, 发送关闭帧之后不立即断开, 而是设置 CloseTimeout 读截止时间,
+// 由 ReadLoop 在收到对端回复的关闭帧或者超时之后断开连接.
+// Closes the connection and stores the error information.
+// The payload of the close frame cannot exceed 125 bytes, truncation never splits a multibyte UTF-8 character.
+// If waitAck is true and ReadLoop is running, the connection is not dropped right after the close frame is sent.
+// A read deadline of CloseTimeout is set instead, and ReadLoop drops the connection once the close frame
+// of the peer arrives or the deadline passes.
+func (c *Conn) writeClose(ev error, reason []byte, waitAck bool) error {
+	if n := internal.ThresholdV1; len(reason) > n {
+		for n > 2 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
 	}
 	c.ev.Store(ev)
+	// 写截止时间同样会唤醒阻塞中的写操作, 使其释放锁
+	// The write deadline also wakes up blocked writes so that they release the lock
+	if c.config.CloseTimeout > 0 {
+		_ = c.setWriteDeadline(time.Now().Add(c.config.CloseTimeout))
+	}
 	err := c.doWrite(OpcodeCloseConnection, internal.Bytes(reason))
+	if waitAck && err == nil && c.config.CloseTimeout > 0 && atomic.LoadUint32(&c.reading) == 1 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.config.CloseTimeout))
+		return nil
+	}
 	_ = c.conn.Close()
 	return err
 }
 
 // WritePing
-// 写入Ping消息, 携带的信息不要超过125字节
-// Control frame length cannot exceed 125 bytes
+// 写入Ping消息, 携带的信息不能超过125字节, 否则返回 ErrMessageTooLarge. 控制帧不会被压缩.
+// Writes a ping frame, the payload cannot exceed 125 bytes, otherwise ErrMessageTooLarge is returned.
+// Control frames are never compressed.
 func (c *Conn) WritePing(payload []byte) error {
 	return c.WriteMessage(OpcodePing, payload)
 }
 
 // WritePong
-// 写入Pong消息, 携带的信息不要超过125字节
-// Control frame length cannot exceed 125 bytes
+// 写入Pong消息, 携带的信息不能超过125字节, 否则返回 ErrMessageTooLarge. 控制帧不会被压缩.
+// Writes a pong frame, the payload cannot exceed 125 bytes, otherwise ErrMessageTooLarge is returned.
+// Control frames are never compressed.
 func (c *Conn) WritePong(payload []byte) error {
 	return c.WriteMessage(OpcodePong, payload)
 }
@@ -60,6 +128,18 @@ func (c *Conn) WriteString(s string) error {
 	return c.WriteMessage(OpcodeText, internal.StringToBytes(s))
 }
 
+// WriteJSON
+// 将 v 编码为JSON并作为文本消息写入, 编码失败时直接返回错误, 不会影响连接.
+// Encodes v as JSON and writes it as a text message.
+// Encoding errors are returned directly without touching the connection.
+func (c *Conn) WriteJSON(v any) error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(OpcodeText, p)
+}
+
 // WriteMessage
 // 写入文本/二进制消息, 文本消息应该使用UTF8编码
 // Writes text/binary messages, text messages should be encoded in UTF8.
@@ -69,17 +149,173 @@ func (c *Conn) WriteMessage(opcode Opcode, payload []byte) error {
 	return err
 }
 
+// WriteContext 类似 WriteMessage, 区别是等待令牌, 等待写锁以及写入期间 ctx 取消或者超时后会中止写入并返回 ctx.Err()
+// 写截止时间只在获得写锁之后设置, 不会影响其他协程正在写入的帧, 写入结束后恢复原来的截止时间.
+// 只有帧已经部分写入网络时才会关闭连接, 因为写了一半的帧无法恢复; 写入之前的错误(如 ErrTextEncoding)与 WriteMessage 的处理相同.
+// Similar to WriteMessage, except that the write is aborted and ctx.Err() is returned once ctx is cancelled
+// or its deadline passes, while waiting for tokens, waiting for the write lock or writing.
+// The write deadline is only set once the write lock is held, so frames written by other goroutines are never affected,
+// and the previous deadline is restored afterwards. The connection is only closed if the frame has partially
+// reached the network, since a partially written frame cannot be recovered; errors raised before writing
+// (e.g. ErrTextEncoding) are handled the same way as WriteMessage.
+func (c *Conn) WriteContext(ctx context.Context, opcode Opcode, payload []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return c.WriteMessage(opcode, payload)
+	}
+
+	if opcode.isDataFrame() {
+		if err := c.limiter.waitContext(ctx, len(payload)); err != nil {
+			if err == ctx.Err() {
+				return err
+			}
+			c.emitError(false, err)
+			return err
+		}
+	}
+	if err := c.lockContext(ctx); err != nil {
+		return err
+	}
+	if opcode.isDataFrame() {
+		if err := c.waitFragmentsContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	// 通过写截止时间唤醒阻塞中的写操作
+	// Wakes up the blocked write through the write deadline
+	var stop = make(chan struct{})
+	var aborted = make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.conn.SetWriteDeadline(time.Now())
+			aborted <- true
+		case <-stop:
+			aborted <- false
+		}
+	}()
+
+	n, err := c.writeLocked(opcode, internal.Bytes(payload), false)
+	close(stop)
+	var isAborted = <-aborted
+	if isAborted {
+		_ = c.conn.SetWriteDeadline(c.getWriteDeadline())
+	}
+	c.mu.Unlock()
+
+	if !isAborted || err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.emitError(false, err)
+		return err
+	}
+
+	// 没有写出任何字节时帧流仍然完整, 但是上下文接管模式下压缩字典已经更新, 与对端不再同步
+	// 帧可能只写了一半, 发送关闭帧没有意义, 直接断开连接
+	// The frame stream is intact if no byte was written, but with context takeover the compression dictionary
+	// has already been updated and is out of sync with the peer.
+	// The frame may be partially written, so a close frame is meaningless and the connection is dropped directly
+	err = ctx.Err()
+	if n > 0 || c.cpsWindow.enabled {
+		if c.markClosed() {
+			c.ev.Store(err)
+			_ = c.conn.Close()
+		}
+	}
+	return err
+}
+
+// 获取写锁, 等待期间 ctx 结束时放弃并返回 ctx.Err()
+// Acquires the write lock, gives up and returns ctx.Err() if ctx is done while waiting
+func (c *Conn) lockContext(ctx context.Context) error {
+	if c.mu.TryLock() {
+		return nil
+	}
+	var locked = make(chan struct{})
+	go func() {
+		c.mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// 放弃等待, 获得锁之后立即释放
+		// Gives up waiting, the lock is released as soon as it is acquired
+		go func() {
+			<-locked
+			c.mu.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// 等待其他协程的分片写入结束, 避免数据帧插入分片消息中间. 调用者必须持有 c.mu, 等待期间会释放它
+// Waits for the fragmented write of another goroutine to finish, so that data frames do not interleave with
+// its fragments. The caller must hold c.mu, it is released while waiting.
+func (c *Conn) waitFragments() {
+	_ = c.waitFragmentsContext(context.Background())
+}
+
+// 类似 waitFragments, ctx 结束时返回 ctx.Err(), 此时不再持有 c.mu
+// Like waitFragments, but returns ctx.Err() once ctx is done, c.mu is no longer held in that case
+func (c *Conn) waitFragmentsContext(ctx context.Context) error {
+	for c.fragments != nil {
+		var done = c.fragments
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := c.lockContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // WriteAsync 异步写
 // Writes messages asynchronously
 // 异步非阻塞地将消息写入到任务队列, 收到回调后才允许回收payload内存
+// 发送队列与 ReadLoop 无关, 按需启动自己的协程, 所以在 ReadLoop 开始之前(例如握手之后立即)写入的消息也会按顺序立即发送, 不需要额外的启动步骤.
 // Write messages to the task queue asynchronously and non-blockingly,
-// allowing payload memory to be recycled only after receiving the callback
+// allowing payload memory to be recycled only after receiving the callback.
+// The write queue is independent of ReadLoop and starts its own goroutine on demand, so messages written before
+// ReadLoop starts (e.g. right after the handshake) are sent immediately and in order, no extra start step is needed.
 func (c *Conn) WriteAsync(opcode Opcode, payload []byte, callback func(error)) {
-	c.Async(func() {
-		if err := c.WriteMessage(opcode, payload); callback != nil {
+	ok := c.async(func() {
+		if err := c.writeAsync(opcode, internal.Bytes(payload)); callback != nil {
 			callback(err)
 		}
+	}, func() {
+		if callback != nil {
+			callback(ErrQueueFull)
+		}
 	})
+	if !ok && callback != nil {
+		callback(ErrQueueFull)
+	}
+}
+
+// TryWriteAsync 尝试异步写入, 发送队列已满时立即返回 false, 不会阻塞, 也不受 QueueFullPolicy 影响
+// 连接已关闭, 文本编码无效或者消息过大时返回错误. 写入过程中的错误会触发 OnClose. 入队成功后不要修改 payload.
+// Tries to write a message asynchronously. It returns false immediately if the write queue is full,
+// never blocks and ignores QueueFullPolicy, so the caller can decide whether to coalesce or drop the message.
+// An error is returned if the connection is closed, the text encoding is invalid or the message is too large.
+// Errors during the write trigger OnClose. Do not modify payload after it has been queued.
+func (c *Conn) TryWriteAsync(opcode Opcode, payload []byte) (bool, error) {
+	if c.IsClosed() {
+		return false, ErrConnClosed
+	}
+	if !internal.CheckEncoding(c.config.CheckUtf8Enabled, uint8(opcode), payload) {
+		return false, ErrTextEncoding
+	}
+	if len(payload) > c.config.WriteMaxPayloadSize {
+		return false, ErrMessageTooLarge
+	}
+	return c.writeQueue.TryPush(c.withFlush(func() { _ = c.writeAsync(opcode, internal.Bytes(payload)) })), nil
 }
 
 // Writev
@@ -91,14 +327,152 @@ func (c *Conn) Writev(opcode Opcode, payloads ...[]byte) error {
 	return err
 }
 
+// Frame 批量写入的帧, 每一帧都是一条完整的消息
+// A frame of a batched write, each frame is a complete message
+type Frame struct {
+	Opcode  Opcode
+	Payload []byte
+}
+
+// WriteBatch 在一次加锁和一次写入中连续发送多个帧, 其他协程的写入不会插入其中
+// 操作码可以是文本, 二进制, Ping 和 Pong. 数据帧按照压缩阈值分别压缩.
+// 任意一帧校验失败(文本编码无效或者消息过大)时返回错误, 不会发送任何帧.
+// Writes several frames back to back under a single lock and a single write, so that writes from other goroutines
+// cannot interleave with them. The opcode may be text, binary, ping or pong, data frames are compressed
+// one by one according to the compression threshold. If any frame fails validation
+// (invalid text encoding or message too large), an error is returned and no frame is sent.
+func (c *Conn) WriteBatch(frames []Frame) error {
+	err := c.doWriteFrames(frames)
+	c.emitError(false, err)
+	return err
+}
+
+// WriteRaw 把已经编码好的帧原样写入连接, 不做任何校验, 适用于转发帧的中继等场景
+// 调用者负责帧的正确性: 服务端发送的帧不能带掩码, 客户端发送的帧必须带掩码; 分片不能和其他消息交错;
+// 只有协商了压缩才能设置 RSV1, 且开启本端的上下文接管时不能转发压缩帧, 否则对端的解压字典会失去同步.
+// 写入拦截器和 WriteMaxPayloadSize 不生效, 但仍然受写入限速约束, 连接关闭后返回 ErrConnClosed.
+// Writes pre-encoded frames to the connection as is without any validation, e.g. for relays forwarding frames.
+// The caller owns the correctness of the frames: frames sent by a server must not be masked, frames sent by a client must be masked;
+// fragments must not interleave with other messages; RSV1 may only be set if compression was negotiated,
+// and compressed frames must not be forwarded with context takeover on this side, or the peer's decompression
+// dictionary goes out of sync. The write interceptor and WriteMaxPayloadSize do not apply, but the write rate limit does.
+// ErrConnClosed is returned once the connection is closed.
+func (c *Conn) WriteRaw(frame []byte) error {
+	err := c.doWriteRaw(frame)
+	c.emitError(false, err)
+	return err
+}
+
+// 执行原始帧写入
+// Executes the raw frame write
+func (c *Conn) doWriteRaw(frame []byte) error {
+	if err := c.limiter.wait(len(frame)); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.waitFragments()
+	if c.IsClosed() {
+		return ErrConnClosed
+	}
+	if _, err := c.bufferedWrite(bytes.NewBuffer(frame), false); err != nil {
+		return err
+	}
+	c.statsWrite(0, len(frame))
+	return nil
+}
+
+// 执行批量写入
+// Executes the batched write
+func (c *Conn) doWriteFrames(frames []Frame) error {
+	var total = 0
+	for _, item := range frames {
+		if item.Opcode.isDataFrame() {
+			total += len(item.Payload)
+		}
+	}
+	if err := c.limiter.wait(total); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.waitFragments()
+	if c.IsClosed() {
+		return ErrConnClosed
+	}
+
+	// 生成帧之前校验全部帧, 避免压缩字典包含没有发送的内容
+	// Validate all frames before generating them, so that the compression dictionary never holds unsent content
+	var payloads = make([]internal.Payload, len(frames))
+	var rsvs = make([]RSVBit, len(frames))
+	for i, item := range frames {
+		payload, err := c.intercept(item.Opcode, internal.Bytes(item.Payload))
+		if err != nil {
+			return err
+		}
+		if !payload.CheckEncoding(c.config.CheckUtf8Enabled, uint8(item.Opcode)) {
+			return ErrTextEncoding
+		}
+		payload, rsvs[i], err = c.encodeExtensions(item.Opcode, payload)
+		if err != nil {
+			return err
+		}
+		var n = payload.Len()
+		if n > c.config.WriteMaxPayloadSize || (!item.Opcode.isDataFrame() && n > internal.ThresholdV1) {
+			return ErrMessageTooLarge
+		}
+		payloads[i] = payload
+	}
+
+	var buf = binaryPool.Get(total + len(frames)*frameHeaderSize)
+	defer binaryPool.Put(buf)
+	var messages = 0
+	for i, item := range frames {
+		var payload = payloads[i]
+		frame, err := c.genFrame(item.Opcode, payload, frameConfig{
+			fin:           true,
+			compress:      c.CompressionEnabled(),
+			broadcast:     false,
+			checkEncoding: false,
+			rsv:           rsvs[i],
+		})
+		if err != nil {
+			return err
+		}
+		buf.Write(frame.Bytes())
+		binaryPool.Put(frame)
+		if item.Opcode.isDataFrame() {
+			_, _ = payload.WriteTo(&c.cpsWindow)
+			messages++
+		}
+	}
+
+	if _, err := c.bufferedWrite(buf, false); err != nil {
+		return err
+	}
+	c.statsWrite(messages, buf.Len())
+	return nil
+}
+
 // WritevAsync 类似 WriteAsync, 区别是可以一次写入多个切片
 // It's similar to WriteAsync, except that you can write multiple slices at once.
 func (c *Conn) WritevAsync(opcode Opcode, payloads [][]byte, callback func(error)) {
-	c.Async(func() {
-		if err := c.Writev(opcode, payloads...); callback != nil {
+	ok := c.async(func() {
+		if err := c.writeAsync(opcode, internal.Buffers(payloads)); callback != nil {
 			callback(err)
 		}
+	}, func() {
+		if callback != nil {
+			callback(ErrQueueFull)
+		}
 	})
+	if !ok && callback != nil {
+		callback(ErrQueueFull)
+	}
 }
 
 // Async 异步
@@ -107,17 +481,159 @@ func (c *Conn) WritevAsync(opcode Opcode, payloads [][]byte, callback func(error
 // Add the task to the send queue (concurrency 1), perform asynchronous operation.
 // Note: Don't add tasks that are blocking for a long time.
 func (c *Conn) Async(f func()) {
-	c.writeQueue.Push(f)
+	c.async(f, nil)
+}
+
+// 将任务加入发送队列, 队列已满时按照 QueueFullPolicy 处理, 任务被拒绝时返回 false
+// 任务入队之后被 QueueFullDropOldest 策略丢弃时调用 drop, 可以为空.
+// Adds the job to the send queue, applies QueueFullPolicy when the queue is full and returns false if the job is rejected.
+// drop is called if the job is evicted by the QueueFullDropOldest policy after it was queued, it may be nil.
+func (c *Conn) async(f func(), drop func()) bool {
+	if c.writeQueue.PushDroppable(c.withFlush(f), drop) {
+		return true
+	}
+	if c.config.QueueFullPolicy == QueueFullClose {
+		go func() { _ = c.WriteClose(internal.CloseTryAgainLater.Uint16(), nil) }()
+	}
+	return false
+}
+
+// 发送队列中的写入任务, 开启批量写入时帧会先进入缓冲区
+// Write job of the write queue, frames go to the batch buffer first if batching is enabled
+func (c *Conn) writeAsync(opcode Opcode, payload internal.Payload) error {
+	err := c.doWriteBatch(opcode, payload, c.config.WriteBatchSize > 1)
+	c.emitError(false, err)
+	return err
+}
+
+// 包装发送队列的任务, 开启批量写入时, 任务执行完毕且队列为空则写出缓冲区, 保证消息不会滞留
+// Wraps a job of the write queue. With batching enabled, the buffer is flushed once the job is done
+// and the queue is empty, so that no message is left behind.
+func (c *Conn) withFlush(f func()) func() {
+	if c.config == nil || c.config.WriteBatchSize <= 1 {
+		return f
+	}
+	return func() {
+		f()
+		c.mu.Lock()
+		var err error
+		if c.writeQueue.Len() == 0 {
+			err = c.flushBatch()
+		}
+		c.mu.Unlock()
+		c.emitError(false, err)
+	}
+}
+
+// 批量写入的缓冲区
+// Buffer for batched writes
+type writeBatch struct {
+	buf    *bytes.Buffer
+	frames int
+}
+
+// 写入帧, batch 为 true 时先追加到缓冲区, 直到缓冲的帧数达到 WriteBatchSize.
+// 缓冲区不为空时, 其他帧也会追加在后面一起写出, 以保证顺序. 调用者必须持有 c.mu
+// Writes a frame. If batch is true, the frame is appended to the buffer until it holds WriteBatchSize frames.
+// If the buffer is not empty, other frames are appended and written together to keep the order.
+// The caller must hold c.mu.
+func (c *Conn) bufferedWrite(frame *bytes.Buffer, batch bool) (int, error) {
+	if !batch && c.wbatch.frames == 0 {
+		return c.conn.Write(frame.Bytes())
+	}
+	if c.wbatch.buf == nil {
+		c.wbatch.buf = binaryPool.Get(frame.Len() * c.config.WriteBatchSize)
+	}
+	c.wbatch.buf.Write(frame.Bytes())
+	c.wbatch.frames++
+	if batch && c.wbatch.frames < c.config.WriteBatchSize {
+		return 0, nil
+	}
+	return c.flushBatchN()
+}
+
+// Flush 立即写出批量缓冲区中的帧, 没有开启批量写入或者缓冲区为空时不做任何事
+// 适用于在发送队列中连续写入多条消息后, 等待对端响应之前确保它们已经写入连接.
+// Writes out the frames held in the batch buffer right away,
+// it does nothing if batching is disabled or the buffer is empty.
+// It is useful to make sure that messages queued back to back have hit the wire before awaiting a response.
+func (c *Conn) Flush() error {
+	c.mu.Lock()
+	var err error
+	if c.IsClosed() {
+		err = ErrConnClosed
+	} else {
+		err = c.flushBatch()
+	}
+	c.mu.Unlock()
+	c.emitError(false, err)
+	return err
+}
+
+// 写出批量缓冲区, 调用者必须持有 c.mu
+// Flushes the batch buffer, the caller must hold c.mu
+func (c *Conn) flushBatch() error {
+	_, err := c.flushBatchN()
+	return err
+}
+
+// 写出批量缓冲区中的帧, 返回写入网络的字节数. 调用者必须持有 c.mu
+// Writes out the frames held in the batch buffer and returns the number of bytes written to the network.
+// The caller must hold c.mu.
+func (c *Conn) flushBatchN() (int, error) {
+	if c.wbatch.frames == 0 {
+		return 0, nil
+	}
+	n, err := c.conn.Write(c.wbatch.buf.Bytes())
+	binaryPool.Put(c.wbatch.buf)
+	c.wbatch.buf, c.wbatch.frames = nil, 0
+	return n, err
 }
 
 // 执行写入逻辑, 注意妥善维护压缩字典
 // Executes the write logic, ensuring proper maintenance of the compression dictionary
 func (c *Conn) doWrite(opcode Opcode, payload internal.Payload) error {
+	return c.doWriteBatch(opcode, payload, false)
+}
+
+// 执行写入逻辑, batch 为 true 时允许先写入批量缓冲区
+// Executes the write logic, the frame may go to the batch buffer if batch is true
+func (c *Conn) doWriteBatch(opcode Opcode, payload internal.Payload, batch bool) error {
+	// 在加锁之前等待令牌, 避免阻塞控制帧
+	// Wait for tokens before locking, so that control frames are not blocked
+	if opcode.isDataFrame() {
+		if err := c.limiter.wait(payload.Len()); err != nil {
+			return err
+		}
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if opcode.isDataFrame() {
+		c.waitFragments()
+	}
+	_, err := c.writeLocked(opcode, payload, batch)
+	return err
+}
 
-	if opcode != OpcodeCloseConnection && c.isClosed() {
-		return ErrConnClosed
+// 生成并写入一帧, 返回写入网络的字节数. 调用者必须持有 c.mu
+// Generates and writes a frame, returns the number of bytes written to the network. The caller must hold c.mu.
+func (c *Conn) writeLocked(opcode Opcode, payload internal.Payload, batch bool) (int, error) {
+	if opcode != OpcodeCloseConnection && c.IsClosed() {
+		return 0, ErrConnClosed
+	}
+	payload, err := c.intercept(opcode, payload)
+	if err != nil {
+		return 0, err
+	}
+	// 在扩展转换负载之前检查文本编码
+	// Check the text encoding before extensions transform the payload
+	if opcode == OpcodeText && !payload.CheckEncoding(c.config.CheckUtf8Enabled, uint8(opcode)) {
+		return 0, ErrTextEncoding
+	}
+	payload, rsv, err := c.encodeExtensions(opcode, payload)
+	if err != nil {
+		return 0, err
 	}
 
 	// 生成帧, 向连接写入内容, 最后更新压缩字典
@@ -126,19 +642,53 @@ func (c *Conn) doWrite(opcode Opcode, payload internal.Payload) error {
 	// For context_takeover mode to work correctly, the contexts of compression, writing, and dictionary updating must be synchronized.
 	frame, err := c.genFrame(opcode, payload, frameConfig{
 		fin:           true,
-		compress:      c.pd.Enabled,
+		compress:      c.CompressionEnabled(),
 		broadcast:     false,
-		checkEncoding: c.config.CheckUtf8Enabled,
+		checkEncoding: false,
+		rsv:           rsv,
 	})
 	if err != nil {
-		return err
+		return 0, err
+	}
+	n, err := c.bufferedWrite(frame, batch)
+	if err == nil {
+		c.statsWrite(internal.SelectValue(opcode.isDataFrame(), 1, 0), frame.Len())
 	}
-	err = internal.WriteN(c.conn, frame.Bytes())
 	_, _ = payload.WriteTo(&c.cpsWindow)
 	binaryPool.Put(frame)
-	return err
+	return n, err
+}
+
+// 调用写入拦截器, 关闭帧不经过拦截器. 调用者必须持有 c.mu
+// Calls the write interceptor, close frames bypass it. The caller must hold c.mu.
+func (c *Conn) intercept(opcode Opcode, payload internal.Payload) (internal.Payload, error) {
+	if c.config.WriteInterceptor == nil || opcode == OpcodeCloseConnection {
+		return payload, nil
+	}
+	// 传入副本, 拦截器原地修改负载或者向剩余容量追加数据都不会影响调用者(可能被多个连接共享)的缓冲区
+	// A copy is passed, so modifying the payload in place or appending into spare capacity never touches
+	// the buffer of the caller, which may be shared across connections
+	var p = payloadBytes(payload)
+	if _, ok := payload.(internal.Bytes); ok {
+		p = append(make([]byte, 0, len(p)), p...)
+	}
+	p, err := c.config.WriteInterceptor(opcode, p)
+	if err != nil {
+		return nil, &interceptError{err: err}
+	}
+	return internal.Bytes(p), nil
+}
+
+// 写入拦截器返回的错误, 属于被拒绝的写入
+// Error returned by the write interceptor, it counts as a rejected write
+type interceptError struct {
+	err error
 }
 
+func (c *interceptError) Error() string { return c.err.Error() }
+
+func (c *interceptError) Unwrap() error { return c.err }
+
 // WebSocket帧配置, 用于重写连接里面的配置, 以适配各种场景
 // WebSocket frame configuration, used to rewrite the configuration inside the connection, to adapt to various scenarios
 type frameConfig struct {
@@ -157,6 +707,10 @@ type frameConfig struct {
 	// 是否检查文本编码
 	// Whether to check text encoding
 	checkEncoding bool
+
+	// 自定义扩展的保留位
+	// Reserved bits of custom extensions
+	rsv RSVBit
 }
 
 // 生成帧数据
@@ -169,6 +723,11 @@ func (c *Conn) genFrame(opcode Opcode, payload internal.Payload, cfg frameConfig
 	if n > c.config.WriteMaxPayloadSize {
 		return nil, ErrMessageTooLarge
 	}
+	// RFC6455: 控制帧的负载不能超过 125 字节
+	// RFC6455: Control frames MUST have a payload length of 125 bytes or less
+	if !opcode.isDataFrame() && n > internal.ThresholdV1 {
+		return nil, ErrMessageTooLarge
+	}
 
 	var buf = binaryPool.Get(n + frameHeaderSize)
 	buf.Write(framePadding[0:])
@@ -184,6 +743,7 @@ func (c *Conn) genFrame(opcode Opcode, payload internal.Payload, cfg frameConfig
 	if !c.isServer {
 		internal.MaskXOR(contents[frameHeaderSize:], maskBytes)
 	}
+	header[0] |= byte(cfg.rsv)
 	var m = frameHeaderSize - headerLength
 	copy(contents[m:], header[:headerLength])
 	buf.Next(m)
@@ -195,18 +755,25 @@ func (c *Conn) genFrame(opcode Opcode, payload internal.Payload, cfg frameConfig
 func (c *Conn) compressData(opcode Opcode, payload internal.Payload, buf *bytes.Buffer, cfg frameConfig) (*bytes.Buffer, error) {
 	// 广播模式必须保证每一帧都是相同的内容, 所以不能使用字典优化压缩率
 	// Broadcast mode must ensure that every frame is the same, so you can't use a dictionary to optimize the compression rate.
-	var dict = internal.SelectValue(cfg.broadcast, nil, c.cpsWindow.dict)
-	if err := c.deflater.Compress(payload, buf, dict); err != nil {
+	var dict = internal.SelectValue(cfg.broadcast, nil, c.compressDict())
+	if err := c.getCompressor().Compress(payload, buf, dict); err != nil {
 		return nil, err
 	}
 
 	var contents = buf.Bytes()
 	var payloadSize = buf.Len() - frameHeaderSize
+	if !cfg.broadcast {
+		c.statsCompressed(payload.Len() - payloadSize)
+		if c.pd.Adaptive && !c.cpsWindow.enabled && !c.adaptive.observe(payload.Len(), payloadSize) {
+			atomic.StoreUint32(&c.cpsDisabled, 1)
+		}
+	}
 	var header = frameHeader{}
 	headerLength, maskBytes := header.GenerateHeader(c.isServer, cfg.fin, true, opcode, payloadSize)
 	if !c.isServer {
 		internal.MaskXOR(contents[frameHeaderSize:], maskBytes)
 	}
+	header[0] |= byte(cfg.rsv)
 	var m = frameHeaderSize - headerLength
 	copy(contents[m:], header[:headerLength])
 	buf.Next(m)
@@ -245,11 +812,18 @@ func NewBroadcaster(opcode Opcode, payload []byte) *Broadcaster {
 // 将帧数据写入连接
 // Writes the frame data to the connection
 func (c *Broadcaster) writeFrame(socket *Conn, frame *bytes.Buffer) error {
-	if socket.isClosed() {
+	if socket.IsClosed() {
 		return ErrConnClosed
 	}
+	if err := socket.limiter.wait(frame.Len()); err != nil {
+		return err
+	}
 	socket.mu.Lock()
-	var err = internal.WriteN(socket.conn, frame.Bytes())
+	socket.waitFragments()
+	var _, err = socket.bufferedWrite(frame, socket.config.WriteBatchSize > 1)
+	if err == nil {
+		socket.statsWrite(1, frame.Len())
+	}
 	_, _ = socket.cpsWindow.Write(c.payload)
 	socket.mu.Unlock()
 	return err
@@ -258,14 +832,16 @@ func (c *Broadcaster) writeFrame(socket *Conn, frame *bytes.Buffer) error {
 // Broadcast 广播
 // 向客户端发送广播消息
 // Send a broadcast message to a client.
+// 发送队列已满且消息被拒绝时返回 ErrQueueFull
+// Returns ErrQueueFull if the write queue is full and the message is rejected.
 func (c *Broadcaster) Broadcast(socket *Conn) error {
-	var idx = internal.SelectValue(socket.pd.Enabled, 1, 0)
+	var idx = internal.SelectValue(socket.CompressionEnabled(), 1, 0)
 	var msg = c.msgs[idx]
 
 	msg.once.Do(func() {
 		msg.frame, msg.err = socket.genFrame(c.opcode, internal.Bytes(c.payload), frameConfig{
 			fin:           true,
-			compress:      socket.pd.Enabled,
+			compress:      socket.CompressionEnabled(),
 			broadcast:     true,
 			checkEncoding: socket.config.CheckUtf8Enabled,
 		})
@@ -275,16 +851,26 @@ func (c *Broadcaster) Broadcast(socket *Conn) error {
 	}
 
 	atomic.AddInt64(&c.state, 1)
-	socket.writeQueue.Push(func() {
+	ok := socket.async(func() {
 		var err = c.writeFrame(socket, msg.frame)
 		socket.emitError(false, err)
-		if atomic.AddInt64(&c.state, -1) == 0 {
-			c.doClose()
-		}
-	})
+		c.release()
+	}, c.release)
+	if !ok {
+		c.release()
+		return ErrQueueFull
+	}
 	return nil
 }
 
+// 一次广播结束(写入完成, 被拒绝或者被丢弃), 最后一次结束时释放资源
+// Ends one broadcast (written, rejected or evicted), the resources are released after the last one
+func (c *Broadcaster) release() {
+	if atomic.AddInt64(&c.state, -1) == 0 {
+		c.doClose()
+	}
+}
+
 // 释放资源
 // releases resources
 func (c *Broadcaster) doClose() {
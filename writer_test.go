@@ -3,13 +3,19 @@ package gws
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/lxzan/gws/internal"
 	"github.com/stretchr/testify/assert"
@@ -152,8 +158,10 @@ func TestWriteClose(t *testing.T) {
 		var wg = &sync.WaitGroup{}
 		wg.Add(1)
 
+		// 保留的 1006 不会发送, 对端收到的是不带状态码的关闭帧
+		// The reserved 1006 is not sent, the peer receives a close frame without status code
 		serverHandler.onClose = func(socket *Conn, err error) {
-			if v, ok := err.(*CloseError); ok && string(v.Reason) == "goodbye" {
+			if v, ok := err.(*CloseError); ok && v.Code == CloseNoStatusReceived && len(v.Reason) == 0 {
 				wg.Done()
 			}
 		}
@@ -194,10 +202,37 @@ func TestWriteClose(t *testing.T) {
 		go server.ReadLoop()
 		go client.ReadLoop()
 
-		var err = client.WriteClose(1006, internal.AlphabetNumeric.Generate(1024))
+		var err = client.WriteClose(1000, internal.AlphabetNumeric.Generate(1024))
 		assert.NoError(t, err)
 		wg.Wait()
 	})
+
+	t.Run("truncate utf8", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{CheckUtf8Enabled: true}
+		var clientOption = &ClientOption{CheckUtf8Enabled: true}
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+
+		serverHandler.onClose = func(socket *Conn, err error) {
+			if v, ok := err.(*CloseError); ok {
+				as.Equal(uint16(1000), v.Code)
+				as.Equal(122, len(v.Reason))
+				as.True(utf8.Valid(v.Reason))
+			}
+			wg.Done()
+		}
+
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var reason = append(internal.AlphabetNumeric.Generate(122), "中文"...)
+		var err = client.WriteClose(1000, reason)
+		as.NoError(err)
+		wg.Wait()
+	})
 }
 
 func TestConn_WriteAsyncError(t *testing.T) {
@@ -260,6 +295,514 @@ func TestConn_WriteClose(t *testing.T) {
 	wg.Wait()
 }
 
+func TestConn_WriteCloseError(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("ok", func(t *testing.T) {
+		var wg = sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		server, client := newPeer(serverHandler, nil, clientHandler, nil)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(ClosePolicyViolation, closeErr.Code)
+				as.Equal("bad request", string(closeErr.Reason))
+			}
+			wg.Done()
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(server.WriteCloseError(&CloseError{Code: ClosePolicyViolation, Reason: []byte("bad request")}))
+		as.ErrorIs(server.WriteCloseError(nil), ErrConnClosed)
+		wg.Wait()
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var wg = sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		server, client := newPeer(serverHandler, nil, clientHandler, nil)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(CloseNormalClosure, closeErr.Code)
+			}
+			wg.Done()
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(server.WriteCloseError(nil))
+		wg.Wait()
+	})
+}
+
+func TestConn_CloseWithError(t *testing.T) {
+	var as = assert.New(t)
+
+	var closeWith = func(err error) *CloseError {
+		var received = make(chan *CloseError, 1)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			errors.As(err, &closeErr)
+			received <- closeErr
+		}
+		server, client := newPeer(new(webSocketMocker), nil, clientHandler, nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(server.CloseWithError(err))
+		as.ErrorIs(server.CloseWithError(err), ErrConnClosed)
+		return <-received
+	}
+
+	var longReason = strings.Repeat("你", 50)
+	var cases = []struct {
+		name   string
+		err    error
+		code   uint16
+		reason string
+	}{
+		{name: "nil", err: nil, code: CloseNormalClosure},
+		{name: "eof", err: fmt.Errorf("read: %w", io.EOF), code: CloseNormalClosure},
+		{name: "close error", err: &CloseError{Code: ClosePolicyViolation, Reason: []byte("bad request")}, code: ClosePolicyViolation, reason: "bad request"},
+		{name: "invalid utf8", err: &CloseError{Code: ClosePolicyViolation, Reason: []byte{0xff, 0xfe}}, code: ClosePolicyViolation},
+		{name: "long reason", err: &CloseError{Code: ClosePolicyViolation, Reason: []byte(longReason)}, code: ClosePolicyViolation, reason: longReason[:123]},
+		{name: "deadline", err: context.DeadlineExceeded, code: CloseGoingAway},
+		{name: "canceled", err: context.Canceled, code: CloseGoingAway},
+		{name: "internal", err: errors.New("dial tcp 10.0.0.1:5432: connection refused"), code: CloseInternalErr, reason: "internal error"},
+	}
+	for _, item := range cases {
+		var closeErr = closeWith(item.err)
+		if as.NotNil(closeErr, item.name) {
+			as.Equal(item.code, closeErr.Code, item.name)
+			as.Equal(item.reason, string(closeErr.Reason), item.name)
+			as.True(utf8.Valid(closeErr.Reason), item.name)
+		}
+	}
+}
+
+func TestConn_KeepOpenOnRejectedWrite(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("keep open", func(t *testing.T) {
+		var wg = sync.WaitGroup{}
+		wg.Add(1)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{
+			KeepOpenOnRejectedWrite: true,
+			CheckUtf8Enabled:        true,
+			WriteMaxPayloadSize:     16,
+		}, clientHandler, nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.ErrorIs(server.WriteMessage(OpcodeText, []byte{0xff}), ErrTextEncoding)
+		as.ErrorIs(server.WriteMessage(OpcodeBinary, make([]byte, 17)), ErrMessageTooLarge)
+		as.False(server.IsClosed())
+		as.NoError(server.WriteString("hello"))
+		wg.Wait()
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		server, client := newPeer(new(webSocketMocker), &ServerOption{
+			KeepOpenOnRejectedWrite: true,
+			WriteRateLimit:          100,
+		}, new(webSocketMocker), nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(server.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)))
+		as.ErrorIs(server.WriteMessage(OpcodeBinary, make([]byte, 1000)), os.ErrDeadlineExceeded)
+		as.False(server.IsClosed())
+	})
+
+	t.Run("close by default", func(t *testing.T) {
+		server, client := newPeer(new(webSocketMocker), &ServerOption{WriteMaxPayloadSize: 16}, new(webSocketMocker), nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.ErrorIs(server.WriteMessage(OpcodeBinary, make([]byte, 17)), ErrMessageTooLarge)
+		as.True(server.IsClosed())
+	})
+}
+
+func TestConn_WriteContext(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("ok", func(t *testing.T) {
+		var wg = sync.WaitGroup{}
+		wg.Add(1)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(new(webSocketMocker), nil, clientHandler, nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		as.NoError(server.WriteContext(ctx, OpcodeText, []byte("hello")))
+		wg.Wait()
+		as.False(server.IsClosed())
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		server, _ := newPeer(new(webSocketMocker), nil, new(webSocketMocker), nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		as.ErrorIs(server.WriteContext(ctx, OpcodeText, []byte("hello")), context.Canceled)
+		as.False(server.IsClosed())
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		// 客户端不读取, 写入会一直阻塞. 没有写出任何字节, 连接保持打开
+		// The client never reads, so the write blocks. No byte was written, so the connection stays open.
+		server, _ := newPeer(new(webSocketMocker), nil, new(webSocketMocker), nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		as.ErrorIs(server.WriteContext(ctx, OpcodeBinary, make([]byte, 1024*1024)), context.Canceled)
+		as.False(server.IsClosed())
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		server, _ := newPeer(new(webSocketMocker), nil, new(webSocketMocker), nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		as.ErrorIs(server.WriteContext(ctx, OpcodeBinary, make([]byte, 1024*1024)), context.DeadlineExceeded)
+		as.False(server.IsClosed())
+	})
+
+	t.Run("partially written", func(t *testing.T) {
+		// 客户端只读取一部分, 帧写了一半, 连接被关闭
+		// The client only reads a part, the frame is half written and the connection is closed
+		server, client := newPeer(new(webSocketMocker), nil, new(webSocketMocker), nil)
+		go func() { _ = internal.ReadN(client.conn, make([]byte, 1024)) }()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		as.ErrorIs(server.WriteContext(ctx, OpcodeBinary, make([]byte, 1024*1024)), context.DeadlineExceeded)
+		as.True(server.IsClosed())
+	})
+
+	t.Run("waiting for lock", func(t *testing.T) {
+		// 其他协程持有写锁时只放弃等待, 不影响正在写入的帧
+		// While another goroutine holds the write lock, only the wait is given up and the frame being written is not affected
+		var clientHandler = new(webSocketMocker)
+		var received = make(chan int, 1)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			received <- message.Data.Len()
+		}
+		server, client := newPeer(new(webSocketMocker), nil, clientHandler, nil)
+		var written = make(chan error, 1)
+		go func() { written <- server.WriteMessage(OpcodeBinary, make([]byte, 1024*1024)) }()
+		time.Sleep(20 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		as.ErrorIs(server.WriteContext(ctx, OpcodeText, []byte("hello")), context.DeadlineExceeded)
+		as.False(server.IsClosed())
+
+		go client.ReadLoop()
+		as.NoError(<-written)
+		as.Equal(1024*1024, <-received)
+		as.NoError(server.WriteString("ok"))
+		as.Equal(2, <-received)
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		server, _ := newPeer(new(webSocketMocker), &ServerOption{WriteRateLimit: 16}, new(webSocketMocker), nil)
+		go func() { _, _ = io.Copy(io.Discard, server.conn) }()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		var start = time.Now()
+		as.ErrorIs(server.WriteContext(ctx, OpcodeBinary, make([]byte, 1024)), context.DeadlineExceeded)
+		as.Less(time.Since(start), time.Second)
+		as.False(server.IsClosed())
+	})
+
+	t.Run("pre-write error", func(t *testing.T) {
+		server, _ := newPeer(new(webSocketMocker), &ServerOption{CheckUtf8Enabled: true, KeepOpenOnRejectedWrite: true}, new(webSocketMocker), nil)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		as.ErrorIs(server.WriteContext(ctx, OpcodeText, []byte{0xff}), ErrTextEncoding)
+		as.False(server.IsClosed())
+	})
+
+	t.Run("keeps write deadline", func(t *testing.T) {
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {}
+		server, client := newPeer(new(webSocketMocker), nil, clientHandler, nil)
+		go client.ReadLoop()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		as.NoError(server.SetWriteDeadline(time.Now().Add(-time.Second)))
+		as.ErrorIs(server.WriteContext(ctx, OpcodeText, []byte("hello")), os.ErrDeadlineExceeded)
+	})
+}
+
+func TestConn_WritePingPong(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("server", func(t *testing.T) {
+		server, client := newPeer(new(webSocketMocker), &ServerOption{
+			PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+		}, new(webSocketMocker), nil)
+		go func() {
+			_ = server.WritePing([]byte("hi"))
+			_ = server.WritePong(nil)
+		}()
+		var buf = make([]byte, 6)
+		as.NoError(internal.ReadN(client.conn, buf))
+		as.Equal([]byte{0x89, 0x02, 'h', 'i', 0x8A, 0x00}, buf)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		SetMaskKeyFunc(func() [4]byte { return [4]byte{1, 2, 3, 4} })
+		defer SetMaskKeyFunc(nil)
+		server, client := newPeer(new(webSocketMocker), nil, new(webSocketMocker), nil)
+		go func() { _ = client.WritePong([]byte("ok")) }()
+		var buf = make([]byte, 8)
+		as.NoError(internal.ReadN(server.conn, buf))
+		as.Equal([]byte{0x8A, 0x82, 1, 2, 3, 4, 'o' ^ 1, 'k' ^ 2}, buf)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		server, _ := newPeer(new(webSocketMocker), &ServerOption{KeepOpenOnRejectedWrite: true}, new(webSocketMocker), nil)
+		as.ErrorIs(server.WritePing(make([]byte, 126)), ErrMessageTooLarge)
+		as.ErrorIs(server.WritePong(make([]byte, 126)), ErrMessageTooLarge)
+		as.False(server.IsClosed())
+	})
+}
+
+func TestConn_WriteBatch(t *testing.T) {
+	var as = assert.New(t)
+
+	var run = func(pd PermessageDeflate) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(4)
+		var received []string
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			received = append(received, message.Data.String())
+			wg.Done()
+		}
+		serverHandler.onPing = func(socket *Conn, payload []byte) {
+			received = append(received, "ping:"+string(payload))
+			wg.Done()
+		}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{PermessageDeflate: pd})
+		server, client, err := NewPipeConns(upgrader, new(webSocketMocker), &ClientOption{PermessageDeflate: pd})
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var long = strings.Repeat("hello", 100)
+		as.NoError(client.WriteBatch([]Frame{
+			{Opcode: OpcodeText, Payload: []byte("a")},
+			{Opcode: OpcodePing, Payload: []byte("b")},
+			{Opcode: OpcodeBinary, Payload: []byte(long)},
+			{Opcode: OpcodeText, Payload: []byte(long)},
+		}))
+		wg.Wait()
+		as.Equal([]string{"a", "ping:b", long, long}, received)
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		run(PermessageDeflate{})
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		run(PermessageDeflate{Enabled: true, Threshold: 64})
+	})
+
+	t.Run("context takeover", func(t *testing.T) {
+		run(PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true})
+	})
+
+	t.Run("invalid frame", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("ok", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, nil, new(webSocketMocker), &ClientOption{
+			KeepOpenOnRejectedWrite: true,
+			CheckUtf8Enabled:        true,
+		})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.ErrorIs(client.WriteBatch([]Frame{
+			{Opcode: OpcodeText, Payload: []byte("a")},
+			{Opcode: OpcodeText, Payload: []byte{0xff}},
+		}), ErrTextEncoding)
+		as.ErrorIs(client.WriteBatch([]Frame{
+			{Opcode: OpcodeText, Payload: []byte("a")},
+			{Opcode: OpcodePing, Payload: make([]byte, 126)},
+		}), ErrMessageTooLarge)
+		as.NoError(client.WriteBatch([]Frame{{Opcode: OpcodeText, Payload: []byte("ok")}}))
+		wg.Wait()
+	})
+}
+
+func TestConn_WriteRaw(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var received []string
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		received = append(received, message.Data.String())
+		wg.Done()
+	}
+	server, client := newPeer(new(webSocketMocker), nil, clientHandler, nil)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var encoder FrameEncoder
+	as.NoError(server.WriteRaw(encoder.EncodeServerFrame(true, false, OpcodeText, []byte("hello"))))
+	var frames = append(
+		encoder.EncodeServerFrame(false, false, OpcodeBinary, []byte("wor")),
+		encoder.EncodeServerFrame(true, false, OpcodeContinuation, []byte("ld"))...,
+	)
+	as.NoError(server.WriteRaw(frames))
+	wg.Wait()
+	as.Equal([]string{"hello", "world"}, received)
+
+	as.NoError(server.WriteClose(1000, nil))
+	as.ErrorIs(server.WriteRaw(encoder.EncodeServerFrame(true, false, OpcodeText, nil)), ErrConnClosed)
+}
+
+func TestConn_WriteInterceptor(t *testing.T) {
+	var as = assert.New(t)
+	var errReject = errors.New("reject")
+
+	t.Run("modify", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(5)
+		var received []string
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			received = append(received, message.Data.String())
+			wg.Done()
+		}
+		serverHandler.onPing = func(socket *Conn, payload []byte) {
+			received = append(received, "ping:"+string(payload))
+			wg.Done()
+		}
+		var seq = 0
+		var clientOption = &ClientOption{
+			WriteInterceptor: func(opcode Opcode, payload []byte) ([]byte, error) {
+				as.NotEqual(OpcodeCloseConnection, opcode)
+				seq++
+				return append([]byte(strconv.Itoa(seq)+":"), payload...), nil
+			},
+		}
+		server, client := newPeer(serverHandler, nil, new(webSocketMocker), clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(client.WriteString("a"))
+		as.NoError(client.Writev(OpcodeText, []byte("b"), []byte("c")))
+		as.NoError(client.WritePing([]byte("d")))
+		var done = make(chan error)
+		client.WriteAsync(OpcodeText, []byte("e"), func(err error) { done <- err })
+		as.NoError(<-done)
+		as.NoError(client.WriteBatch([]Frame{{Opcode: OpcodeText, Payload: []byte("f")}}))
+		wg.Wait()
+		as.Equal([]string{"1:a", "2:bc", "ping:3:d", "4:e", "5:f"}, received)
+		as.NoError(client.WriteClose(1000, nil))
+	})
+
+	t.Run("in place", func(t *testing.T) {
+		var messages = make(chan string, 1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			messages <- message.Data.String()
+		}
+		var clientOption = &ClientOption{
+			WriteInterceptor: func(opcode Opcode, payload []byte) ([]byte, error) {
+				payload[0] = 'X'
+				return append(payload, '!'), nil
+			},
+		}
+		server, client := newPeer(serverHandler, nil, new(webSocketMocker), clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 拦截器拿到的是副本, 调用者的缓冲区及其剩余容量保持不变
+		// The interceptor gets a copy, the buffer of the caller and its spare capacity stay untouched
+		var buf = make([]byte, 5, 8)
+		copy(buf[:cap(buf)], "hello???")
+		as.NoError(client.WriteMessage(OpcodeText, buf))
+		as.Equal("Xello!", <-messages)
+		as.Equal("hello???", string(buf[:cap(buf)]))
+		as.NoError(client.WriteClose(1000, nil))
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("ok", message.Data.String())
+			wg.Done()
+		}
+		var clientOption = &ClientOption{
+			KeepOpenOnRejectedWrite: true,
+			WriteInterceptor: func(opcode Opcode, payload []byte) ([]byte, error) {
+				if string(payload) != "ok" {
+					return nil, errReject
+				}
+				return payload, nil
+			},
+		}
+		server, client := newPeer(serverHandler, nil, new(webSocketMocker), clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.ErrorIs(client.WriteString("bad"), errReject)
+		as.ErrorIs(client.WriteBatch([]Frame{
+			{Opcode: OpcodeText, Payload: []byte("ok")},
+			{Opcode: OpcodeText, Payload: []byte("bad")},
+		}), errReject)
+		as.False(client.IsClosed())
+		as.NoError(client.WriteString("ok"))
+		wg.Wait()
+	})
+
+	t.Run("close on reject", func(t *testing.T) {
+		var clientOption = &ClientOption{
+			WriteInterceptor: func(opcode Opcode, payload []byte) ([]byte, error) {
+				return nil, errReject
+			},
+		}
+		server, client := newPeer(new(webSocketMocker), nil, new(webSocketMocker), clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.ErrorIs(client.WriteString("bad"), errReject)
+		as.True(client.IsClosed())
+	})
+}
+
 func TestNewBroadcaster(t *testing.T) {
 	var as = assert.New(t)
 
@@ -422,6 +965,106 @@ func TestRecovery(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 }
 
+func TestRecovery_ClosePanicked(t *testing.T) {
+	var as = assert.New(t)
+
+	var run = func(setup func(serverHandler *webSocketMocker), trigger func(client *Conn)) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		setup(serverHandler)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.ErrorIs(err, ErrHandlerPanic)
+			wg.Done()
+			panic("on close")
+		}
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(internal.CloseInternalErr.Uint16(), closeErr.Code)
+				as.Equal(ErrHandlerPanic.Error(), string(closeErr.Reason))
+			}
+			wg.Done()
+		}
+		var logger = new(testLogger)
+		var serverOption = &ServerOption{Logger: logger}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		trigger(client)
+		wg.Wait()
+
+		// 默认情况下回调的 panic 和 OnClose 的 panic 都被恢复并记录
+		// By default both the panic of the callback and the one of OnClose are recovered and logged
+		as.Eventually(func() bool {
+			logger.mu.Lock()
+			defer logger.mu.Unlock()
+			return len(logger.logs) == 2
+		}, time.Second, time.Millisecond)
+	}
+
+	t.Run("OnOpen", func(t *testing.T) {
+		run(func(serverHandler *webSocketMocker) {
+			serverHandler.onOpen = func(socket *Conn) { panic("on open") }
+		}, func(client *Conn) {})
+	})
+
+	t.Run("OnMessage", func(t *testing.T) {
+		run(func(serverHandler *webSocketMocker) {
+			serverHandler.onMessage = func(socket *Conn, message *Message) { panic("on message") }
+		}, func(client *Conn) { _ = client.WriteString("hi") })
+	})
+
+	t.Run("OnPing", func(t *testing.T) {
+		run(func(serverHandler *webSocketMocker) {
+			serverHandler.onPing = func(socket *Conn, payload []byte) { panic("on ping") }
+		}, func(client *Conn) { _ = client.WritePing(nil) })
+	})
+}
+
+func TestRecovery_Options(t *testing.T) {
+	var as = assert.New(t)
+	var call = func(recovery func(logger Logger)) {
+		defer recovery(new(testLogger))
+		panic("test")
+	}
+
+	t.Run("hook without recover", func(t *testing.T) {
+		var values []any
+		var recovery = newRecovery(true, func(logger Logger) {
+			values = append(values, recover())
+		})
+		as.NotPanics(func() { call(recovery) })
+		as.Equal([]any{"test"}, values)
+
+		var hooked = false
+		recovery = newRecovery(true, func(logger Logger) { hooked = true })
+		as.NotPanics(func() { call(recovery) })
+		as.True(hooked)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var off = false
+		var config = (&ClientOption{RecoverHandlerPanics: &off}).getConfig()
+		as.False(config.RecoverHandlerPanics)
+		as.Panics(func() { call(config.Recovery) })
+
+		config = (&ClientOption{RecoverHandlerPanics: &off, Recovery: Recovery}).getConfig()
+		as.NotPanics(func() { call(config.Recovery) })
+	})
+
+	t.Run("default", func(t *testing.T) {
+		var config = initClientOption(&ClientOption{}).getConfig()
+		as.True(config.RecoverHandlerPanics)
+		as.NotPanics(func() { call(config.Recovery) })
+
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), nil)
+		as.True(upgrader.option.getConfig().RecoverHandlerPanics)
+		as.NotPanics(func() { call(upgrader.option.getConfig().Recovery) })
+	})
+}
+
 func TestConn_Writev(t *testing.T) {
 	t.Run("", func(t *testing.T) {
 		var serverHandler = new(webSocketMocker)
@@ -572,6 +1215,95 @@ func TestConn_Async(t *testing.T) {
 	assert.True(t, internal.IsSameSlice(arr1, arr2))
 }
 
+func TestConn_WriteFragments(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("frames", func(t *testing.T) {
+		server, client := newPeer(new(webSocketMocker), nil, new(webSocketMocker), nil)
+		var content = internal.AlphabetNumeric.Generate(95)
+		go func() { as.NoError(server.WriteFragments(OpcodeText, 10, bytes.NewReader(content))) }()
+
+		var buf = bytes.NewBuffer(nil)
+		for i := 0; ; i++ {
+			var fh = frameHeader{}
+			n, err := fh.Parse(client.br)
+			as.NoError(err)
+			as.LessOrEqual(n, 10)
+			as.False(fh.GetRSV1())
+			as.Equal(internal.SelectValue(i == 0, OpcodeText, OpcodeContinuation), fh.GetOpcode())
+			var p = make([]byte, n)
+			as.NoError(internal.ReadN(client.br, p))
+			buf.Write(p)
+			if fh.GetFIN() {
+				break
+			}
+		}
+		as.Equal(content, buf.Bytes())
+	})
+
+	t.Run("compress", func(t *testing.T) {
+		var pd = PermessageDeflate{Enabled: true, Threshold: 1}
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+
+		var content = internal.AlphabetNumeric.Generate(64 * 1024)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(OpcodeBinary, message.Opcode)
+			as.Equal(content, message.Bytes())
+			wg.Done()
+		}
+
+		server, client := newPeer(serverHandler, &ServerOption{PermessageDeflate: pd}, clientHandler, &ClientOption{PermessageDeflate: pd})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(server.WriteFragments(OpcodeBinary, 1024, bytes.NewReader(content)))
+		wg.Wait()
+	})
+
+	t.Run("compressed frame size", func(t *testing.T) {
+		var pd = PermessageDeflate{Enabled: true, Threshold: 1}
+		var clientHandler = new(webSocketMocker)
+		var done = make(chan struct{})
+		var content = internal.AlphabetNumeric.Generate(64 * 1024)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(content, message.Bytes())
+			close(done)
+		}
+		var sizes []int
+		var rsv1 []bool
+		var clientOption = &ClientOption{
+			PermessageDeflate: pd,
+			OnFrame: func(socket *Conn, fin bool, compressed bool, opcode Opcode, payloadLen int) {
+				sizes = append(sizes, payloadLen)
+				rsv1 = append(rsv1, compressed)
+			},
+		}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{PermessageDeflate: pd}, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(server.WriteFragments(OpcodeBinary, 16, bytes.NewReader(content)))
+		<-done
+		if as.Greater(len(sizes), 2) {
+			for i, n := range sizes[:len(sizes)-1] {
+				as.Equal(16, n)
+				as.Equal(i == 0, rsv1[i])
+			}
+			as.LessOrEqual(sizes[len(sizes)-1], 16)
+			as.False(rsv1[len(rsv1)-1])
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		server, _ := newPeer(new(webSocketMocker), &ServerOption{WriteMaxPayloadSize: 8}, new(webSocketMocker), nil)
+		var err = server.WriteFragments(OpcodeText, 16, bytes.NewReader(internal.AlphabetNumeric.Generate(32)))
+		as.ErrorIs(err, ErrMessageTooLarge)
+	})
+}
+
 func TestConn_WriteFile(t *testing.T) {
 	t.Run("context_take_over 1", func(t *testing.T) {
 		var pd = PermessageDeflate{
@@ -837,16 +1569,153 @@ func TestConn_WriteFile(t *testing.T) {
 	})
 
 	t.Run("", func(t *testing.T) {
+		var frames []string
 		var fw = &flateWriter{
+			size: 2,
 			cb: func(index int, eof bool, p []byte) error {
+				frames = append(frames, string(p))
+				assert.Equal(t, index == 2, eof)
 				return nil
 			},
-			buffers: []*bytes.Buffer{
-				bytes.NewBufferString("he"),
-				bytes.NewBufferString("llo"),
-			},
+			buf: bytes.NewBufferString("hello"),
 		}
 		var err = fw.Flush()
 		assert.NoError(t, err)
+		assert.Equal(t, []string{"he", "ll", "o"}, frames)
+	})
+}
+
+func TestConn_CloseTimeout(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{CloseTimeout: 50 * time.Millisecond}
+	var clientOption = &ClientOption{}
+	server, _ := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+
+	// 对端不读取, 写入会一直阻塞
+	// The peer does not read, so writes block forever
+	var errs = make(chan error, 1)
+	server.WriteAsync(OpcodeText, []byte("hello"), func(err error) { errs <- err })
+	time.Sleep(10 * time.Millisecond)
+
+	var start = time.Now()
+	as.Error(server.WriteClose(1000, nil))
+	as.Less(time.Since(start), time.Second)
+	as.Error(<-errs)
+}
+
+func TestConn_CloseHandshake(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("await close frame", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var messages = make(chan string, 1)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			messages <- message.Data.String()
+		}
+		var closed = make(chan error, 1)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			closed <- err
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		time.Sleep(10 * time.Millisecond)
+
+		go func() { _ = server.WriteClose(1000, nil) }()
+		var frame = make([]byte, 4)
+		_, err := io.ReadFull(client.conn, frame)
+		as.NoError(err)
+		as.Equal(OpcodeCloseConnection, Opcode(frame[0]&15))
+
+		// 收到关闭帧回复之前连接保持打开, 期间的消息被丢弃
+		// The connection stays open until the close frame arrives, messages received meanwhile are discarded
+		as.NoError(client.WriteString("hello"))
+		select {
+		case <-closed:
+			as.Fail("closed before the close frame of the peer")
+		case <-messages:
+			as.Fail("message dispatched after close")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		as.NoError(client.WriteClose(1000, nil))
+		select {
+		case err := <-closed:
+			as.True(errors.Is(err, internal.CloseNormalClosure))
+		case <-time.After(time.Second):
+			as.Fail("not closed after the close frame of the peer")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var closed = make(chan struct{})
+		serverHandler.onClose = func(socket *Conn, err error) {
+			close(closed)
+		}
+		server, client := newPeer(serverHandler, &ServerOption{CloseTimeout: 50 * time.Millisecond}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		time.Sleep(10 * time.Millisecond)
+
+		// 对端读取了关闭帧但是不回复
+		// The peer reads the close frame but does not reply
+		go func() { _, _ = io.Copy(io.Discard, client.conn) }()
+		var start = time.Now()
+		as.NoError(server.WriteClose(1000, nil))
+		<-closed
+		as.GreaterOrEqual(time.Since(start), 40*time.Millisecond)
+		as.Less(time.Since(start), time.Second)
+	})
+
+	t.Run("without read loop", func(t *testing.T) {
+		server, client := newPeer(new(webSocketMocker), &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		go func() { _, _ = io.Copy(io.Discard, client.conn) }()
+		as.NoError(server.WriteClose(1000, nil))
+		_, err := server.conn.Write([]byte{0})
+		as.Error(err)
+	})
+}
+
+func TestConn_WriteJSON(t *testing.T) {
+	var as = assert.New(t)
+	type payload struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			var v payload
+			as.Equal(OpcodeText, message.Opcode)
+			as.NoError(message.Bind(&v))
+			as.Equal(payload{Name: "caster", Age: 18}, v)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(server.WriteJSON(payload{Name: "caster", Age: 18}))
+		wg.Wait()
+	})
+
+	t.Run("marshal error", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		server, _ := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		as.Error(server.WriteJSON(make(chan int)))
+		as.False(server.IsClosed())
+	})
+
+	t.Run("bind error", func(t *testing.T) {
+		var message = &Message{Opcode: OpcodeText, Data: bytes.NewBufferString("{")}
+		var v payload
+		as.Error(message.Bind(&v))
 	})
 }